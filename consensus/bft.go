@@ -0,0 +1,152 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// ----------------------------------------------------------------------------------
+// BFT is Tendermint-style consensus: a block is final the moment it's committed, so long
+// as fewer than a third of the validators are faulty. The validators come from the
+// genesis header; each height takes one or more rounds, each round proposed by the next
+// validator in line. The rounds themselves are run by the voter - see bft_voter.go.
+
+type BFTConfig struct {
+	// How long to wait on the round's proposal before prevoting nil
+	TimeoutPropose time.Duration
+
+	// How long to wait on 2/3+ prevotes - or precommits - that don't agree on a block
+	// before giving up on them
+	TimeoutPrevote   time.Duration
+	TimeoutPrecommit time.Duration
+
+	// Added to each timeout for every round the height has been through, so the timeouts
+	// grow until they're long enough for the network at hand
+	TimeoutDelta time.Duration
+
+	// How long after a commit the next height starts
+	BlockTime time.Duration
+}
+
+func DefaultBFTConfig() BFTConfig {
+	return BFTConfig{
+		TimeoutPropose:   time.Second * 3,
+		TimeoutPrevote:   time.Second,
+		TimeoutPrecommit: time.Second,
+		TimeoutDelta:     time.Millisecond * 500,
+		BlockTime:        DefaultBlockTime,
+	}
+}
+
+type BFT struct {
+	cfg BFTConfig
+}
+
+func NewBFT(cfg BFTConfig) *BFT {
+	return &BFT{
+		cfg: cfg,
+	}
+}
+
+// Prepare leaves the timestamp alone - when to propose is up to the voter
+func (e *BFT) Prepare(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error {
+
+	if !NewValidatorSet(chain.GenesisHeader().Validators).Contains(signer) {
+		return fmt.Errorf("%w: [%x] is not a validator", ErrWrongProposer, signer)
+	}
+
+	return nil
+}
+
+func (e *BFT) Finalize(chain ChainReader, header *proto.Header, txx []*proto.Transaction) (*proto.Block, error) {
+	return assemble(header, txx), nil
+}
+
+func (e *BFT) Seal(chain ChainReader, block *proto.Block, privKey *crypto.PrivateKey, stop <-chan struct{}) error {
+
+	types.SignBlock(privKey, block)
+
+	return nil
+}
+
+// VerifyHeader only checks a validator signed the block - which round's proposer it came
+// from is for the commit certificate to vouch for
+func (e *BFT) VerifyHeader(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error {
+
+	if !NewValidatorSet(chain.GenesisHeader().Validators).Contains(signer) {
+		return fmt.Errorf("%w: [%x] is not a validator", ErrWrongProposer, signer)
+	}
+
+	return nil
+}
+
+// Weight counts every block the same - committed blocks never fork, so there's no real
+// choice to make
+func (e *BFT) Weight(header *proto.Header) uint64 {
+	return 1
+}
+
+// VerifyCommit checks [block] carries precommits for it from 2/3+ of the validators, all
+// cast in the same round
+func (e *BFT) VerifyCommit(chain ChainReader, block *proto.Block) error {
+
+	commit := block.Commit
+	if commit == nil {
+		return fmt.Errorf("%w: block has none", ErrBadCommit)
+	}
+
+	hash := types.HashBlock(block)
+
+	if commit.Height != block.Header.Height || !bytes.Equal(commit.BlockHash, hash) {
+		return fmt.Errorf("%w: certificate is for another block", ErrBadCommit)
+	}
+
+	var (
+		validators = NewValidatorSet(chain.GenesisHeader().Validators)
+		signers    = make(map[string]bool)
+	)
+
+	for _, vote := range commit.Precommits {
+
+		if vote.Type != proto.VoteType_PRECOMMIT || vote.Height != commit.Height || vote.Round != commit.Round || !bytes.Equal(vote.BlockHash, hash) {
+			return fmt.Errorf("%w: vote by [%x] is not a precommit for the block", ErrBadCommit, vote.PublicKey)
+		}
+
+		if !validators.Contains(vote.PublicKey) {
+			return fmt.Errorf("%w: [%x] is not a validator", ErrBadCommit, vote.PublicKey)
+		}
+
+		if !types.VerifyVote(vote) {
+			return fmt.Errorf("%w: vote by [%x] has an invalid signature", ErrBadCommit, vote.PublicKey)
+		}
+
+		signers[hex.EncodeToString(vote.PublicKey)] = true
+	}
+
+	if len(signers) < quorum(validators.Len()) {
+		return fmt.Errorf("%w: (%d) of (%d) validators signed - (%d) needed", ErrBadCommit, len(signers), validators.Len(), quorum(validators.Len()))
+	}
+
+	return nil
+}
+
+func (e *BFT) NewVoter(backend Backend, privKey *crypto.PrivateKey) Voter {
+	return newBFTVoter(e.cfg, backend, privKey)
+}
+
+// quorum is the smallest number of validators that's more than 2/3 of [n]
+func quorum(n int) int {
+	return n*2/3 + 1
+}
+
+// oneHonest is the smallest number of validators that's more than 1/3 of [n] - at least
+// one of them is sure not to be faulty
+func oneHonest(n int) int {
+	return n/3 + 1
+}
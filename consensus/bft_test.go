@@ -0,0 +1,475 @@
+package consensus
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+
+	pb "google.golang.org/protobuf/proto"
+)
+
+var bftTestConfig = BFTConfig{
+	TimeoutPropose:   time.Millisecond * 200,
+	TimeoutPrevote:   time.Millisecond * 100,
+	TimeoutPrecommit: time.Millisecond * 100,
+	TimeoutDelta:     time.Millisecond * 50,
+	BlockTime:        time.Millisecond * 10,
+}
+
+// testNet connects voters in memory - every message goes to every voter that isn't down,
+// each on its own goroutine like it would over the network
+type testNet struct {
+	lock     sync.RWMutex
+	voters   []Voter
+	down     map[int]bool
+	backends []*testBackend
+}
+
+type testBackend struct {
+	testChain
+
+	net     *testNet
+	id      int
+	engine  *BFT
+	privKey *crypto.PrivateKey
+
+	lock   sync.Mutex
+	blocks []*proto.Block
+}
+
+func newTestNet(t *testing.T, n int) *testNet {
+
+	privKeys, chain := testValidators(n)
+
+	var (
+		net    = &testNet{down: make(map[int]bool)}
+		engine = NewBFT(bftTestConfig)
+	)
+
+	for i, privKey := range privKeys {
+
+		b := &testBackend{
+			testChain: *chain,
+			net:       net,
+			id:        i,
+			engine:    engine,
+			privKey:   privKey,
+			blocks:    []*proto.Block{{Header: chain.genesis}},
+		}
+
+		net.backends = append(net.backends, b)
+		net.voters = append(net.voters, engine.NewVoter(b, privKey))
+	}
+
+	t.Cleanup(func() {
+		for _, v := range net.voters {
+			v.Stop()
+		}
+	})
+
+	return net
+}
+
+func (net *testNet) start(skip ...int) {
+
+	for _, i := range skip {
+		net.down[i] = true
+	}
+
+	for i, v := range net.voters {
+		if !net.down[i] {
+			v.Start()
+		}
+	}
+}
+
+// join starts voter [i] late, missing everything the others have said so far
+func (net *testNet) join(i int) {
+
+	net.lock.Lock()
+	delete(net.down, i)
+	net.lock.Unlock()
+
+	net.voters[i].Start()
+}
+
+func (net *testNet) send(from int, fn func(v Voter)) {
+
+	net.lock.RLock()
+	defer net.lock.RUnlock()
+
+	for i, v := range net.voters {
+		if i != from && !net.down[i] {
+			go fn(v)
+		}
+	}
+}
+
+func (b *testBackend) GetHeader(hash []byte) *proto.Header {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, block := range b.blocks {
+		if bytes.Equal(types.HashBlock(block), hash) {
+			return block.Header
+		}
+	}
+
+	return nil
+}
+
+func (b *testBackend) Height() int {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return len(b.blocks) - 1
+}
+
+func (b *testBackend) tip() *proto.Block {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.blocks[len(b.blocks)-1]
+}
+
+func (b *testBackend) block(height int) *proto.Block {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.blocks[height]
+}
+
+func (b *testBackend) ProposeBlock() (*proto.Block, error) {
+
+	parent := b.tip().Header
+
+	header := &proto.Header{
+		Version:   1,
+		Height:    parent.Height + 1,
+		PrevHash:  types.HashHeader(parent),
+		Timestamp: time.Now().UnixNano(),
+	}
+
+	block, err := b.engine.Finalize(b, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return block, b.engine.Seal(b, block, b.privKey, nil)
+}
+
+func (b *testBackend) ValidateBlock(block *proto.Block) error {
+
+	if !bytes.Equal(block.Header.PrevHash, types.HashBlock(b.tip())) {
+		return fmt.Errorf("block does not build on the tip")
+	}
+
+	if !types.VerifyBlock(block) {
+		return fmt.Errorf("invalid block")
+	}
+
+	return b.engine.VerifyHeader(b, b.tip().Header, block.Header, block.PublicKey)
+}
+
+func (b *testBackend) Commit(block *proto.Block) error {
+
+	if err := b.engine.VerifyCommit(b, block); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if int(block.Header.Height) != len(b.blocks) {
+		return fmt.Errorf("block for height (%d) on chain of height (%d)", block.Header.Height, len(b.blocks)-1)
+	}
+
+	b.blocks = append(b.blocks, block)
+
+	return nil
+}
+
+func (b *testBackend) BroadcastProposal(p *proto.Proposal) {
+	b.net.send(b.id, func(v Voter) { v.HandleProposal(p) })
+}
+
+func (b *testBackend) BroadcastVote(vote *proto.Vote) {
+	b.net.send(b.id, func(v Voter) { v.HandleVote(vote) })
+}
+
+// waitForHeight waits until every voter that's up has committed up to [height], and
+// checks they all committed the same blocks
+func (net *testNet) waitForHeight(t *testing.T, height int) {
+
+	require.Eventually(t, func() bool {
+		for i, b := range net.backends {
+			if !net.down[i] && b.Height() < height {
+				return false
+			}
+		}
+		return true
+	}, time.Second*10, time.Millisecond*10)
+
+	var first *testBackend
+
+	for i, b := range net.backends {
+
+		if net.down[i] {
+			continue
+		}
+
+		if first == nil {
+			first = b
+			continue
+		}
+
+		for h := 1; h <= height; h++ {
+			require.Equal(t, types.HashBlock(first.block(h)), types.HashBlock(b.block(h)), "height (%d)", h)
+		}
+	}
+}
+
+func TestBFTCommitsWithFourValidators(t *testing.T) {
+
+	net := newTestNet(t, 4)
+	net.start()
+	net.waitForHeight(t, 5)
+
+	b := net.backends[0]
+
+	for h := 1; h <= 5; h++ {
+
+		block := b.block(h)
+		require.Nil(t, b.engine.VerifyCommit(b, block))
+		require.GreaterOrEqual(t, len(block.Commit.Precommits), 3)
+	}
+}
+
+func TestBFTSurvivesOfflineValidator(t *testing.T) {
+
+	net := newTestNet(t, 4)
+
+	// Validator 1 proposes height 1 in round 0 - the others have to move on without it
+	net.start(1)
+	net.waitForHeight(t, 4)
+
+	b := net.backends[0]
+	require.Greater(t, b.block(1).Commit.Round, int32(0))
+
+	for h := 1; h <= 4; h++ {
+		require.Nil(t, b.engine.VerifyCommit(b, b.block(h)))
+	}
+}
+
+func TestBFTStallsWithoutQuorum(t *testing.T) {
+
+	net := newTestNet(t, 4)
+	net.start(1, 2)
+
+	time.Sleep(time.Second)
+
+	for _, i := range []int{0, 3} {
+		require.Equal(t, 0, net.backends[i].Height())
+	}
+}
+
+func TestBFTRecoversFromLateJoiners(t *testing.T) {
+
+	net := newTestNet(t, 4)
+	net.start(2, 3)
+
+	// Whatever 0 and 1 say before the others come up is lost on them
+	time.Sleep(time.Millisecond * 500)
+
+	net.join(2)
+	net.join(3)
+	net.waitForHeight(t, 3)
+}
+
+func TestVerifyCommitRejectsBadCertificates(t *testing.T) {
+
+	net := newTestNet(t, 4)
+	net.start()
+	net.waitForHeight(t, 1)
+
+	var (
+		b     = net.backends[0]
+		block = b.block(1)
+	)
+
+	cases := map[string]func(*proto.Block){
+		"missing": func(bl *proto.Block) { bl.Commit = nil },
+		"too few": func(bl *proto.Block) { bl.Commit.Precommits = bl.Commit.Precommits[:2] },
+		"duplicate signer": func(bl *proto.Block) {
+			bl.Commit.Precommits = append(bl.Commit.Precommits[:2], bl.Commit.Precommits[0])
+		},
+		"other block": func(bl *proto.Block) { bl.Commit.BlockHash = types.EmptyRootHash },
+		"other round": func(bl *proto.Block) { bl.Commit.Round++ },
+		"forged vote": func(bl *proto.Block) { bl.Commit.Precommits[0].Signature[0] ^= 0xff },
+		"outsider vote": func(bl *proto.Block) {
+			vote := &proto.Vote{Type: proto.VoteType_PRECOMMIT, Height: 1, Round: bl.Commit.Round, BlockHash: bl.Commit.BlockHash}
+			types.SignVote(crypto.GeneratePrivateKey(), vote)
+			bl.Commit.Precommits = append(bl.Commit.Precommits[:2], vote)
+		},
+	}
+
+	for name, tamper := range cases {
+
+		tampered := pb.Clone(block).(*proto.Block)
+		tamper(tampered)
+
+		require.ErrorIs(t, b.engine.VerifyCommit(b, tampered), ErrBadCommit, name)
+	}
+
+	// The original still passes
+	require.Nil(t, b.engine.VerifyCommit(b, block))
+}
+
+// ----------------------------------------------------------------------------------
+// Locking - one voter driven by hand, with the messages of the other three made up
+
+type recordingBackend struct {
+	testBackend
+
+	lock  sync.Mutex
+	votes []*proto.Vote
+}
+
+func (b *recordingBackend) BroadcastProposal(p *proto.Proposal) {}
+
+func (b *recordingBackend) BroadcastVote(vote *proto.Vote) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.votes = append(b.votes, vote)
+}
+
+// lastVote is the last vote of [voteType] the voter cast in [round], nil if none yet
+func (b *recordingBackend) lastVote(voteType proto.VoteType, round int) *proto.Vote {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i := len(b.votes) - 1; i >= 0; i-- {
+		if b.votes[i].Type == voteType && int(b.votes[i].Round) == round {
+			return b.votes[i]
+		}
+	}
+
+	return nil
+}
+
+func TestBFTLockingRules(t *testing.T) {
+
+	privKeys, chain := testValidators(4)
+
+	var (
+		engine  = NewBFT(bftTestConfig)
+		genesis = &proto.Block{Header: chain.genesis}
+		backend = &recordingBackend{
+			testBackend: testBackend{
+				testChain: *chain,
+				engine:    engine,
+				privKey:   privKeys[0],
+				blocks:    []*proto.Block{genesis},
+			},
+		}
+		voter = engine.NewVoter(backend, privKeys[0]).(*bftVoter)
+	)
+
+	t.Cleanup(voter.Stop)
+
+	// Height 1 is proposed by validator 1 in round 0, 2 in round 1, 3 in round 2
+	propose := func(round int, polRound int, block *proto.Block) {
+		p := &proto.Proposal{Height: 1, Round: int32(round), PolRound: int32(polRound), Block: block}
+		types.SignProposal(privKeys[1+round], p)
+		require.Nil(t, voter.HandleProposal(p))
+	}
+
+	vote := func(from []int, voteType proto.VoteType, round int, block *proto.Block) {
+		for _, i := range from {
+
+			v := &proto.Vote{Type: voteType, Height: 1, Round: int32(round)}
+			if block != nil {
+				v.BlockHash = types.HashBlock(block)
+			}
+
+			types.SignVote(privKeys[i], v)
+			require.Nil(t, voter.HandleVote(v))
+		}
+	}
+
+	blockBy := func(i int) *proto.Block {
+		b := &testBackend{testChain: *chain, engine: engine, privKey: privKeys[i], blocks: []*proto.Block{genesis}}
+		block, err := b.ProposeBlock()
+		require.Nil(t, err)
+		return block
+	}
+
+	waitForVote := func(voteType proto.VoteType, round int) *proto.Vote {
+		require.Eventually(t, func() bool { return backend.lastVote(voteType, round) != nil }, time.Second*5, time.Millisecond*5)
+		return backend.lastVote(voteType, round)
+	}
+
+	var (
+		blockA = blockBy(1)
+		blockB = blockBy(2)
+		hashA  = types.HashBlock(blockA)
+		hashB  = types.HashBlock(blockB)
+	)
+
+	voter.Start()
+
+	// Round 0: A gets 2/3+ prevotes - the voter locks on it and precommits it, but the
+	// others precommit nil and the round runs out
+	propose(0, -1, blockA)
+	require.Equal(t, hashA, waitForVote(proto.VoteType_PREVOTE, 0).BlockHash)
+
+	vote([]int{1, 2}, proto.VoteType_PREVOTE, 0, blockA)
+	require.Equal(t, hashA, waitForVote(proto.VoteType_PRECOMMIT, 0).BlockHash)
+
+	vote([]int{1, 2}, proto.VoteType_PRECOMMIT, 0, nil)
+
+	// Round 1: a fresh proposal for B - locked on A, the voter prevotes nil
+	propose(1, -1, blockB)
+	require.Empty(t, waitForVote(proto.VoteType_PREVOTE, 1).BlockHash)
+
+	// The prevotes for B come in too slowly - the voter gives up on them and precommits
+	// nil before the last one arrives, but then remembers B as the valid block
+	vote([]int{1, 2}, proto.VoteType_PREVOTE, 1, blockB)
+	require.Empty(t, waitForVote(proto.VoteType_PRECOMMIT, 1).BlockHash)
+
+	vote([]int{3}, proto.VoteType_PREVOTE, 1, blockB)
+
+	voter.lock.Lock()
+	require.Equal(t, 1, voter.validRound)
+	require.Equal(t, 0, voter.lockedRound)
+	voter.lock.Unlock()
+
+	vote([]int{1, 2}, proto.VoteType_PRECOMMIT, 1, nil)
+
+	// Round 2: B re-proposed with its round 1 prevotes - newer than the lock on A, so the
+	// voter lets go and prevotes B
+	propose(2, 1, blockB)
+	require.Equal(t, hashB, waitForVote(proto.VoteType_PREVOTE, 2).BlockHash)
+
+	vote([]int{1, 2}, proto.VoteType_PREVOTE, 2, blockB)
+	require.Equal(t, hashB, waitForVote(proto.VoteType_PRECOMMIT, 2).BlockHash)
+
+	// 2/3+ precommits in round 2 commit B
+	vote([]int{1, 2}, proto.VoteType_PRECOMMIT, 2, blockB)
+
+	require.Eventually(t, func() bool { return backend.Height() == 1 }, time.Second*5, time.Millisecond*5)
+	require.Equal(t, hashB, types.HashBlock(backend.block(1)))
+	require.Equal(t, int32(2), backend.block(1).Commit.Round)
+}
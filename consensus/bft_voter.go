@@ -0,0 +1,694 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+
+	pb "google.golang.org/protobuf/proto"
+)
+
+// ----------------------------------------------------------------------------------
+// bftVoter runs the rounds for one validator, following "The latest gossip on BFT
+// consensus" (Buchman, Kwon, Milosevic). Each round goes propose -> prevote -> precommit:
+//
+//   - the proposer proposes a block - the one it's seen 2/3+ prevotes for, if any
+//   - everyone prevotes the proposal, unless locked on another block
+//   - on 2/3+ prevotes for the block, everyone locks on it and precommits it
+//   - on 2/3+ precommits for the block, it's committed
+//
+// Wherever 2/3+ don't agree a timeout moves things along, ending in the next round. A
+// validator only lets go of its lock for a block with 2/3+ prevotes from a later round,
+// so no two blocks can ever get 2/3+ precommits at the same height.
+//
+// All of it happens under one lock - incoming messages are recorded, then the rules are
+// applied over and over until none of them has anything left to do.
+
+type bftStep int
+
+const (
+	stepNewHeight bftStep = iota // waiting out the block time after a commit
+	stepPropose
+	stepPrevote
+	stepPrecommit
+)
+
+// how far ahead of the current round messages are kept - anything further is dropped
+const maxRoundsAhead = 16
+
+type bftVoter struct {
+	cfg     BFTConfig
+	backend Backend
+	privKey *crypto.PrivateKey
+	pubKey  []byte
+
+	validators *ValidatorSet
+
+	lock    sync.Mutex
+	running bool
+
+	height int
+	round  int
+	step   bftStep
+
+	lockedBlock *proto.Block
+	lockedRound int
+	validBlock  *proto.Block
+	validRound  int
+
+	// what's been heard for this height and the next, by height and round
+	rounds map[int]map[int]*bftRound
+
+	// what the backend made of each block proposed at this height, by hash
+	checked map[string]error
+
+	timers []*time.Timer
+}
+
+type bftRound struct {
+	proposal   *proto.Proposal
+	prevotes   *voteSet
+	precommits *voteSet
+
+	// the rules that only ever fire once a round
+	prevoteWait   bool
+	precommitWait bool
+	polka         bool
+}
+
+func newBFTVoter(cfg BFTConfig, backend Backend, privKey *crypto.PrivateKey) *bftVoter {
+	return &bftVoter{
+		cfg:        cfg,
+		backend:    backend,
+		privKey:    privKey,
+		pubKey:     privKey.PubKey().Bytes(),
+		validators: NewValidatorSet(backend.GenesisHeader().Validators),
+		rounds:     make(map[int]map[int]*bftRound),
+	}
+}
+
+func (v *bftVoter) Start() {
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.running = true
+	v.newHeight(v.backend.Height() + 1)
+	v.startRound(0)
+	v.update()
+}
+
+func (v *bftVoter) Stop() {
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.running = false
+	v.stopTimers()
+}
+
+func (v *bftVoter) HandleProposal(p *proto.Proposal) error {
+
+	if p.Block == nil || p.Block.Header == nil || p.Block.Header.Height != p.Height {
+		return fmt.Errorf("%w: proposal carries no block for height (%d)", ErrBadVote, p.Height)
+	}
+
+	if p.Round < 0 || p.PolRound < -1 || p.PolRound >= p.Round {
+		return fmt.Errorf("%w: proposal round (%d) with pol round (%d)", ErrBadVote, p.Round, p.PolRound)
+	}
+
+	if v.validators.Len() == 0 || !bytes.Equal(v.validators.Proposer(int(p.Height), int(p.Round)), p.PublicKey) {
+		return fmt.Errorf("%w: [%x] is not the proposer for height (%d) round (%d)", ErrWrongProposer, p.PublicKey, p.Height, p.Round)
+	}
+
+	if !types.VerifyProposal(p) {
+		return fmt.Errorf("%w: proposal has an invalid signature", ErrBadVote)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if r := v.roundFor(int(p.Height), int(p.Round)); r != nil && r.proposal == nil {
+		r.proposal = p
+		v.update()
+	}
+
+	return nil
+}
+
+func (v *bftVoter) HandleVote(vote *proto.Vote) error {
+
+	if vote.Type != proto.VoteType_PREVOTE && vote.Type != proto.VoteType_PRECOMMIT {
+		return fmt.Errorf("%w: unknown vote type (%d)", ErrBadVote, vote.Type)
+	}
+
+	if !v.validators.Contains(vote.PublicKey) {
+		return fmt.Errorf("%w: [%x] is not a validator", ErrBadVote, vote.PublicKey)
+	}
+
+	if !types.VerifyVote(vote) {
+		return fmt.Errorf("%w: vote has an invalid signature", ErrBadVote)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.addVote(vote) {
+		v.update()
+	}
+
+	return nil
+}
+
+// roundFor is where messages for [height] and [round] are kept - nil if they're too old
+// or too far ahead to bother with
+func (v *bftVoter) roundFor(height int, round int) *bftRound {
+
+	if height < v.height || height > v.height+1 || round < 0 || round > v.round+maxRoundsAhead {
+		return nil
+	}
+
+	if v.rounds[height] == nil {
+		v.rounds[height] = make(map[int]*bftRound)
+	}
+
+	r, ok := v.rounds[height][round]
+	if !ok {
+		r = &bftRound{
+			prevotes:   newVoteSet(),
+			precommits: newVoteSet(),
+		}
+		v.rounds[height][round] = r
+	}
+
+	return r
+}
+
+func (v *bftVoter) addVote(vote *proto.Vote) bool {
+
+	r := v.roundFor(int(vote.Height), int(vote.Round))
+	if r == nil {
+		return false
+	}
+
+	if vote.Type == proto.VoteType_PREVOTE {
+		return r.prevotes.add(vote)
+	}
+
+	return r.precommits.add(vote)
+}
+
+// ----------------------------------------------------------------------------------
+// Moving through heights and rounds
+
+func (v *bftVoter) newHeight(height int) {
+
+	v.stopTimers()
+
+	for h := range v.rounds {
+		if h < height {
+			delete(v.rounds, h)
+		}
+	}
+
+	v.height = height
+	v.round = 0
+	v.step = stepNewHeight
+	v.lockedBlock, v.lockedRound = nil, -1
+	v.validBlock, v.validRound = nil, -1
+	v.checked = make(map[string]error)
+}
+
+func (v *bftVoter) startRound(round int) {
+
+	v.round = round
+	v.step = stepPropose
+
+	if v.validators.Len() > 0 && bytes.Equal(v.validators.Proposer(v.height, round), v.pubKey) {
+		v.propose()
+	}
+
+	v.schedule(v.timeout(v.cfg.TimeoutPropose), func() {
+		if v.step == stepPropose {
+			v.vote(proto.VoteType_PREVOTE, nil)
+		}
+	})
+
+	v.resend()
+}
+
+// resend repeats what this validator has said in the round for as long as the round
+// lasts - a peer that missed it, say by connecting late, would otherwise leave the round
+// waiting on 2/3+ that never come
+func (v *bftVoter) resend() {
+
+	v.schedule(v.timeout(v.cfg.TimeoutPropose), func() {
+
+		r := v.roundFor(v.height, v.round)
+
+		if r.proposal != nil && bytes.Equal(r.proposal.PublicKey, v.pubKey) {
+			v.backend.BroadcastProposal(r.proposal)
+		}
+
+		for _, set := range []*voteSet{r.prevotes, r.precommits} {
+			if vote, ok := set.votes[hex.EncodeToString(v.pubKey)]; ok {
+				v.backend.BroadcastVote(vote)
+			}
+		}
+
+		v.resend()
+	})
+}
+
+func (v *bftVoter) propose() {
+
+	block, polRound := v.validBlock, v.validRound
+
+	if block == nil {
+
+		var err error
+
+		if block, err = v.backend.ProposeBlock(); err != nil {
+			log.Printf("\n*** >>> [bft] failed to build a proposal for height (%d) - %v", v.height, err)
+			return
+		}
+
+		if int(block.Header.Height) != v.height {
+			log.Printf("\n*** >>> [bft] proposal built for height (%d) while voting on (%d)", block.Header.Height, v.height)
+			return
+		}
+
+		polRound = -1
+	}
+
+	p := &proto.Proposal{
+		Height:   int32(v.height),
+		Round:    int32(v.round),
+		PolRound: int32(polRound),
+		Block:    block,
+	}
+	types.SignProposal(v.privKey, p)
+
+	v.roundFor(v.height, v.round).proposal = p
+	v.backend.BroadcastProposal(p)
+}
+
+func (v *bftVoter) vote(voteType proto.VoteType, blockHash []byte) {
+
+	vote := &proto.Vote{
+		Type:      voteType,
+		Height:    int32(v.height),
+		Round:     int32(v.round),
+		BlockHash: blockHash,
+	}
+	types.SignVote(v.privKey, vote)
+
+	v.addVote(vote)
+	v.backend.BroadcastVote(vote)
+
+	if voteType == proto.VoteType_PREVOTE {
+		v.step = stepPrevote
+	} else {
+		v.step = stepPrecommit
+	}
+}
+
+// commit puts [block] on the chain with the precommits it got in [round], and moves on
+// to the next height once the block time is up
+func (v *bftVoter) commit(block *proto.Block, round int, precommits []*proto.Vote) {
+
+	decided := pb.Clone(block).(*proto.Block)
+	decided.Commit = &proto.Commit{
+		Height:     int32(v.height),
+		Round:      int32(round),
+		BlockHash:  types.HashBlock(block),
+		Precommits: precommits,
+	}
+
+	if err := v.backend.Commit(decided); err != nil {
+		log.Printf("\n*** >>> [bft] failed to commit block [%x] - %v", decided.Commit.BlockHash, err)
+		v.checked[hex.EncodeToString(decided.Commit.BlockHash)] = err
+		return
+	}
+
+	v.newHeight(v.backend.Height() + 1)
+
+	v.schedule(v.cfg.BlockTime, func() {
+		if v.step == stepNewHeight {
+			v.startRound(0)
+		}
+	})
+}
+
+// schedule runs [fn] after [d] - unless the height or round has moved on by then
+func (v *bftVoter) schedule(d time.Duration, fn func()) {
+
+	height, round := v.height, v.round
+
+	v.timers = append(v.timers, time.AfterFunc(d, func() {
+
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		if !v.running || v.height != height || v.round != round {
+			return
+		}
+
+		fn()
+		v.update()
+	}))
+}
+
+func (v *bftVoter) stopTimers() {
+
+	for _, t := range v.timers {
+		t.Stop()
+	}
+
+	v.timers = nil
+}
+
+func (v *bftVoter) timeout(base time.Duration) time.Duration {
+	return base + time.Duration(v.round)*v.cfg.TimeoutDelta
+}
+
+// ----------------------------------------------------------------------------------
+// Rules
+
+func (v *bftVoter) update() {
+
+	for v.running && v.apply() {
+	}
+}
+
+// apply fires the first rule that has something to do - false once none have
+func (v *bftVoter) apply() bool {
+	return v.catchUp() ||
+		v.decide() ||
+		v.skipRound() ||
+		v.prevoteProposal() ||
+		v.waitOnPrevotes() ||
+		v.lockOnPolka() ||
+		v.precommitNil() ||
+		v.waitOnPrecommits()
+}
+
+// catchUp moves on to the next height when the chain has got there without us - a
+// block committed by the others came in through the node
+func (v *bftVoter) catchUp() bool {
+
+	if height := v.backend.Height(); height >= v.height {
+		v.newHeight(height + 1)
+		v.startRound(0)
+		return true
+	}
+
+	return false
+}
+
+// decide commits a block once it has 2/3+ precommits in any round
+func (v *bftVoter) decide() bool {
+
+	for round, r := range v.rounds[v.height] {
+
+		hash, ok := r.precommits.quorum(v.validators.Len())
+		if !ok || len(hash) == 0 {
+			continue
+		}
+
+		block := v.proposedBlock(hash)
+		if block == nil || !v.valid(block) {
+			continue
+		}
+
+		v.commit(block, round, r.precommits.votesFor(hash))
+		return true
+	}
+
+	return false
+}
+
+// skipRound jumps ahead to a later round more than a third of the validators are in
+// already - at least one of them honest, so the round is real
+func (v *bftVoter) skipRound() bool {
+
+	skipTo := -1
+
+	for round, r := range v.rounds[v.height] {
+		if round > v.round && round > skipTo && r.senders() >= oneHonest(v.validators.Len()) {
+			skipTo = round
+		}
+	}
+
+	if skipTo < 0 {
+		return false
+	}
+
+	v.startRound(skipTo)
+
+	return true
+}
+
+// prevoteProposal prevotes the round's proposal - or nil, if it's invalid or we're locked
+// on another block and the proposal gives no reason to let go
+func (v *bftVoter) prevoteProposal() bool {
+
+	r := v.rounds[v.height][v.round]
+	if v.step != stepPropose || r == nil || r.proposal == nil {
+		return false
+	}
+
+	var (
+		p     = r.proposal
+		block = p.Block
+		hash  = types.HashBlock(block)
+		pol   = int(p.PolRound)
+	)
+
+	// A re-proposal has to wait for the prevotes it claims to have had
+	if pol >= 0 {
+
+		polRound := v.rounds[v.height][pol]
+		if polRound == nil || polRound.prevotes.count(hash) < quorum(v.validators.Len()) {
+			return false
+		}
+	}
+
+	if v.valid(block) && (v.lockedRound <= pol || v.locked(hash)) {
+		v.vote(proto.VoteType_PREVOTE, hash)
+	} else {
+		v.vote(proto.VoteType_PREVOTE, nil)
+	}
+
+	return true
+}
+
+// waitOnPrevotes gives 2/3+ prevotes that don't agree a while longer to come round
+func (v *bftVoter) waitOnPrevotes() bool {
+
+	r := v.rounds[v.height][v.round]
+	if v.step != stepPrevote || r == nil || r.prevoteWait || r.prevotes.len() < quorum(v.validators.Len()) {
+		return false
+	}
+
+	r.prevoteWait = true
+
+	v.schedule(v.timeout(v.cfg.TimeoutPrevote), func() {
+		if v.step == stepPrevote {
+			v.vote(proto.VoteType_PRECOMMIT, nil)
+		}
+	})
+
+	return true
+}
+
+// lockOnPolka locks on - and precommits - the round's proposal once it has 2/3+ prevotes
+func (v *bftVoter) lockOnPolka() bool {
+
+	r := v.rounds[v.height][v.round]
+	if v.step < stepPrevote || r == nil || r.polka || r.proposal == nil {
+		return false
+	}
+
+	var (
+		block = r.proposal.Block
+		hash  = types.HashBlock(block)
+	)
+
+	if r.prevotes.count(hash) < quorum(v.validators.Len()) || !v.valid(block) {
+		return false
+	}
+
+	r.polka = true
+
+	if v.step == stepPrevote {
+		v.lockedBlock, v.lockedRound = block, v.round
+		v.vote(proto.VoteType_PRECOMMIT, hash)
+	}
+
+	v.validBlock, v.validRound = block, v.round
+
+	return true
+}
+
+// precommitNil gives up on the round once 2/3+ prevoted nil
+func (v *bftVoter) precommitNil() bool {
+
+	r := v.rounds[v.height][v.round]
+	if v.step != stepPrevote || r == nil || r.prevotes.count(nil) < quorum(v.validators.Len()) {
+		return false
+	}
+
+	v.vote(proto.VoteType_PRECOMMIT, nil)
+
+	return true
+}
+
+// waitOnPrecommits moves on to the next round if 2/3+ precommits don't commit anything in time
+func (v *bftVoter) waitOnPrecommits() bool {
+
+	r := v.rounds[v.height][v.round]
+	if v.step == stepNewHeight || r == nil || r.precommitWait || r.precommits.len() < quorum(v.validators.Len()) {
+		return false
+	}
+
+	r.precommitWait = true
+
+	round := v.round
+
+	v.schedule(v.timeout(v.cfg.TimeoutPrecommit), func() {
+		v.startRound(round + 1)
+	})
+
+	return true
+}
+
+// ----------------------------------------------------------------------------------
+
+func (v *bftVoter) locked(hash []byte) bool {
+	return v.lockedBlock != nil && bytes.Equal(types.HashBlock(v.lockedBlock), hash)
+}
+
+// proposedBlock finds the block with [hash] among this height's proposals
+func (v *bftVoter) proposedBlock(hash []byte) *proto.Block {
+
+	for _, r := range v.rounds[v.height] {
+		if r.proposal != nil && bytes.Equal(types.HashBlock(r.proposal.Block), hash) {
+			return r.proposal.Block
+		}
+	}
+
+	return nil
+}
+
+// valid asks the backend about [block] - once per block
+func (v *bftVoter) valid(block *proto.Block) bool {
+
+	hash := hex.EncodeToString(types.HashBlock(block))
+
+	err, ok := v.checked[hash]
+	if !ok {
+
+		if int(block.Header.Height) != v.height {
+			err = fmt.Errorf("block is for height (%d)", block.Header.Height)
+		} else {
+			err = v.backend.ValidateBlock(block)
+		}
+
+		v.checked[hash] = err
+	}
+
+	return err == nil
+}
+
+// ----------------------------------------------------------------------------------
+// voteSet holds one kind of vote for one round - a validator's first vote is the one
+// that counts
+type voteSet struct {
+	votes map[string]*proto.Vote
+}
+
+func newVoteSet() *voteSet {
+	return &voteSet{
+		votes: make(map[string]*proto.Vote),
+	}
+}
+
+func (s *voteSet) add(vote *proto.Vote) bool {
+
+	key := hex.EncodeToString(vote.PublicKey)
+
+	if _, ok := s.votes[key]; ok {
+		return false
+	}
+
+	s.votes[key] = vote
+
+	return true
+}
+
+func (s *voteSet) len() int {
+	return len(s.votes)
+}
+
+// count is how many voted for [hash] - nil counting the votes for no block
+func (s *voteSet) count(hash []byte) int {
+
+	n := 0
+	for _, vote := range s.votes {
+		if bytes.Equal(vote.BlockHash, hash) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// quorum is the block hash 2/3+ of [n] validators voted for, if there is one
+func (s *voteSet) quorum(n int) ([]byte, bool) {
+
+	for _, vote := range s.votes {
+		if s.count(vote.BlockHash) >= quorum(n) {
+			return vote.BlockHash, true
+		}
+	}
+
+	return nil, false
+}
+
+func (s *voteSet) votesFor(hash []byte) []*proto.Vote {
+
+	votes := []*proto.Vote{}
+	for _, vote := range s.votes {
+		if bytes.Equal(vote.BlockHash, hash) {
+			votes = append(votes, vote)
+		}
+	}
+
+	return votes
+}
+
+// senders is how many validators have been heard from in the round
+func (r *bftRound) senders() int {
+
+	seen := make(map[string]bool)
+
+	if r.proposal != nil {
+		seen[hex.EncodeToString(r.proposal.PublicKey)] = true
+	}
+
+	for _, set := range []*voteSet{r.prevotes, r.precommits} {
+		for key := range set.votes {
+			seen[key] = true
+		}
+	}
+
+	return len(seen)
+}
@@ -0,0 +1,110 @@
+package consensus
+
+import (
+	"errors"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+)
+
+// ----------------------------------------------------------------------------------
+// An Engine is the set of rules deciding who may produce the next block, when, and
+// which branch wins when the chain forks. The node drives block production through it
+// and the chain checks every block it's handed against it, so neither knows which
+// engine is running.
+//
+// Producing a block goes:
+//
+//	Prepare  -> fill in the consensus fields of a header built on the tip
+//	Finalize -> assemble the block from the header and the transactions picked for it
+//	Seal     -> do whatever makes the block valid - sign it, mine it
+//
+// and every block received is held to VerifyHeader before the chain takes it.
+
+const DefaultBlockTime = time.Second * 5
+
+// ChainReader is what an engine gets to see of the chain
+type ChainReader interface {
+	// GetHeader looks up a header on any branch the chain knows of - nil if it doesn't
+	GetHeader(hash []byte) *proto.Header
+
+	GenesisHeader() *proto.Header
+}
+
+type Engine interface {
+	// Prepare fills in the consensus fields of [header], built on [parent], for a block
+	// [signer] would produce. Its timestamp is moved up to the earliest the engine lets
+	// that block be sealed - the caller waits until then. An error means [signer] can't
+	// produce the block at all.
+	Prepare(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error
+
+	// Finalize assembles the block from its prepared header and the transactions picked
+	// for it. The header is not to change after this, short of sealing.
+	Finalize(chain ChainReader, header *proto.Header, txx []*proto.Transaction) (*proto.Block, error)
+
+	// Seal makes [block] ready to be broadcast, giving up with ErrSealAborted once [stop]
+	// is closed. A nil [stop] never is.
+	Seal(chain ChainReader, block *proto.Block, privKey *crypto.PrivateKey, stop <-chan struct{}) error
+
+	// VerifyHeader checks [header], signed by [signer], keeps to the engine's rules on top
+	// of [parent]. Signatures and the link to the parent are checked by the chain.
+	VerifyHeader(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error
+
+	// Weight is the fork choice - what [header] adds to its branch. The branch with the
+	// most in total is the active one.
+	Weight(header *proto.Header) uint64
+}
+
+// Finality is for engines whose blocks only count once they carry proof the validators
+// agreed on them - the chain won't take a block that fails VerifyCommit
+type Finality interface {
+	VerifyCommit(chain ChainReader, block *proto.Block) error
+}
+
+// ----------------------------------------------------------------------------------
+// A VotingEngine settles each block by having the validators exchange proposals and
+// votes, rather than leaving one to seal it on its own. A validator node runs a Voter in
+// place of its proposing loop, feeding it whatever messages come in from the others.
+type VotingEngine interface {
+	Engine
+	NewVoter(backend Backend, privKey *crypto.PrivateKey) Voter
+}
+
+type Voter interface {
+	Start()
+	Stop()
+	HandleProposal(p *proto.Proposal) error
+	HandleVote(v *proto.Vote) error
+}
+
+// Backend is the node as a Voter sees it
+type Backend interface {
+	ChainReader
+
+	// Height of the last block on the chain
+	Height() int
+
+	// ProposeBlock builds and seals a block on top of the chain, to be proposed
+	ProposeBlock() (*proto.Block, error)
+
+	// ValidateBlock checks [block] could go on top of the chain as it is
+	ValidateBlock(block *proto.Block) error
+
+	// Commit puts a decided [block], commit certificate attached, on the chain
+	Commit(block *proto.Block) error
+
+	// Broadcasts go out to the other validators - not back to the Voter sending them
+	BroadcastProposal(p *proto.Proposal)
+	BroadcastVote(v *proto.Vote)
+}
+
+var (
+	ErrWrongProposer = errors.New("wrong proposer")
+	ErrSealAborted   = errors.New("sealing aborted")
+	ErrBadCommit     = errors.New("bad commit certificate")
+	ErrBadVote       = errors.New("bad vote")
+
+	ErrBadDifficulty    = errors.New("bad difficulty")
+	ErrInsufficientWork = errors.New("insufficient proof of work")
+)
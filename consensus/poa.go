@@ -0,0 +1,182 @@
+package consensus
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// ----------------------------------------------------------------------------------
+// Proof-of-authority
+//
+// The validators are listed in the genesis header and take turns by height: the one at
+// [height % n] is the scheduled proposer. If it misses its turn the next one in line may
+// propose once a proposer timeout has passed since the parent block, the one after that
+// once two have, and so on - so a validator that's offline stalls the chain for one
+// timeout at most.
+//
+// A block carries its proposer's slot, and weighs less the further down the line it
+// came from - so of two branches the same length, the one that kept to the schedule
+// wins. A fallback block is only taken once its slot has opened by our own clock, not
+// just by its timestamp, so a validator can't backdate its way in ahead of its turn.
+
+// What an in-turn block weighs - each slot further down the line weighs one less
+const maxSlotWeight = 1 << 16
+
+type PoAConfig struct {
+	// How long the scheduled proposer waits after the parent block
+	BlockTime time.Duration
+
+	// How long past its turn a proposer has before the next validator in line may step in
+	ProposerTimeout time.Duration
+}
+
+type PoA struct {
+	cfg   PoAConfig
+	clock func() time.Time
+}
+
+func NewPoA(cfg PoAConfig) *PoA {
+	return &PoA{
+		cfg:   cfg,
+		clock: time.Now,
+	}
+}
+
+func (e *PoA) Prepare(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error {
+
+	slot, err := e.slot(chain, parent, signer)
+	if err != nil {
+		return err
+	}
+
+	opens := SlotOpens(parent, slot, e.cfg.ProposerTimeout).Add(e.cfg.BlockTime)
+	header.Timestamp = max(header.Timestamp, opens.UnixNano())
+	header.Slot = int32(slot)
+
+	return nil
+}
+
+func (e *PoA) Finalize(chain ChainReader, header *proto.Header, txx []*proto.Transaction) (*proto.Block, error) {
+	return assemble(header, txx), nil
+}
+
+func (e *PoA) Seal(chain ChainReader, block *proto.Block, privKey *crypto.PrivateKey, stop <-chan struct{}) error {
+
+	types.SignBlock(privKey, block)
+
+	return nil
+}
+
+// VerifyHeader makes sure [header] comes from the validator whose turn it was on top of
+// [parent], and that its turn has come by our clock
+func (e *PoA) VerifyHeader(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error {
+
+	slot, err := e.slot(chain, parent, signer)
+	if err != nil {
+		return err
+	}
+
+	if int(header.Slot) != slot {
+		return fmt.Errorf("%w: [%x] claims slot (%d) - its slot is (%d)", ErrWrongProposer, signer, header.Slot, slot)
+	}
+
+	opens := SlotOpens(parent, slot, e.cfg.ProposerTimeout)
+
+	if time.Unix(0, header.Timestamp).Before(opens) || e.clock().Before(opens) {
+		return fmt.Errorf("%w: fallback slot (%d) for [%x] opens at %s",
+			ErrWrongProposer, slot, signer, opens.Format(time.RFC3339Nano))
+	}
+
+	return nil
+}
+
+func (e *PoA) Weight(header *proto.Header) uint64 {
+	return SlotWeight(header)
+}
+
+// slot is [signer]'s place in line for the block on top of [parent]
+func (e *PoA) slot(chain ChainReader, parent *proto.Header, signer []byte) (int, error) {
+
+	validators := NewValidatorSet(chain.GenesisHeader().Validators)
+
+	if validators.Len() == 0 {
+		return 0, fmt.Errorf("%w: genesis lists no validators", ErrWrongProposer)
+	}
+
+	slot, ok := validators.Slot(int(parent.Height)+1, signer)
+	if !ok {
+		return 0, fmt.Errorf("%w: [%x] is not a validator", ErrWrongProposer, signer)
+	}
+
+	return slot, nil
+}
+
+// ----------------------------------------------------------------------------------
+type ValidatorSet struct {
+	keys  [][]byte
+	index map[string]int
+}
+
+func NewValidatorSet(keys [][]byte) *ValidatorSet {
+
+	s := &ValidatorSet{
+		index: make(map[string]int),
+	}
+
+	for _, key := range keys {
+
+		hexKey := hex.EncodeToString(key)
+
+		if _, ok := s.index[hexKey]; ok {
+			continue
+		}
+
+		s.index[hexKey] = len(s.keys)
+		s.keys = append(s.keys, key)
+	}
+
+	return s
+}
+
+func (s *ValidatorSet) Len() int {
+	return len(s.keys)
+}
+
+func (s *ValidatorSet) Contains(pubKey []byte) bool {
+	_, ok := s.index[hex.EncodeToString(pubKey)]
+	return ok
+}
+
+// Proposer is who may propose at [height] in fallback [slot] - slot 0 being the
+// scheduled proposer
+func (s *ValidatorSet) Proposer(height int, slot int) []byte {
+	return s.keys[(height+slot)%len(s.keys)]
+}
+
+// Slot is [pubKey]'s place in line at [height], false if it isn't a validator
+func (s *ValidatorSet) Slot(height int, pubKey []byte) (int, bool) {
+
+	i, ok := s.index[hex.EncodeToString(pubKey)]
+	if !ok {
+		return 0, false
+	}
+
+	n := len(s.keys)
+
+	return ((i-height)%n + n) % n, true
+}
+
+// SlotWeight is what a block proposed from [header]'s slot weighs toward its branch
+func SlotWeight(header *proto.Header) uint64 {
+	return maxSlotWeight - uint64(min(max(header.Slot, 0), maxSlotWeight-1))
+}
+
+// SlotOpens is the earliest a block in [slot] may be timestamped on top of [parent]
+func SlotOpens(parent *proto.Header, slot int, timeout time.Duration) time.Time {
+	return time.Unix(0, parent.Timestamp).Add(time.Duration(slot) * timeout)
+}
@@ -0,0 +1,144 @@
+package consensus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/stretchr/testify/require"
+)
+
+// testChain is a chain of nothing but its genesis header
+type testChain struct {
+	genesis *proto.Header
+}
+
+func (c *testChain) GetHeader(hash []byte) *proto.Header {
+	return nil
+}
+
+func (c *testChain) GenesisHeader() *proto.Header {
+	return c.genesis
+}
+
+func testValidators(n int) ([]*crypto.PrivateKey, *testChain) {
+
+	var (
+		privKeys = make([]*crypto.PrivateKey, n)
+		chain    = &testChain{genesis: &proto.Header{Version: 1}}
+	)
+
+	for i := range privKeys {
+		privKeys[i] = crypto.GeneratePrivateKey()
+		chain.genesis.Validators = append(chain.genesis.Validators, privKeys[i].PubKey().Bytes())
+	}
+
+	return privKeys, chain
+}
+
+func TestValidatorSetSchedule(t *testing.T) {
+
+	privKeys, chain := testValidators(3)
+
+	// Duplicates keep their first place
+	set := NewValidatorSet(append(chain.genesis.Validators, chain.genesis.Validators[0]))
+	require.Equal(t, 3, set.Len())
+
+	for height := 0; height < 6; height++ {
+		for slot := 0; slot < 3; slot++ {
+
+			proposer := set.Proposer(height, slot)
+			require.Equal(t, privKeys[(height+slot)%3].PubKey().Bytes(), proposer)
+
+			got, ok := set.Slot(height, proposer)
+			require.True(t, ok)
+			require.Equal(t, slot, got)
+		}
+	}
+
+	_, ok := set.Slot(1, crypto.GeneratePrivateKey().PubKey().Bytes())
+	require.False(t, ok)
+}
+
+func TestPoAPrepareWaitsForSlot(t *testing.T) {
+
+	var (
+		privKeys, chain = testValidators(3)
+		engine          = NewPoA(PoAConfig{BlockTime: time.Second, ProposerTimeout: time.Second * 2})
+		parent          = &proto.Header{Height: 4, Timestamp: time.Now().UnixNano()}
+	)
+
+	// Height 5 belongs to validator 2, then 0, then 1
+	for slot, i := range []int{2, 0, 1} {
+
+		header := &proto.Header{Height: 5}
+		require.Nil(t, engine.Prepare(chain, parent, header, privKeys[i].PubKey().Bytes()))
+
+		want := parent.Timestamp + int64(time.Second) + int64(slot)*int64(time.Second*2)
+		require.Equal(t, want, header.Timestamp)
+		require.Equal(t, int32(slot), header.Slot)
+	}
+
+	// A timestamp already past the slot is left alone
+	late := &proto.Header{Height: 5, Timestamp: parent.Timestamp + int64(time.Hour)}
+	require.Nil(t, engine.Prepare(chain, parent, late, privKeys[2].PubKey().Bytes()))
+	require.Equal(t, parent.Timestamp+int64(time.Hour), late.Timestamp)
+
+	err := engine.Prepare(chain, parent, &proto.Header{Height: 5}, crypto.GeneratePrivateKey().PubKey().Bytes())
+	require.True(t, errors.Is(err, ErrWrongProposer))
+}
+
+func TestPoAVerifyHeader(t *testing.T) {
+
+	var (
+		privKeys, chain = testValidators(2)
+		engine          = NewPoA(PoAConfig{ProposerTimeout: time.Second})
+		parent          = &proto.Header{Height: 0, Timestamp: time.Now().UnixNano()}
+		header          = &proto.Header{Height: 1, Timestamp: parent.Timestamp}
+	)
+
+	// Our clock is well past both slots
+	engine.clock = func() time.Time { return time.Unix(0, parent.Timestamp).Add(time.Hour) }
+
+	require.Nil(t, engine.VerifyHeader(chain, parent, header, privKeys[1].PubKey().Bytes()))
+
+	header.Slot = 1
+	err := engine.VerifyHeader(chain, parent, header, privKeys[0].PubKey().Bytes())
+	require.True(t, errors.Is(err, ErrWrongProposer))
+
+	header.Timestamp += int64(time.Second)
+	require.Nil(t, engine.VerifyHeader(chain, parent, header, privKeys[0].PubKey().Bytes()))
+
+	// Claiming another slot than its own doesn't get a validator anywhere
+	header.Slot = 0
+	err = engine.VerifyHeader(chain, parent, header, privKeys[0].PubKey().Bytes())
+	require.True(t, errors.Is(err, ErrWrongProposer))
+
+	// Nor does a timestamp backdated into a slot that hasn't opened yet by our clock
+	header.Slot = 1
+	engine.clock = func() time.Time { return time.Unix(0, parent.Timestamp).Add(time.Millisecond * 500) }
+	err = engine.VerifyHeader(chain, parent, header, privKeys[0].PubKey().Bytes())
+	require.True(t, errors.Is(err, ErrWrongProposer))
+
+	// Nobody can propose on a chain without validators
+	err = engine.VerifyHeader(&testChain{genesis: &proto.Header{}}, parent, header, privKeys[0].PubKey().Bytes())
+	require.True(t, errors.Is(err, ErrWrongProposer))
+}
+
+func TestPoAWeightFollowsSchedule(t *testing.T) {
+
+	engine := NewPoA(PoAConfig{})
+
+	// Of two branches the same length, the one closer to the schedule wins - but length
+	// still comes first
+	inTurn := engine.Weight(&proto.Header{Slot: 0})
+	first := engine.Weight(&proto.Header{Slot: 1})
+	second := engine.Weight(&proto.Header{Slot: 2})
+
+	require.Greater(t, inTurn, first)
+	require.Greater(t, first, second)
+	require.Greater(t, 2*second, inTurn)
+	require.Greater(t, engine.Weight(&proto.Header{Slot: 1 << 20}), uint64(0))
+}
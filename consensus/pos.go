@@ -0,0 +1,244 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// ----------------------------------------------------------------------------------
+// Proof-of-stake
+//
+// Validators are whoever has coins bonded with them on the branch, as the chain tracks
+// it through bonding and unbonding transactions. For each block they're put in a line
+// drawn at random by stake, seeded from the hash of the block before - the more at
+// stake, the likelier a validator is to be near the front. The first in line proposes;
+// if it misses its turn, the next may step in once a proposer timeout has passed, and
+// so on, like PoA's fallback slots. Blocks carry and are weighed by their slot the same
+// way, and a fallback block waits for its slot to open by our own clock too.
+
+type PoSConfig struct {
+	// How long the first in line waits after the parent block
+	BlockTime time.Duration
+
+	// How long past its turn a proposer has before the next in line may step in
+	ProposerTimeout time.Duration
+
+	// How many blocks unbonded coins stay locked for
+	UnbondingPeriod int
+}
+
+func DefaultPoSConfig() PoSConfig {
+	return PoSConfig{
+		BlockTime:       DefaultBlockTime,
+		ProposerTimeout: DefaultBlockTime,
+		UnbondingPeriod: 100,
+	}
+}
+
+type Stake struct {
+	Validator []byte
+	Amount    uint64
+}
+
+// StakeReader is the chain as a staking engine needs to see it - the stakes as well as
+// the headers
+type StakeReader interface {
+	ChainReader
+
+	// Stakes lists every validator with coins bonded as of block [hash], on its branch
+	Stakes(hash []byte) ([]Stake, error)
+}
+
+// Staking is for engines that pick validators by stake - the chain only takes bonding
+// and unbonding transactions when running one
+type Staking interface {
+	UnbondingPeriod() int
+}
+
+type PoS struct {
+	cfg   PoSConfig
+	clock func() time.Time
+}
+
+func NewPoS(cfg PoSConfig) *PoS {
+	return &PoS{
+		cfg:   cfg,
+		clock: time.Now,
+	}
+}
+
+func (e *PoS) UnbondingPeriod() int {
+	return e.cfg.UnbondingPeriod
+}
+
+func (e *PoS) Prepare(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error {
+
+	slot, err := e.slot(chain, parent, signer)
+	if err != nil {
+		return err
+	}
+
+	opens := SlotOpens(parent, slot, e.cfg.ProposerTimeout).Add(e.cfg.BlockTime)
+	header.Timestamp = max(header.Timestamp, opens.UnixNano())
+	header.Slot = int32(slot)
+
+	return nil
+}
+
+func (e *PoS) Finalize(chain ChainReader, header *proto.Header, txx []*proto.Transaction) (*proto.Block, error) {
+	return assemble(header, txx), nil
+}
+
+func (e *PoS) Seal(chain ChainReader, block *proto.Block, privKey *crypto.PrivateKey, stop <-chan struct{}) error {
+
+	types.SignBlock(privKey, block)
+
+	return nil
+}
+
+// VerifyHeader makes sure [header] comes from the validator whose turn it was on top of
+// [parent], given the stakes as of [parent], and that its turn has come by our clock
+func (e *PoS) VerifyHeader(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error {
+
+	slot, err := e.slot(chain, parent, signer)
+	if err != nil {
+		return err
+	}
+
+	if int(header.Slot) != slot {
+		return fmt.Errorf("%w: [%x] claims slot (%d) - its slot is (%d)", ErrWrongProposer, signer, header.Slot, slot)
+	}
+
+	opens := SlotOpens(parent, slot, e.cfg.ProposerTimeout)
+
+	if time.Unix(0, header.Timestamp).Before(opens) || e.clock().Before(opens) {
+		return fmt.Errorf("%w: fallback slot (%d) for [%x] opens at %s",
+			ErrWrongProposer, slot, signer, opens.Format(time.RFC3339Nano))
+	}
+
+	return nil
+}
+
+func (e *PoS) Weight(header *proto.Header) uint64 {
+	return SlotWeight(header)
+}
+
+// slot is [signer]'s place in line for the block on top of [parent]
+func (e *PoS) slot(chain ChainReader, parent *proto.Header, signer []byte) (int, error) {
+
+	reader, ok := chain.(StakeReader)
+	if !ok {
+		return 0, fmt.Errorf("proof-of-stake needs the stakes to check a proposer against")
+	}
+
+	parentHash := types.HashHeader(parent)
+
+	stakes, err := reader.Stakes(parentHash)
+	if err != nil {
+		return 0, err
+	}
+
+	schedule := NewStakeSchedule(stakes, parentHash)
+
+	if schedule.Len() == 0 {
+		return 0, fmt.Errorf("%w: nothing is staked", ErrWrongProposer)
+	}
+
+	slot, ok := schedule.Slot(signer)
+	if !ok {
+		return 0, fmt.Errorf("%w: [%x] has nothing staked", ErrWrongProposer, signer)
+	}
+
+	return slot, nil
+}
+
+// ----------------------------------------------------------------------------------
+// StakeSchedule is the line of validators for one block. Each place is drawn from
+// those not yet in line, with odds in proportion to their stake.
+type StakeSchedule struct {
+	order [][]byte
+	index map[string]int
+}
+
+func NewStakeSchedule(stakes []Stake, seed []byte) *StakeSchedule {
+
+	// Same stakes, same line - however they were listed
+	pool := make([]Stake, 0, len(stakes))
+	total := new(big.Int)
+
+	for _, stake := range stakes {
+		if stake.Amount > 0 {
+			pool = append(pool, stake)
+			total.Add(total, new(big.Int).SetUint64(stake.Amount))
+		}
+	}
+
+	sort.Slice(pool, func(i, j int) bool {
+		return bytes.Compare(pool[i].Validator, pool[j].Validator) < 0
+	})
+
+	s := &StakeSchedule{
+		index: make(map[string]int),
+	}
+
+	for slot := 0; len(pool) > 0; slot++ {
+
+		draw := new(big.Int).Mod(new(big.Int).SetBytes(drawHash(seed, slot)), total)
+
+		for i, stake := range pool {
+
+			amount := new(big.Int).SetUint64(stake.Amount)
+
+			if draw.Cmp(amount) >= 0 {
+				draw.Sub(draw, amount)
+				continue
+			}
+
+			s.index[hex.EncodeToString(stake.Validator)] = len(s.order)
+			s.order = append(s.order, stake.Validator)
+
+			total.Sub(total, amount)
+			pool = append(pool[:i], pool[i+1:]...)
+			break
+		}
+	}
+
+	return s
+}
+
+// drawHash is the randomness behind [slot]'s draw
+func drawHash(seed []byte, slot int) []byte {
+
+	buf := make([]byte, len(seed)+8)
+	copy(buf, seed)
+	binary.BigEndian.PutUint64(buf[len(seed):], uint64(slot))
+
+	hash := sha256.Sum256(buf)
+
+	return hash[:]
+}
+
+func (s *StakeSchedule) Len() int {
+	return len(s.order)
+}
+
+// Proposer is who may propose in [slot] - past the end of the line it starts over
+func (s *StakeSchedule) Proposer(slot int) []byte {
+	return s.order[slot%len(s.order)]
+}
+
+// Slot is [pubKey]'s place in line, false if it has nothing staked
+func (s *StakeSchedule) Slot(pubKey []byte) (int, bool) {
+	slot, ok := s.index[hex.EncodeToString(pubKey)]
+	return slot, ok
+}
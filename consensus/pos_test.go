@@ -0,0 +1,131 @@
+package consensus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+// stakeChain is a testChain with the same stakes behind every block
+type stakeChain struct {
+	testChain
+	stakes []Stake
+}
+
+func (c *stakeChain) Stakes(hash []byte) ([]Stake, error) {
+	return c.stakes, nil
+}
+
+func TestStakeSchedule(t *testing.T) {
+
+	privKeys, _ := testValidators(3)
+
+	stakes := []Stake{
+		{Validator: privKeys[0].PubKey().Bytes(), Amount: 300},
+		{Validator: privKeys[1].PubKey().Bytes(), Amount: 100},
+		{Validator: privKeys[2].PubKey().Bytes(), Amount: 0},
+	}
+
+	var (
+		seed     = []byte("parent hash")
+		schedule = NewStakeSchedule(stakes, seed)
+	)
+
+	// Nothing staked, no place in line
+	require.Equal(t, 2, schedule.Len())
+	_, ok := schedule.Slot(privKeys[2].PubKey().Bytes())
+	require.False(t, ok)
+
+	for slot := 0; slot < 4; slot++ {
+		got, ok := schedule.Slot(schedule.Proposer(slot))
+		require.True(t, ok)
+		require.Equal(t, slot%2, got)
+	}
+
+	// The order stakes come in doesn't matter - the seed does
+	reversed := NewStakeSchedule([]Stake{stakes[2], stakes[1], stakes[0]}, seed)
+	require.Equal(t, schedule.Proposer(0), reversed.Proposer(0))
+
+	// Three times the stake, three times as often first in line
+	first := 0
+	for i := 0; i < 4000; i++ {
+		if string(NewStakeSchedule(stakes, drawHash(seed, i)).Proposer(0)) == string(stakes[0].Validator) {
+			first++
+		}
+	}
+	require.InDelta(t, 3000, first, 150)
+}
+
+func TestPoSVerifyHeader(t *testing.T) {
+
+	var (
+		privKeys, validators = testValidators(3)
+		pos                  = NewPoS(PoSConfig{BlockTime: time.Second, ProposerTimeout: time.Second})
+		parent               = &proto.Header{Version: 1, Height: 4}
+	)
+
+	chain := &stakeChain{testChain: *validators}
+	for _, privKey := range privKeys[:2] {
+		chain.stakes = append(chain.stakes, Stake{Validator: privKey.PubKey().Bytes(), Amount: 50})
+	}
+
+	schedule := NewStakeSchedule(chain.stakes, types.HashHeader(parent))
+
+	header := func(slot int32, after time.Duration) *proto.Header {
+		return &proto.Header{Version: 1, Height: 5, Slot: slot, Timestamp: parent.Timestamp + int64(after)}
+	}
+
+	// First in line right away, second only once the first has had its turn
+	require.Nil(t, pos.VerifyHeader(chain, parent, header(0, 0), schedule.Proposer(0)))
+	require.True(t, errors.Is(pos.VerifyHeader(chain, parent, header(1, time.Millisecond*999), schedule.Proposer(1)), ErrWrongProposer))
+	require.Nil(t, pos.VerifyHeader(chain, parent, header(1, time.Second), schedule.Proposer(1)))
+
+	// Claiming the first slot doesn't make the second in line first
+	require.True(t, errors.Is(pos.VerifyHeader(chain, parent, header(0, time.Second), schedule.Proposer(1)), ErrWrongProposer))
+
+	// Validator 2 is in the genesis but has nothing staked
+	require.True(t, errors.Is(pos.VerifyHeader(chain, parent, header(0, time.Hour), privKeys[2].PubKey().Bytes()), ErrWrongProposer))
+
+	// Prepare holds the proposer to its slot, plus the block time, and records the slot
+	next := header(0, 0)
+	require.Nil(t, pos.Prepare(chain, parent, next, schedule.Proposer(1)))
+	require.Equal(t, parent.Timestamp+int64(time.Second*2), next.Timestamp)
+	require.Equal(t, int32(1), next.Slot)
+
+	// Without the stakes there's nothing to go on
+	require.NotNil(t, pos.VerifyHeader(validators, parent, header(0, 0), schedule.Proposer(0)))
+
+	// The fallback block weighs less than the one from the first in line
+	require.Greater(t, pos.Weight(header(0, 0)), pos.Weight(header(1, 0)))
+}
+
+func TestPoSRejectsBackdatedFallback(t *testing.T) {
+
+	var (
+		privKeys, validators = testValidators(2)
+		pos                  = NewPoS(PoSConfig{BlockTime: time.Second, ProposerTimeout: time.Second})
+		parent               = &proto.Header{Version: 1, Height: 4, Timestamp: time.Now().UnixNano()}
+	)
+
+	chain := &stakeChain{testChain: *validators}
+	for _, privKey := range privKeys {
+		chain.stakes = append(chain.stakes, Stake{Validator: privKey.PubKey().Bytes(), Amount: 50})
+	}
+
+	var (
+		schedule = NewStakeSchedule(chain.stakes, types.HashHeader(parent))
+		header   = &proto.Header{Version: 1, Height: 5, Slot: 1, Timestamp: parent.Timestamp + int64(time.Second)}
+	)
+
+	// The timestamp says the fallback slot is open, but by our clock it's only been half
+	// a timeout since the parent
+	pos.clock = func() time.Time { return time.Unix(0, parent.Timestamp).Add(time.Millisecond * 500) }
+	require.True(t, errors.Is(pos.VerifyHeader(chain, parent, header, schedule.Proposer(1)), ErrWrongProposer))
+
+	pos.clock = func() time.Time { return time.Unix(0, parent.Timestamp).Add(time.Second) }
+	require.Nil(t, pos.VerifyHeader(chain, parent, header, schedule.Proposer(1)))
+}
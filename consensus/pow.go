@@ -0,0 +1,292 @@
+package consensus
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+
+	pb "google.golang.org/protobuf/proto"
+)
+
+// ----------------------------------------------------------------------------------
+// Proof-of-work
+//
+// Anyone may produce a block, so long as its header hashes in under the target its
+// [bits] encode. The target is worked out afresh for every block from how long the
+// blocks in the window before it took, so blocks keep coming at about the block time
+// however much hashing power joins or leaves. The branch with the most work wins.
+
+type PoWConfig struct {
+	// How often blocks should come, on average
+	BlockTime time.Duration
+
+	// How many blocks back the retarget looks
+	RetargetWindow int
+
+	// The easiest target allowed, in compact form - the chain starts out on it
+	PowLimit uint32
+
+	// How many goroutines search for the nonce
+	Threads int
+}
+
+func DefaultPoWConfig() PoWConfig {
+	return PoWConfig{
+		BlockTime:      DefaultBlockTime,
+		RetargetWindow: 20,
+		PowLimit:       0x1f00ffff,
+		Threads:        1,
+	}
+}
+
+// how many nonces a miner tries between checks on whether to give up
+const nonceBatch = 1024
+
+// work per block stops counting past this, so summing a branch can't overflow
+const maxWork = math.MaxUint64 >> 20
+
+type PoW struct {
+	cfg PoWConfig
+}
+
+func NewPoW(cfg PoWConfig) *PoW {
+
+	if cfg.Threads < 1 {
+		cfg.Threads = 1
+	}
+
+	return &PoW{
+		cfg: cfg,
+	}
+}
+
+func (e *PoW) Prepare(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error {
+
+	bits, err := e.NextBits(chain, parent)
+	if err != nil {
+		return err
+	}
+
+	header.Bits = bits
+	header.Timestamp = max(header.Timestamp, parent.Timestamp+1)
+
+	return nil
+}
+
+func (e *PoW) Finalize(chain ChainReader, header *proto.Header, txx []*proto.Transaction) (*proto.Block, error) {
+	return assemble(header, txx), nil
+}
+
+// Seal mines [block] - the miners each try their own share of the nonces until one of
+// them finds a header hash under the target - then signs it
+func (e *PoW) Seal(chain ChainReader, block *proto.Block, privKey *crypto.PrivateKey, stop <-chan struct{}) error {
+
+	var (
+		target = CompactToBig(block.Header.Bits)
+		found  = make(chan uint64, e.cfg.Threads)
+		quit   = make(chan struct{})
+	)
+
+	defer close(quit)
+
+	for i := 0; i < e.cfg.Threads; i++ {
+		go mine(pb.Clone(block.Header).(*proto.Header), uint64(i), uint64(e.cfg.Threads), target, found, quit)
+	}
+
+	select {
+	case nonce := <-found:
+		block.Header.Nonce = nonce
+	case <-stop:
+		return ErrSealAborted
+	}
+
+	types.SignBlock(privKey, block)
+
+	return nil
+}
+
+// mine tries every [step]th nonce from [start] on [header] until one hashes under
+// [target], or [quit] is closed
+func mine(header *proto.Header, start uint64, step uint64, target *big.Int, found chan<- uint64, quit <-chan struct{}) {
+
+	hash := new(big.Int)
+
+	for nonce := start; ; {
+
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		for i := 0; i < nonceBatch; i++ {
+
+			header.Nonce = nonce
+
+			if hash.SetBytes(types.HashHeader(header)).Cmp(target) <= 0 {
+				found <- nonce
+				return
+			}
+
+			nonce += step
+		}
+	}
+}
+
+// VerifyHeader checks [header] carries the target the retarget calls for and that its
+// hash comes in under it
+func (e *PoW) VerifyHeader(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error {
+
+	bits, err := e.NextBits(chain, parent)
+	if err != nil {
+		return err
+	}
+
+	if header.Bits != bits {
+		return fmt.Errorf("%w: block has bits (%08x) - (%08x) expected", ErrBadDifficulty, header.Bits, bits)
+	}
+
+	hash := types.HashHeader(header)
+
+	if new(big.Int).SetBytes(hash).Cmp(CompactToBig(bits)) > 0 {
+		return fmt.Errorf("%w: hash [%x] is above the target for bits (%08x)", ErrInsufficientWork, hash, bits)
+	}
+
+	return nil
+}
+
+// Weight is the work [header] proves - how many hashes it takes on average to get
+// under its target
+func (e *PoW) Weight(header *proto.Header) uint64 {
+	return Work(header.Bits)
+}
+
+// NextBits is the target, in compact form, for the block after [parent]. Until there
+// are RetargetWindow blocks to look back on it's the limit. After that it's the average
+// target over the window, scaled by how long the window took against how long it should
+// have - by a factor of four at most either way.
+func (e *PoW) NextBits(chain ChainReader, parent *proto.Header) (uint32, error) {
+
+	window := e.cfg.RetargetWindow
+
+	if window < 2 || int(parent.Height) < window {
+		return e.cfg.PowLimit, nil
+	}
+
+	var (
+		first = parent
+		sum   = new(big.Int)
+	)
+
+	// The window ends at [parent] on its own branch - which needn't be the active one
+	for i := 0; i < window; i++ {
+
+		if i > 0 {
+			if first = chain.GetHeader(first.PrevHash); first == nil {
+				return 0, fmt.Errorf("retarget window for height (%d) runs into an unknown block", parent.Height+1)
+			}
+		}
+
+		sum.Add(sum, CompactToBig(first.Bits))
+	}
+
+	var (
+		expected = int64(window-1) * int64(e.cfg.BlockTime)
+		actual   = min(max(parent.Timestamp-first.Timestamp, expected/4), expected*4)
+	)
+
+	target := sum.Div(sum, big.NewInt(int64(window)))
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	if limit := CompactToBig(e.cfg.PowLimit); target.Cmp(limit) > 0 {
+		target = limit
+	}
+
+	return BigToCompact(target), nil
+}
+
+// ----------------------------------------------------------------------------------
+// Targets in compact form, as Bitcoin has them: the top byte is the length of the
+// target in bytes and the lower three its leading bytes, the highest bit of which
+// would be a sign.
+
+func CompactToBig(bits uint32) *big.Int {
+
+	var (
+		mantissa = int64(bits & 0x007fffff)
+		exponent = uint(bits >> 24)
+		n        *big.Int
+	)
+
+	if exponent <= 3 {
+		n = big.NewInt(mantissa >> (8 * (3 - exponent)))
+	} else {
+		n = new(big.Int).Lsh(big.NewInt(mantissa), 8*(exponent-3))
+	}
+
+	if bits&0x00800000 != 0 {
+		n.Neg(n)
+	}
+
+	return n
+}
+
+// BigToCompact is the compact form of [n], rounded down to its three leading bytes
+func BigToCompact(n *big.Int) uint32 {
+
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var (
+		exponent = uint(len(n.Bytes()))
+		mantissa uint32
+	)
+
+	if exponent <= 3 {
+		mantissa = uint32(new(big.Int).Abs(n).Uint64() << (8 * (3 - exponent)))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(new(big.Int).Abs(n), 8*(exponent-3)).Uint64())
+	}
+
+	// The top bit is the sign - move over a byte to keep it clear
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+
+	return compact
+}
+
+// Work is how many hashes it takes on average to get under the target [bits] encode -
+// none for a target that isn't positive, like the genesis header's unset one
+func Work(bits uint32) uint64 {
+
+	target := CompactToBig(bits)
+
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	// 2^256 / (target + 1)
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	work.Div(work, target.Add(target, big.NewInt(1)))
+
+	if !work.IsUint64() || work.Uint64() > maxWork {
+		return maxWork
+	}
+
+	return work.Uint64()
+}
@@ -0,0 +1,180 @@
+package consensus
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+
+	pb "google.golang.org/protobuf/proto"
+)
+
+// headerChain is a line of headers that can be looked up by hash
+type headerChain struct {
+	headers []*proto.Header
+	byHash  map[string]*proto.Header
+}
+
+func newHeaderChain() *headerChain {
+
+	c := &headerChain{byHash: make(map[string]*proto.Header)}
+	c.add(&proto.Header{Version: 1})
+
+	return c
+}
+
+func (c *headerChain) add(h *proto.Header) {
+	c.headers = append(c.headers, h)
+	c.byHash[string(types.HashHeader(h))] = h
+}
+
+func (c *headerChain) tip() *proto.Header {
+	return c.headers[len(c.headers)-1]
+}
+
+// extend adds [n] headers with [bits], [gap] apart - unmined, which the retarget never
+// looks at
+func (c *headerChain) extend(n int, bits uint32, gap time.Duration) {
+
+	for i := 0; i < n; i++ {
+		parent := c.tip()
+		c.add(&proto.Header{
+			Version:   1,
+			Height:    parent.Height + 1,
+			PrevHash:  types.HashHeader(parent),
+			Timestamp: parent.Timestamp + int64(gap),
+			Bits:      bits,
+		})
+	}
+}
+
+func (c *headerChain) GetHeader(hash []byte) *proto.Header {
+	return c.byHash[string(hash)]
+}
+
+func (c *headerChain) GenesisHeader() *proto.Header {
+	return c.headers[0]
+}
+
+func TestCompactTargets(t *testing.T) {
+
+	for _, bits := range []uint32{0x1d00ffff, 0x1f00ffff, 0x207fffff, 0x05009234, 0x03123456, 0x01120000} {
+		require.Equal(t, bits, BigToCompact(CompactToBig(bits)), "%08x", bits)
+	}
+
+	// The three leading bytes are all that's kept
+	n, _ := new(big.Int).SetString("123456789abcdef", 16)
+	require.Equal(t, uint32(0x08012345), BigToCompact(n))
+	require.Equal(t, "12345000000000", CompactToBig(0x08012345).Text(16)[:14])
+
+	require.Equal(t, uint64(0), Work(0))
+	require.Equal(t, uint64(2), Work(0x207fffff))
+	require.Equal(t, Work(0x1f00ffff)*256, Work(0x1e00ffff))
+}
+
+func TestPoWRetarget(t *testing.T) {
+
+	var (
+		limit = uint32(0x1f00ffff)
+		pow   = NewPoW(PoWConfig{BlockTime: time.Second, RetargetWindow: 4, PowLimit: limit})
+	)
+
+	next := func(c *headerChain) uint32 {
+		bits, err := pow.NextBits(c, c.tip())
+		require.Nil(t, err)
+		return bits
+	}
+
+	// Too few blocks to look back on
+	chain := newHeaderChain()
+	chain.extend(3, limit, time.Millisecond)
+	require.Equal(t, limit, next(chain))
+
+	// On time - no change
+	chain = newHeaderChain()
+	chain.extend(4, limit, time.Second)
+	require.Equal(t, limit, next(chain))
+
+	// Ten times too quick - four times harder, as far as it goes in one step
+	chain = newHeaderChain()
+	chain.extend(4, limit, time.Millisecond*100)
+	harder := next(chain)
+	require.InEpsilon(t, 4*Work(limit), Work(harder), 0.001)
+
+	// Twice too slow - half as hard again, but never easier than the limit
+	chain.extend(4, harder, time.Second*2)
+	require.InEpsilon(t, 2*Work(limit), Work(next(chain)), 0.001)
+
+	chain.extend(4, next(chain), time.Second*10)
+	require.Equal(t, limit, next(chain))
+
+	// The window has to be there to look back on
+	orphan := newHeaderChain()
+	orphan.extend(4, limit, time.Second)
+	orphan.byHash = map[string]*proto.Header{}
+
+	_, err := pow.NextBits(orphan, orphan.tip())
+	require.NotNil(t, err)
+}
+
+func TestPoWSealAndVerify(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		pow     = NewPoW(PoWConfig{BlockTime: time.Second, RetargetWindow: 4, PowLimit: 0x2000ffff, Threads: 4})
+		chain   = newHeaderChain()
+		parent  = chain.tip()
+	)
+
+	header := &proto.Header{
+		Version:  1,
+		Height:   1,
+		PrevHash: types.HashHeader(parent),
+	}
+
+	require.Nil(t, pow.Prepare(chain, parent, header, nil))
+	require.Equal(t, uint32(0x2000ffff), header.Bits)
+
+	block, err := pow.Finalize(chain, header, nil)
+	require.Nil(t, err)
+	require.Nil(t, pow.Seal(chain, block, privKey, nil))
+
+	require.True(t, types.VerifyBlock(block))
+	require.Nil(t, pow.VerifyHeader(chain, parent, block.Header, block.PublicKey))
+
+	// Claiming an easier target than the retarget calls for
+	easier := pb.Clone(block.Header).(*proto.Header)
+	easier.Bits = 0x207fffff
+	require.True(t, errors.Is(pow.VerifyHeader(chain, parent, easier, nil), ErrBadDifficulty))
+
+	// Changing the header undoes the work sooner or later
+	for pow.VerifyHeader(chain, parent, block.Header, nil) == nil {
+		block.Header.Timestamp++
+	}
+	require.True(t, errors.Is(pow.VerifyHeader(chain, parent, block.Header, nil), ErrInsufficientWork))
+}
+
+func TestPoWSealAborts(t *testing.T) {
+
+	var (
+		pow    = NewPoW(PoWConfig{BlockTime: time.Second, PowLimit: 0x03000001, Threads: 2})
+		chain  = newHeaderChain()
+		header = &proto.Header{Version: 1, Height: 1}
+		stop   = make(chan struct{})
+	)
+
+	require.Nil(t, pow.Prepare(chain, chain.tip(), header, nil))
+
+	block, err := pow.Finalize(chain, header, nil)
+	require.Nil(t, err)
+
+	time.AfterFunc(time.Millisecond*50, func() { close(stop) })
+
+	require.Equal(t, ErrSealAborted, pow.Seal(chain, block, crypto.GeneratePrivateKey(), stop))
+	require.Nil(t, block.Signature)
+}
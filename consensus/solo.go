@@ -0,0 +1,61 @@
+package consensus
+
+import (
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// ----------------------------------------------------------------------------------
+// Solo is the chain as it started out: whoever runs a validator signs a block every
+// block time, any signer is accepted, and the longest branch wins.
+type Solo struct {
+	blockTime time.Duration
+}
+
+func NewSolo(blockTime time.Duration) *Solo {
+	return &Solo{
+		blockTime: blockTime,
+	}
+}
+
+func (e *Solo) Prepare(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error {
+
+	header.Timestamp = max(header.Timestamp, parent.Timestamp+int64(e.blockTime))
+
+	return nil
+}
+
+func (e *Solo) Finalize(chain ChainReader, header *proto.Header, txx []*proto.Transaction) (*proto.Block, error) {
+	return assemble(header, txx), nil
+}
+
+func (e *Solo) Seal(chain ChainReader, block *proto.Block, privKey *crypto.PrivateKey, stop <-chan struct{}) error {
+
+	types.SignBlock(privKey, block)
+
+	return nil
+}
+
+func (e *Solo) VerifyHeader(chain ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error {
+	return nil
+}
+
+func (e *Solo) Weight(header *proto.Header) uint64 {
+	return 1
+}
+
+// assemble puts [txx] under [header], committing the header to them
+func assemble(header *proto.Header, txx []*proto.Transaction) *proto.Block {
+
+	block := &proto.Block{
+		Header:       header,
+		Transactions: txx,
+	}
+
+	header.RootHash = types.CalculateRootHash(block)
+
+	return block
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"io"
 )
 
@@ -91,15 +92,15 @@ func (p *PublicKey) Address() Address {
 	}
 }
 
-func PubKeyFromBytes(b []byte) *PublicKey {
+func PubKeyFromBytes(b []byte) (*PublicKey, error) {
 
 	if len(b) != PubKeyLen {
-		panic("\n*** >>> invalid pubkey length")
+		return nil, fmt.Errorf("invalid pubkey length (%d) - expected (%d)", len(b), PubKeyLen)
 	}
 
 	return &PublicKey{
 		key: ed25519.PublicKey(b),
-	}
+	}, nil
 }
 
 // -----------------------------------------------------------------
@@ -116,15 +117,15 @@ func (s *Signature) Verify(pubKey *PublicKey, msg []byte) bool {
 	return ed25519.Verify(pubKey.key, msg, s.value)
 }
 
-func SignatureFromBytes(b []byte) *Signature {
+func SignatureFromBytes(b []byte) (*Signature, error) {
 
 	if len(b) != SignatureLen {
-		panic("\n*** >>> invalid signature length")
+		return nil, fmt.Errorf("invalid signature length (%d) - expected (%d)", len(b), SignatureLen)
 	}
 
 	return &Signature{
 		value: b,
-	}
+	}, nil
 }
 
 // -----------------------------------------------------------------
@@ -54,3 +54,25 @@ func TestPrivateKeyFromString(t *testing.T) {
 	assert.Equal(t, addressStr, address.String())
 	assert.Equal(t, PrivKeyLen, len(privKey.Bytes()))
 }
+
+func TestFromBytesRejectsBadLengths(t *testing.T) {
+
+	privKey := GeneratePrivateKey()
+
+	pubKey, err := PubKeyFromBytes(privKey.PubKey().Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, privKey.PubKey().Bytes(), pubKey.Bytes())
+
+	_, err = PubKeyFromBytes(make([]byte, PubKeyLen-1))
+	assert.NotNil(t, err)
+
+	_, err = PubKeyFromBytes(nil)
+	assert.NotNil(t, err)
+
+	sig, err := SignatureFromBytes(privKey.Sign([]byte("msg")).Bytes())
+	assert.Nil(t, err)
+	assert.True(t, sig.Verify(pubKey, []byte("msg")))
+
+	_, err = SignatureFromBytes(make([]byte, SignatureLen+1))
+	assert.NotNil(t, err)
+}
@@ -3,7 +3,6 @@ module github.com/i101dev/blocker
 go 1.22.1
 
 require (
-	github.com/cbergoon/merkletree v0.2.0
 	github.com/stretchr/testify v1.9.0
 	google.golang.org/grpc v1.64.0
 	google.golang.org/protobuf v1.34.1
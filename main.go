@@ -2,14 +2,19 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/i101dev/blocker/consensus"
 	"github.com/i101dev/blocker/crypto"
 	"github.com/i101dev/blocker/node"
 	"github.com/i101dev/blocker/proto"
-	"github.com/i101dev/blocker/util"
+	"github.com/i101dev/blocker/types"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
@@ -17,29 +22,75 @@ import (
 var (
 	originNode    = ":3000"
 	startingPeers = []string{originNode}
+
+	// Fixed so a restart with -datadir comes back up on the same genesis
+	validatorSeeds = []string{
+		"5e0c4f3bd83e44a3b0ff2c1f3d4b6a6a8d12c6f27e4f9a1b3c5d7e9f0a2b4c6d",
+		"a1d3f5b7c9e0f2a4b6c8d0e2f4a6b8c0d2e4f6a8b0c2d4e6f8a0b2c4d6e8f0a2",
+	}
+
+	genesis = &node.Genesis{
+		Validators: validatorKeys(),
+		Engine: consensus.NewPoA(consensus.PoAConfig{
+			BlockTime:       consensus.DefaultBlockTime,
+			ProposerTimeout: time.Second * 5,
+		}),
+		InitialSubsidy:   node.DefaultSubsidy,
+		HalvingInterval:  node.DefaultHalvingInterval,
+		CoinbaseMaturity: node.DefaultCoinbaseMaturity,
+	}
+
+	engine   = flag.String("consensus", "poa", "how the validators agree on blocks - poa, bft for instant finality, pow to mine them, or pos to stake on them")
+	dataDir  = flag.String("datadir", "", "keep each node's chain on disk under this directory instead of in memory")
+	verifyDB = flag.Bool("verify-db", false, "check the chain stored under -datadir for consistency and exit")
+	repairDB = flag.Bool("repair", false, "with -verify-db, fix what the check finds")
+
+	clockDrift = flag.Duration("clock-drift", node.DefaultMaxClockDrift, "how far ahead of the local clock a block's timestamp may be")
+
+	mempoolSize   = flag.Int("mempool-size", node.DefaultMempoolConfig().MaxCount, "how many transactions each node's mempool holds - no limit if zero")
+	mempoolExpiry = flag.Duration("mempool-expiry", node.DefaultMempoolConfig().Expiry, "how long a transaction may wait in the mempool - forever if zero")
 )
 
 func main() {
 
-	node1 := makeNode(originNode, []string{}, true)
+	flag.Parse()
+
+	switch *engine {
+	case "poa":
+	case "bft":
+		genesis.Engine = consensus.NewBFT(consensus.DefaultBFTConfig())
+	case "pow":
+		genesis.Engine = consensus.NewPoW(consensus.DefaultPoWConfig())
+	case "pos":
+		genesis.Engine = consensus.NewPoS(consensus.DefaultPoSConfig())
+		genesis.Stake = 1000
+	default:
+		log.Fatalf("unknown consensus engine: %s", *engine)
+	}
+
+	if *verifyDB {
+		os.Exit(runVerifyDB(*dataDir, *repairDB))
+	}
+
+	node1 := makeNode(originNode, []string{}, validatorSeeds[0])
 	time.Sleep(time.Second * 2)
 
-	node2 := makeNode(":4000", startingPeers, false)
+	node2 := makeNode(":4000", startingPeers, validatorSeeds[1])
 	time.Sleep(time.Second * 2)
 
-	node3 := makeNode(":5000", startingPeers, false)
+	node3 := makeNode(":5000", startingPeers, "")
 	time.Sleep(time.Second * 2)
 
-	// node4 := makeNode(":6000", startingPeers, false)
+	// node4 := makeNode(":6000", startingPeers, "")
 	// time.Sleep(time.Second * 2)
 
-	// node5 := makeNode(":7000", startingPeers, false)
+	// node5 := makeNode(":7000", startingPeers, "")
 	// time.Sleep(time.Second * 2)
 
-	// node6 := makeNode(":8000", startingPeers, false)
+	// node6 := makeNode(":8000", startingPeers, "")
 	// time.Sleep(time.Second * 2)
 
-	// node7 := makeNode(":9000", startingPeers, false)
+	// node7 := makeNode(":9000", startingPeers, "")
 	// time.Sleep(time.Second * 2)
 
 	fmt.Println("\n----------------------------------------------------------------------------")
@@ -61,16 +112,55 @@ func main() {
 	// select {}
 }
 
-func makeNode(listenAddr string, bootstrapNodes []string, isValidator bool) *node.Node {
+func validatorKeys() [][]byte {
+
+	keys := make([][]byte, len(validatorSeeds))
+	for i, seed := range validatorSeeds {
+		keys[i] = crypto.NewPrivateKeyFromString(seed).PubKey().Bytes()
+	}
+
+	return keys
+}
+
+// makeNode starts a node on the demo network - a validator if it's given one of the
+// validator seeds
+func makeNode(listenAddr string, bootstrapNodes []string, validatorSeed string) *node.Node {
 
 	cfg := node.ServerConfig{
 		Version:    "blocker-0.1",
 		ListenAddr: listenAddr,
 		PrivateKey: nil,
+		Genesis:    genesis,
+
+		MaxClockDrift: *clockDrift,
+		MinRelayFee:   node.DefaultMinRelayFee,
 	}
 
-	if isValidator {
-		cfg.PrivateKey = crypto.GeneratePrivateKey()
+	mempool := node.DefaultMempoolConfig()
+	mempool.MaxCount = *mempoolSize
+	mempool.Expiry = *mempoolExpiry
+	cfg.Mempool = &mempool
+
+	if validatorSeed != "" {
+		cfg.PrivateKey = crypto.NewPrivateKeyFromString(validatorSeed)
+	}
+
+	if *dataDir != "" {
+
+		db := openNodeStore(filepath.Join(*dataDir, strings.TrimPrefix(listenAddr, ":")))
+
+		// Whatever a crash left half done gets cleaned up before the chain is loaded
+		report, err := node.VerifyDBWithGenesis(genesis, db.Blocks(), db.TXs(), db.UTXOs(), true)
+		if err != nil {
+			log.Fatalf("\n*** >>> [%s] - storage is unusable - %v\n%s", listenAddr, err, report)
+		}
+		if !report.OK() {
+			fmt.Printf("\n*** >>> [%s] - storage repaired on startup\n%s", listenAddr, report)
+		}
+
+		cfg.BlockStorer = db.Blocks()
+		cfg.TXStorer = db.TXs()
+		cfg.UTXOStorer = db.UTXOs()
 	}
 
 	n := node.NewNode(cfg)
@@ -84,8 +174,93 @@ func makeNode(listenAddr string, bootstrapNodes []string, isValidator bool) *nod
 	return n
 }
 
+func openNodeStore(dir string) *node.DiskStore {
+
+	db, err := node.OpenDiskStore(node.DiskStoreConfig{Dir: dir, Sync: node.SyncInterval})
+	if err != nil {
+		log.Fatal("\n*** >>> [node.OpenDiskStore] - FAIL -", err)
+	}
+
+	return db
+}
+
+// runVerifyDB checks the store of every node under [dir] and returns the exit code
+func runVerifyDB(dir string, repair bool) int {
+
+	if dir == "" {
+		fmt.Println("-verify-db needs -datadir")
+		return 2
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		fmt.Println("failed to read data directory -", err)
+		return 1
+	}
+
+	code := 0
+
+	for _, entry := range entries {
+
+		if !entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		db := openNodeStore(path)
+
+		report, err := node.VerifyDBWithGenesis(genesis, db.Blocks(), db.TXs(), db.UTXOs(), repair)
+		db.Close()
+
+		fmt.Println("\n----------------------------------------------------------------------------")
+		fmt.Printf("%s\n\n", path)
+
+		if report != nil {
+			fmt.Print(report)
+		}
+
+		if err != nil {
+			fmt.Println("error:", err)
+			code = 1
+			continue
+		}
+
+		if !report.OK() && !report.Repaired {
+			code = 1
+		}
+	}
+
+	return code
+}
+
+// wallet is the demo's spending money - the genesis coins, passed along a payment at a
+// time with the change coming back. A payment can't spend change until the block before
+// has confirmed it, so the node turns the next one away until then.
+var wallet struct {
+	key    *crypto.PrivateKey
+	prevTx *proto.Transaction
+	index  uint32
+	amount uint64
+}
+
 func makeTransaction() {
 
+	if wallet.key == nil {
+		wallet.key = node.OriginKey()
+		wallet.prevTx = genesis.Block().Transactions[0]
+		wallet.amount = wallet.prevTx.Outputs[0].Amount
+	}
+
+	const (
+		payment = 1
+		fee     = node.DefaultMinRelayFee
+	)
+
+	if wallet.amount < payment+fee {
+		fmt.Println("\n*** >>> [makeTransaction] - wallet is empty")
+		return
+	}
+
 	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
 	client, err := grpc.NewClient(originNode, opts...)
 
@@ -95,33 +270,42 @@ func makeTransaction() {
 
 	c := proto.NewNodeClient(client)
 
-	privKey := crypto.GeneratePrivateKey()
-
 	txn := &proto.Transaction{
 		Version: 1,
 		Inputs: []*proto.TxInput{
 			{
-				PrevTxHash:   util.RandomHash(),
-				PrevOutIndex: 0,
-				PubKey:       privKey.PubKey().Bytes(),
+				PrevTxHash:   types.HashTransaction(wallet.prevTx),
+				PrevOutIndex: wallet.index,
+				PubKey:       wallet.key.PubKey().Bytes(),
 			},
 		},
 		Outputs: []*proto.TxOutput{
 			{
-				Amount:  99,
-				Address: privKey.PubKey().Address().Bytes(),
+				Amount:  payment,
+				Address: crypto.GeneratePrivateKey().PubKey().Address().Bytes(),
+			},
+			{
+				Amount:  wallet.amount - payment - fee,
+				Address: wallet.key.PubKey().Address().Bytes(),
 			},
 		},
 	}
 
+	txn.Inputs[0].Signature = types.SignTransaction(wallet.key, txn).Bytes()
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
 
 	_, err = c.HandleTX(ctx, txn)
 
 	if err != nil {
-		log.Fatal("\n*** >>> [makeTransaction] - FAIL -", err)
+		log.Printf("\n*** >>> [makeTransaction] - REJECTED - %v", err)
+		return
 	}
+
+	wallet.prevTx = txn
+	wallet.index = 1
+	wallet.amount = txn.Outputs[1].Amount
 }
 
 // func makeHandshake() {
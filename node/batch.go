@@ -0,0 +1,363 @@
+package node
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// ------------------------------------------------------------------------
+// A Batch collects every write needed to move the chain from one state to the next -
+// connecting a block, disconnecting one, or a whole reorg - so they land together or
+// not at all. Nothing touches the stores until Commit.
+//
+// Reads of UTXOs and undo records go through the batch first, so later steps in the
+// same batch see what earlier ones staged.
+type Batch struct {
+	blocks []*proto.Block
+	txs    []*proto.Transaction
+	undo   map[string]*BlockUndo
+
+	// UTXO writes in the order they were staged - a nil entry in [utxoState] is a delete
+	utxoKeys  []string
+	utxoState map[string]*UTXO
+
+	tip string
+}
+
+// BatchWriter is storage that can commit a whole batch atomically on its own
+type BatchWriter interface {
+	WriteBatch(*Batch) error
+}
+
+// batchBackend is implemented by store views that share a BatchWriter underneath
+type batchBackend interface {
+	batchWriter() BatchWriter
+}
+
+func NewBatch() *Batch {
+	return &Batch{
+		undo:      make(map[string]*BlockUndo),
+		utxoState: make(map[string]*UTXO),
+	}
+}
+
+func (b *Batch) PutBlock(block *proto.Block) {
+	b.blocks = append(b.blocks, block)
+}
+
+func (b *Batch) PutTx(tx *proto.Transaction) {
+	b.txs = append(b.txs, tx)
+}
+
+func (b *Batch) PutUndo(hash string, undo *BlockUndo) {
+	b.undo[hash] = undo
+}
+
+func (b *Batch) PutUTXO(utxo *UTXO) {
+	b.stageUTXO(utxo.Key(), utxo)
+}
+
+func (b *Batch) DeleteUTXO(key string) {
+	b.stageUTXO(key, nil)
+}
+
+func (b *Batch) SetTip(hash string) {
+	b.tip = hash
+}
+
+func (b *Batch) stageUTXO(key string, utxo *UTXO) {
+
+	if _, ok := b.utxoState[key]; !ok {
+		b.utxoKeys = append(b.utxoKeys, key)
+	}
+
+	b.utxoState[key] = utxo
+}
+
+// Discard drops everything staged so far
+func (b *Batch) Discard() {
+	*b = *NewBatch()
+}
+
+func (b *Batch) Empty() bool {
+	return len(b.blocks) == 0 && len(b.txs) == 0 && len(b.undo) == 0 && len(b.utxoKeys) == 0 && b.tip == ""
+}
+
+// ------------------------------------------------------------------------
+// batchView reads through a batch to the stores beneath it
+type batchView struct {
+	batch      *Batch
+	blockStore BlockStorer
+	utxoStore  UTXOStorer
+}
+
+func (v *batchView) Get(key string) (*UTXO, error) {
+
+	if utxo, ok := v.batch.utxoState[key]; ok {
+
+		if utxo == nil {
+			return nil, fmt.Errorf("failed to fetch UTXO with hash - %s", key)
+		}
+
+		return utxo, nil
+	}
+
+	return v.utxoStore.Get(key)
+}
+
+func (v *batchView) GetUndo(hash string) (*BlockUndo, error) {
+
+	if undo, ok := v.batch.undo[hash]; ok {
+		return undo, nil
+	}
+
+	return v.blockStore.GetUndo(hash)
+}
+
+// ------------------------------------------------------------------------
+// commitBatch writes [b] to the stores. If they all sit on the same BatchWriter - or are
+// all plain memory stores - it does the whole job atomically. Otherwise the writes go through the plain storer interfaces:
+// blocks, txs and undo records first - they're keyed by content hash, so one left behind
+// by a failed commit is never wrong, just unreferenced - then the UTXO changes, which are
+// rolled back if anything fails, and the tip last as the commit point
+func commitBatch(bs BlockStorer, ts TXStorer, us UTXOStorer, b *Batch) error {
+
+	if w := sharedBatchWriter(bs, ts, us); w != nil {
+		return w.WriteBatch(b)
+	}
+
+	for _, tx := range b.txs {
+		if err := ts.Put(tx); err != nil {
+			return err
+		}
+	}
+
+	for _, block := range b.blocks {
+		if err := bs.PutBlock(block); err != nil {
+			return err
+		}
+	}
+
+	for hash, undo := range b.undo {
+		if err := bs.PutUndo(hash, undo); err != nil {
+			return err
+		}
+	}
+
+	// Pre-images of every UTXO touched so far - nil if it didn't exist
+	applied := []string{}
+	previous := make(map[string]*UTXO)
+
+	rollback := func(cause error) error {
+
+		for i := len(applied) - 1; i >= 0; i-- {
+
+			var (
+				key = applied[i]
+				err error
+			)
+
+			if prev := previous[key]; prev != nil {
+				err = us.Put(prev)
+			} else {
+				err = us.Delete(key)
+			}
+
+			if err != nil {
+				return fmt.Errorf("batch commit failed (%v) and rollback of [%s] failed: %v", cause, key, err)
+			}
+		}
+
+		return cause
+	}
+
+	for _, key := range b.utxoKeys {
+
+		if prev, err := us.Get(key); err == nil {
+			cp := *prev
+			previous[key] = &cp
+		}
+
+		var err error
+
+		if utxo := b.utxoState[key]; utxo != nil {
+			err = us.Put(utxo)
+		} else {
+			err = us.Delete(key)
+		}
+
+		if err != nil {
+			return rollback(err)
+		}
+
+		applied = append(applied, key)
+	}
+
+	if b.tip != "" {
+		if err := bs.SetTip(b.tip); err != nil {
+			return rollback(err)
+		}
+	}
+
+	return nil
+}
+
+func sharedBatchWriter(bs BlockStorer, ts TXStorer, us UTXOStorer) BatchWriter {
+
+	mb, ok1 := bs.(*MemoryBlockStore)
+	mt, ok2 := ts.(*MemoryTXStore)
+	mu, ok3 := us.(*MemoryUTXOStore)
+
+	if ok1 && ok2 && ok3 {
+		return &memoryBatchWriter{blocks: mb, txs: mt, utxos: mu}
+	}
+
+	bb, ok1 := bs.(batchBackend)
+	tb, ok2 := ts.(batchBackend)
+	ub, ok3 := us.(batchBackend)
+
+	if !ok1 || !ok2 || !ok3 {
+		return nil
+	}
+
+	w := bb.batchWriter()
+
+	if tb.batchWriter() != w || ub.batchWriter() != w {
+		return nil
+	}
+
+	return w
+}
+
+// ------------------------------------------------------------------------
+// Staging the UTXO changes for connecting and disconnecting blocks
+
+// stageConnect stages the writes for connecting [block], at [height], on top of the state
+// [view] reads - after its transactions, the bonds its evidence [forfeited] are burnt
+func stageConnect(view *batchView, block *proto.Block, height int, forfeited []string) error {
+
+	var (
+		batch = view.batch
+		undo  = &BlockUndo{}
+	)
+
+	for _, tx := range block.Transactions {
+
+		batch.PutTx(tx)
+
+		hash := hex.EncodeToString(types.HashTransaction(tx))
+
+		for index, output := range tx.Outputs {
+
+			utxo := &UTXO{
+				Hash:     hash,
+				Amount:   output.Amount,
+				Address:  output.Address,
+				OutIndex: index,
+				Spent:    false,
+			}
+
+			switch {
+			case tx.Kind == proto.TxKind_BOND && index == 0:
+				utxo.Validator = tx.Validator
+			case tx.Kind == proto.TxKind_UNBOND:
+				utxo.UnbondedAt = height
+			case tx.Kind == proto.TxKind_COINBASE:
+				utxo.MintedAt = height
+			}
+
+			batch.PutUTXO(utxo)
+		}
+
+		for _, input := range tx.Inputs {
+
+			key := inputKey(input)
+			utxo, err := view.Get(key)
+
+			if err != nil {
+				return err
+			}
+
+			// Keep a copy of the output as it was so the spend can be undone
+			prev := *utxo
+			undo.Spent = append(undo.Spent, &prev)
+
+			spent := *utxo
+			spent.Spent = true
+
+			batch.PutUTXO(&spent)
+		}
+	}
+
+	for _, key := range forfeited {
+
+		utxo, err := view.Get(key)
+		if err != nil {
+			return err
+		}
+
+		prev := *utxo
+		undo.Forfeited = append(undo.Forfeited, &prev)
+
+		burnt := *utxo
+		burnt.Spent = true
+
+		batch.PutUTXO(&burnt)
+	}
+
+	batch.PutUndo(hex.EncodeToString(types.HashBlock(block)), undo)
+	batch.PutBlock(block)
+
+	return nil
+}
+
+// stageDisconnect stages the writes that take [block] back off the state [view] reads
+func stageDisconnect(view *batchView, block *proto.Block) error {
+
+	hash := hex.EncodeToString(types.HashBlock(block))
+
+	undo, err := view.GetUndo(hash)
+	if err != nil {
+		return err
+	}
+
+	nInputs := 0
+	for _, tx := range block.Transactions {
+		nInputs += len(tx.Inputs)
+	}
+
+	if nInputs != len(undo.Spent) {
+		return fmt.Errorf("undo record for block [%s] has (%d) entries - expected (%d)", hash, len(undo.Spent), nInputs)
+	}
+
+	// Slashing came last, so it goes first
+	for _, forfeited := range undo.Forfeited {
+		prev := *forfeited
+		view.batch.PutUTXO(&prev)
+	}
+
+	// Walk back tx by tx so an output both created and spent within the block ends up gone
+	next := len(undo.Spent)
+
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+
+		tx := block.Transactions[i]
+		txHash := hex.EncodeToString(types.HashTransaction(tx))
+
+		for index := range tx.Outputs {
+			view.batch.DeleteUTXO(fmt.Sprintf("%s_%d", txHash, index))
+		}
+
+		next -= len(tx.Inputs)
+
+		for _, spent := range undo.Spent[next : next+len(tx.Inputs)] {
+			prev := *spent
+			view.batch.PutUTXO(&prev)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,274 @@
+package node
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyUTXOStore fails a single write, once [failAfter] writes have gone through
+type flakyUTXOStore struct {
+	*MemoryUTXOStore
+	writes    int
+	failAfter int
+}
+
+func (s *flakyUTXOStore) Put(utxo *UTXO) error {
+	if err := s.tick(); err != nil {
+		return err
+	}
+	return s.MemoryUTXOStore.Put(utxo)
+}
+
+func (s *flakyUTXOStore) Delete(key string) error {
+	if err := s.tick(); err != nil {
+		return err
+	}
+	return s.MemoryUTXOStore.Delete(key)
+}
+
+func (s *flakyUTXOStore) tick() error {
+	s.writes++
+	if s.writes == s.failAfter+1 {
+		return fmt.Errorf("disk on fire")
+	}
+	return nil
+}
+
+func TestAddBlockFailureLeavesStoresUntouched(t *testing.T) {
+
+	var (
+		privKey = crypto.NewPrivateKeyFromString(originSeed)
+		utxos   = &flakyUTXOStore{MemoryUTXOStore: NewMemoryUTXOStore(), failAfter: -1}
+		blocks  = NewMemoryBlockStore()
+		chain   = NewChain(blocks, NewMemoryTXStore(), utxos)
+	)
+
+	tipBefore, err := blocks.GetTip()
+	require.Nil(t, err)
+
+	before := snapshotUTXOs(utxos.MemoryUTXOStore)
+
+	block := NextBlock(t, chain, privKey)
+	block.Transactions = append(block.Transactions, genesisSpendTX(t, chain, 100))
+	types.SignBlock(privKey, block)
+
+	// The new output goes in, then the spend of the genesis output blows up
+	utxos.writes = 0
+	utxos.failAfter = 1
+
+	require.NotNil(t, chain.AddBlock(block))
+	require.Equal(t, 0, chain.Height())
+	require.Equal(t, before, snapshotUTXOs(utxos.MemoryUTXOStore))
+
+	tipAfter, err := blocks.GetTip()
+	require.Nil(t, err)
+	require.Equal(t, tipBefore, tipAfter)
+
+	// Nothing is left half done - the same block goes in cleanly once the store recovers
+	require.Nil(t, chain.AddBlock(block))
+	require.Equal(t, 1, chain.Height())
+}
+
+func TestBatchReadsThroughStagedWrites(t *testing.T) {
+
+	var (
+		store = NewMemoryUTXOStore()
+		view  = &batchView{batch: NewBatch(), blockStore: NewMemoryBlockStore(), utxoStore: store}
+	)
+
+	require.Nil(t, store.Put(&UTXO{Hash: "aa", OutIndex: 0, Amount: 1}))
+
+	view.batch.PutUTXO(&UTXO{Hash: "bb", OutIndex: 0, Amount: 2})
+	view.batch.DeleteUTXO("aa_0")
+
+	utxo, err := view.Get("bb_0")
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), utxo.Amount)
+
+	_, err = view.Get("aa_0")
+	require.NotNil(t, err)
+
+	// Nothing reaches the store until commit
+	_, err = store.Get("bb_0")
+	require.NotNil(t, err)
+
+	view.batch.Discard()
+	require.True(t, view.batch.Empty())
+
+	_, err = view.Get("aa_0")
+	require.Nil(t, err)
+}
+
+func TestMemoryStoresCommitBatchAtomically(t *testing.T) {
+
+	var (
+		blocks = NewMemoryBlockStore()
+		txs    = NewMemoryTXStore()
+		utxos  = NewMemoryUTXOStore()
+	)
+
+	require.NotNil(t, sharedBatchWriter(blocks, txs, utxos))
+
+	// A reader must never see a batch's UTXO changes without its tip, or the other way round
+	done := make(chan struct{})
+	go func() {
+
+		defer close(done)
+
+		for i := 0; i < 1000; i++ {
+
+			batch := NewBatch()
+			batch.PutUTXO(&UTXO{Hash: fmt.Sprintf("%04d", i), OutIndex: 0, Amount: 1})
+			batch.SetTip(fmt.Sprintf("%04d", i))
+
+			if err := commitBatch(blocks, txs, utxos, batch); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			tip, err := blocks.GetTip()
+			require.Nil(t, err)
+			require.Equal(t, "0999", tip)
+			return
+		default:
+		}
+
+		blocks.lock.RLock()
+		utxos.lock.RLock()
+		count, tip := len(utxos.data), blocks.tip
+		utxos.lock.RUnlock()
+		blocks.lock.RUnlock()
+
+		if count > 0 {
+			require.Equal(t, fmt.Sprintf("%04d", count-1), tip)
+		}
+	}
+}
+
+func TestDiskStoreReplaysCommittedJournal(t *testing.T) {
+
+	var (
+		dir   = t.TempDir()
+		db    = openTestDiskStore(t, dir)
+		batch = NewBatch()
+		tx    = &proto.Transaction{Version: 1, Outputs: []*proto.TxOutput{{Amount: 5}}}
+	)
+
+	batch.PutTx(tx)
+	batch.PutUTXO(&UTXO{Hash: "aa", OutIndex: 0, Amount: 5})
+	batch.SetTip("cafe")
+
+	ops, err := batchOps(batch)
+	require.Nil(t, err)
+
+	journal := []byte{}
+	for _, op := range ops {
+		journal = append(journal, encodeRecord(op.log+"/"+op.key, op.value, op.deleted)...)
+	}
+
+	// Without the commit record the batch never happened
+	require.Nil(t, os.WriteFile(db.walPath(), journal, 0644))
+	require.Nil(t, db.Close())
+
+	db = openTestDiskStore(t, dir)
+
+	_, err = db.UTXOs().Get("aa_0")
+	require.NotNil(t, err)
+
+	// With it, the whole batch is applied on open as if the crash never happened
+	journal = append(journal, encodeRecord(walCommitKey, nil, false)...)
+	require.Nil(t, os.WriteFile(db.walPath(), journal, 0644))
+	require.Nil(t, db.Close())
+
+	db = openTestDiskStore(t, dir)
+	defer db.Close()
+
+	utxo, err := db.UTXOs().Get("aa_0")
+	require.Nil(t, err)
+	require.Equal(t, uint64(5), utxo.Amount)
+
+	_, err = db.TXs().Get(fmt.Sprintf("%x", types.HashTransaction(tx)))
+	require.Nil(t, err)
+
+	tip, err := db.Blocks().GetTip()
+	require.Nil(t, err)
+	require.Equal(t, "cafe", tip)
+
+	_, err = os.Stat(db.walPath())
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestDiskStoreSyncsBatchBeforeDroppingJournal(t *testing.T) {
+
+	var (
+		dir   = t.TempDir()
+		cfg   = DiskStoreConfig{Dir: dir, Sync: SyncInterval, SyncInterval: time.Hour}
+		batch = NewBatch()
+	)
+
+	db, err := OpenDiskStore(cfg)
+	require.Nil(t, err)
+
+	require.Nil(t, db.Blocks().SetTip("beef"))
+	require.Nil(t, db.Sync())
+
+	sizes := map[string]int64{}
+	for _, name := range []string{"utxos.dat", "utxos.idx"} {
+		stat, err := os.Stat(filepath.Join(dir, name))
+		require.Nil(t, err)
+		sizes[name] = stat.Size()
+	}
+
+	batch.PutUTXO(&UTXO{Hash: "aa", OutIndex: 0, Amount: 5})
+	batch.SetTip("cafe")
+
+	ops, err := batchOps(batch)
+	require.Nil(t, err)
+
+	journal := []byte{}
+	for _, op := range ops {
+		journal = append(journal, encodeRecord(op.log+"/"+op.key, op.value, op.deleted)...)
+	}
+	journal = append(journal, encodeRecord(walCommitKey, nil, false)...)
+
+	// Once applied the batch is on disk, even though the background sync hasn't run
+	require.Nil(t, db.applyOps(ops))
+	require.False(t, db.utxos.dirty)
+
+	require.Nil(t, db.Close())
+
+	// Power goes before the journal is removed, taking the writes the OS was still holding -
+	// the journal brings them back
+	for name, size := range sizes {
+		require.Nil(t, os.Truncate(filepath.Join(dir, name), size))
+	}
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "TIP"), []byte("beef"), 0644))
+	require.Nil(t, os.WriteFile(db.walPath(), journal, 0644))
+
+	db, err = OpenDiskStore(cfg)
+	require.Nil(t, err)
+	defer db.Close()
+
+	utxo, err := db.UTXOs().Get("aa_0")
+	require.Nil(t, err)
+	require.Equal(t, uint64(5), utxo.Amount)
+
+	tip, err := db.Blocks().GetTip()
+	require.Nil(t, err)
+	require.Equal(t, "cafe", tip)
+
+	_, err = os.Stat(db.walPath())
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,106 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// --------------------------------------------------------------
+// A validator node on a voting engine hands block production over to its voter, which
+// reaches the chain and the network through voterBackend
+
+type voterBackend struct {
+	n *Node
+}
+
+func (b *voterBackend) GetHeader(hash []byte) *proto.Header {
+	return b.n.chain.GetHeader(hash)
+}
+
+func (b *voterBackend) GenesisHeader() *proto.Header {
+	return b.n.chain.GenesisHeader()
+}
+
+func (b *voterBackend) Height() int {
+	return b.n.chain.Height()
+}
+
+func (b *voterBackend) ProposeBlock() (*proto.Block, error) {
+
+	header, ok := b.n.prepareHeader(time.Now())
+	if !ok {
+		return nil, fmt.Errorf("(%s) can't propose on the current tip", b.n.ListenAddr)
+	}
+
+	return b.n.createBlock(header, b.n.mempool.Template(b.n.MaxBlockBytes))
+}
+
+func (b *voterBackend) ValidateBlock(block *proto.Block) error {
+	return b.n.chain.ValidateProposal(block)
+}
+
+func (b *voterBackend) Commit(block *proto.Block) error {
+
+	// The block may have reached us from a quicker peer already
+	if err := b.n.chain.AddBlock(block); err != nil && !errors.Is(err, ErrKnownBlock) {
+		return err
+	}
+
+	if !b.n.markBlockSeen(hex.EncodeToString(types.HashBlock(block)), int(block.Header.Height)) {
+		return nil
+	}
+
+	fmt.Printf("\n*** >>> COMMIT NEW BLOCK <<< *** || height: (%d) || round: (%d) || lenTx: (%d)", block.Header.Height, block.Commit.Round, len(block.Transactions))
+
+	// Validators have it from their own voters - this is for everyone else
+	go func() {
+		if err := b.n.broadcast(block); err != nil {
+			log.Printf("\n*** >>> (%s) failed to broadcast block - %v", b.n.ListenAddr, err)
+		}
+	}()
+
+	return nil
+}
+
+func (b *voterBackend) BroadcastProposal(p *proto.Proposal) {
+	go b.n.broadcast(p)
+}
+
+func (b *voterBackend) BroadcastVote(v *proto.Vote) {
+	go b.n.broadcast(v)
+}
+
+// --------------------------------------------------------------
+
+func (n *Node) HandleProposal(ctx context.Context, p *proto.Proposal) (*proto.Ack, error) {
+
+	if n.voter == nil {
+		return &proto.Ack{}, nil
+	}
+
+	if err := n.voter.HandleProposal(p); err != nil {
+		return nil, fromConsensus(err)
+	}
+
+	return &proto.Ack{}, nil
+}
+
+func (n *Node) HandleVote(ctx context.Context, v *proto.Vote) (*proto.Ack, error) {
+
+	if n.voter == nil {
+		return &proto.Ack{}, nil
+	}
+
+	if err := n.voter.HandleVote(v); err != nil {
+		return nil, fromConsensus(err)
+	}
+
+	return &proto.Ack{}, nil
+}
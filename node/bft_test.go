@@ -0,0 +1,127 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+var bftTestConfig = consensus.BFTConfig{
+	TimeoutPropose:   time.Millisecond * 500,
+	TimeoutPrevote:   time.Millisecond * 200,
+	TimeoutPrecommit: time.Millisecond * 200,
+	TimeoutDelta:     time.Millisecond * 100,
+	BlockTime:        time.Millisecond * 100,
+}
+
+// commitBlock signs a commit certificate for [block] by [signers]
+func commitBlock(block *proto.Block, round int32, signers ...*crypto.PrivateKey) *proto.Block {
+
+	hash := types.HashBlock(block)
+
+	block.Commit = &proto.Commit{
+		Height:    block.Header.Height,
+		Round:     round,
+		BlockHash: hash,
+	}
+
+	for _, privKey := range signers {
+
+		vote := &proto.Vote{
+			Type:      proto.VoteType_PRECOMMIT,
+			Height:    block.Header.Height,
+			Round:     round,
+			BlockHash: hash,
+		}
+		types.SignVote(privKey, vote)
+
+		block.Commit.Precommits = append(block.Commit.Precommits, vote)
+	}
+
+	return block
+}
+
+func TestBFTChainRequiresCommit(t *testing.T) {
+
+	genesis, privKeys := testGenesis(consensus.NewBFT(bftTestConfig), 4)
+
+	chain, err := OpenChainWithGenesis(genesis, NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	require.Nil(t, err)
+
+	parent, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	block := blockAt(t, parent, privKeys[1], time.Second)
+
+	// Still being voted on, the block is fine as a proposal - but not yet for the chain
+	require.Nil(t, chain.ValidateProposal(block))
+	require.Equal(t, CodeBadCommit, CodeOf(chain.AddBlock(block)))
+
+	// Two of four validators aren't enough
+	require.Equal(t, CodeBadCommit, CodeOf(chain.AddBlock(commitBlock(block, 0, privKeys[0], privKeys[1]))))
+	require.Equal(t, 0, chain.Height())
+
+	require.Nil(t, chain.AddBlock(commitBlock(block, 0, privKeys[0], privKeys[1], privKeys[3])))
+	require.Equal(t, 1, chain.Height())
+
+	// The next proposal has to build on the new tip
+	require.Equal(t, CodeUnknownParent, CodeOf(chain.ValidateProposal(blockAt(t, parent, privKeys[2], time.Second))))
+	require.Nil(t, chain.ValidateProposal(blockAt(t, block, privKeys[2], time.Second)))
+}
+
+func TestBFTValidatorsCommitTogether(t *testing.T) {
+
+	var (
+		genesis, privKeys = testGenesis(consensus.NewBFT(bftTestConfig), 4)
+		nodes             = make([]*Node, len(privKeys))
+		target            = 3
+	)
+
+	for i, privKey := range privKeys {
+		nodes[i] = NewNode(ServerConfig{
+			ListenAddr: freeAddr(t),
+			PrivateKey: privKey,
+			Genesis:    genesis,
+		})
+	}
+
+	startNode(t, nodes[0], nil)
+	time.Sleep(time.Millisecond * 200)
+
+	for _, n := range nodes[1:] {
+		startNode(t, n, []string{nodes[0].ListenAddr})
+	}
+
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if n.chain.Height() < target {
+				return false
+			}
+		}
+		return true
+	}, time.Second*30, time.Millisecond*100)
+
+	engine := genesis.Engine.(*consensus.BFT)
+
+	for height := 1; height <= target; height++ {
+
+		first, err := nodes[0].chain.GetBlockByHeight(height)
+		require.Nil(t, err)
+		require.Nil(t, engine.VerifyCommit(nodes[0].chain, first))
+
+		for _, n := range nodes[1:] {
+
+			block, err := n.chain.GetBlockByHeight(height)
+			require.Nil(t, err)
+			require.Equal(t, types.HashBlock(first), types.HashBlock(block))
+
+			// Certificates may differ in whose precommits made it in, never in what they're for
+			require.Nil(t, engine.VerifyCommit(n.chain, block))
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package node
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// ----------------------------------------------------------------
+// Every block the chain has accepted, on the active branch or not, linked to its parent
+type blockNode struct {
+	hash   string
+	header *proto.Header
+	parent *blockNode
+	height int
+
+	// cumulative weight of the branch from genesis up to and including this block
+	weight uint64
+}
+
+// ancestor walks back to the node at [height] on this node's branch
+func (bn *blockNode) ancestor(height int) *blockNode {
+
+	it := bn
+	for it != nil && it.height > height {
+		it = it.parent
+	}
+
+	return it
+}
+
+// ----------------------------------------------------------------
+type BlockTree struct {
+	lock  sync.RWMutex
+	nodes map[string]*blockNode
+
+	// what a block adds to its branch - the engine's fork choice
+	weight func(*proto.Header) uint64
+}
+
+func NewBlockTree(weight func(*proto.Header) uint64) *BlockTree {
+	return &BlockTree{
+		nodes:  make(map[string]*blockNode),
+		weight: weight,
+	}
+}
+
+func (t *BlockTree) Get(hash string) *blockNode {
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.nodes[hash]
+}
+
+func (t *BlockTree) Has(hash string) bool {
+	return t.Get(hash) != nil
+}
+
+func (t *BlockTree) Len() int {
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return len(t.nodes)
+}
+
+// Insert links [h] under [parent] - a nil parent is only valid for genesis
+func (t *BlockTree) Insert(h *proto.Header, parent *blockNode) *blockNode {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	node := &blockNode{
+		hash:   hex.EncodeToString(types.HashHeader(h)),
+		header: h,
+		parent: parent,
+		weight: t.weight(h),
+	}
+
+	if parent != nil {
+		node.height = parent.height + 1
+		node.weight += parent.weight
+	}
+
+	t.nodes[node.hash] = node
+
+	return node
+}
+
+// Remove drops [node] along with every descendant built on top of it
+func (t *BlockTree) Remove(node *blockNode) {
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	doomed := map[*blockNode]bool{node: true}
+
+	// Descendants always sit higher than their parent so a couple of passes settles it
+	for changed := true; changed; {
+		changed = false
+		for _, it := range t.nodes {
+			if !doomed[it] && doomed[it.parent] {
+				doomed[it] = true
+				changed = true
+			}
+		}
+	}
+
+	for it := range doomed {
+		delete(t.nodes, it.hash)
+	}
+}
+
+// ----------------------------------------------------------------
+// Fork choice
+
+// findFork returns the last block shared by the branches ending at [a] and [b]
+func findFork(a, b *blockNode) *blockNode {
+
+	if a.height > b.height {
+		a = a.ancestor(b.height)
+	} else {
+		b = b.ancestor(a.height)
+	}
+
+	for a != b {
+		a = a.parent
+		b = b.parent
+	}
+
+	return a
+}
@@ -3,9 +3,12 @@ package node
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
-	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/consensus"
 	"github.com/i101dev/blocker/proto"
 	"github.com/i101dev/blocker/types"
 )
@@ -15,6 +18,7 @@ const originSeed string = "b72a9caf5a5c5e6b88ee6f25f053d07b43ddc263a034e2b8e7175
 
 // ----------------------------------------------------------------------------------
 type HeaderList struct {
+	lock    sync.RWMutex
 	headers []*proto.Header
 }
 
@@ -25,17 +29,46 @@ func NewHeaderList() *HeaderList {
 }
 
 func (list *HeaderList) Add(h *proto.Header) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
 	list.headers = append(list.headers, h)
 }
 
-func (list *HeaderList) Get(index int) *proto.Header {
-	if index > list.Height() {
-		panic("index too high")
+func (list *HeaderList) Get(index int) (*proto.Header, error) {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	if index < 0 || index >= len(list.headers) {
+		return nil, fmt.Errorf("given height (%d) out of range - current height: (%d)", index, len(list.headers)-1)
 	}
-	return list.headers[index]
+	return list.headers[index], nil
+}
+
+func (list *HeaderList) Last() *proto.Header {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	return list.headers[len(list.headers)-1]
+}
+
+// RemoveLast pops the tip header, for when a block is disconnected
+func (list *HeaderList) RemoveLast() *proto.Header {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	last := list.headers[len(list.headers)-1]
+	list.headers = list.headers[:len(list.headers)-1]
+	return last
+}
+
+// Replace drops every header above [height] and appends [headers] in their place, all
+// at once - so nobody reading the list sees it half way through a reorg
+func (list *HeaderList) Replace(height int, headers []*proto.Header) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	list.headers = append(list.headers[:height+1:height+1], headers...)
 }
 
 func (list *HeaderList) Len() int {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
 	return len(list.headers)
 }
 
@@ -43,214 +76,749 @@ func (list *HeaderList) Height() int {
 	return list.Len() - 1
 }
 
+// ----------------------------------------------------------------
+// headerIndex gives the consensus engine its view of the chain where there's no block
+// tree to look headers up in - headers go in once checked and are never taken out
+type headerIndex struct {
+	lock    sync.RWMutex
+	genesis *proto.Header
+	headers map[string]*proto.Header
+}
+
+func newHeaderIndex(genesis *proto.Header) *headerIndex {
+
+	x := &headerIndex{
+		genesis: genesis,
+		headers: make(map[string]*proto.Header),
+	}
+	x.Add(genesis)
+
+	return x
+}
+
+func (x *headerIndex) Add(h *proto.Header) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	x.headers[hex.EncodeToString(types.HashHeader(h))] = h
+}
+
+func (x *headerIndex) GetHeader(hash []byte) *proto.Header {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+	return x.headers[hex.EncodeToString(hash)]
+}
+
+func (x *headerIndex) GenesisHeader() *proto.Header {
+	return x.genesis
+}
+
 // ----------------------------------------------------------------
 type UTXO struct {
 	Hash     string
 	OutIndex int
 	Amount   uint64
+	Address  []byte
 	Spent    bool
+
+	// The validator the output is bonded with, if it is - it can only be unbonded
+	Validator []byte `json:",omitempty"`
+
+	// Height of the coinbase that minted the output - it's locked until it matures
+	MintedAt int `json:",omitempty"`
+
+	// Height of the unbonding that paid the output out - it's locked for the unbonding
+	// period from there
+	UnbondedAt int `json:",omitempty"`
+}
+
+func (u *UTXO) Key() string {
+	return fmt.Sprintf("%s_%d", u.Hash, u.OutIndex)
+}
+
+// ----------------------------------------------------------------
+// BlockUndo is everything needed to take a block back off the UTXO set - the
+// outputs it spent, as they were right before it was connected
+type BlockUndo struct {
+	Spent []*UTXO
+
+	// bonds slashed by the block's evidence
+	Forfeited []*UTXO `json:",omitempty"`
 }
 
 // ----------------------------------------------------------------
 type Chain struct {
+	// serializes writers - readers go through the [HeaderList] and store locks
+	lock sync.Mutex
+
 	blockStore BlockStorer
 	utxoStore  UTXOStorer
 	txStore    TXStorer
-	headers    *HeaderList
+
+	// [headers] is the active branch only - [tree] holds every known branch
+	headers *HeaderList
+	tree    *BlockTree
+	tip     *blockNode
+
+	genesis *Genesis
+	engine  consensus.Engine
+
+	// stake bonded as of each block, for staking engines
+	stakes *stakeIndex
+
+	// receives the transactions dropped from the active branch, and each block joining it
+	orphanHandler func([]*proto.Transaction)
+	blockHandler  func(*proto.Block)
+
+	// who signed what lately, and who hears about it when someone signs twice
+	signed            *signedIndex
+	doubleSignHandler func(*proto.Evidence)
+
+	// how far ahead of our clock a block may be
+	maxClockDrift time.Duration
 }
 
 func NewChain(bs BlockStorer, ts TXStorer, us UTXOStorer) *Chain {
 
+	newChain, err := OpenChain(bs, ts, us)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return newChain
+}
+
+// OpenChain picks up from whatever the stores already hold, or starts a fresh chain
+// from the default genesis if they're empty
+func OpenChain(bs BlockStorer, ts TXStorer, us UTXOStorer) (*Chain, error) {
+	return OpenChainWithGenesis(DefaultGenesis(), bs, ts, us)
+}
+
+func OpenChainWithGenesis(genesis *Genesis, bs BlockStorer, ts TXStorer, us UTXOStorer) (*Chain, error) {
+
+	engine := genesis.engine()
+
 	newChain := &Chain{
 		blockStore: bs,
 		utxoStore:  us,
 		txStore:    ts,
 		headers:    NewHeaderList(),
+		tree:       NewBlockTree(engine.Weight),
+		genesis:    genesis,
+		engine:     engine,
+		stakes:     newStakeIndex(bs.GetBlock),
+		signed:     newSignedIndex(),
+
+		maxClockDrift: DefaultMaxClockDrift,
 	}
 
-	newChain.addBlock(createGenesisBlock())
+	tipHash, err := bs.GetTip()
+	if err != nil {
+		return nil, err
+	}
 
-	return newChain
+	if tipHash != "" {
+		return newChain, newChain.load(tipHash)
+	}
+
+	genesisBlock := genesis.Block()
+	node := newChain.tree.Insert(genesisBlock.Header, nil)
+
+	if err := newChain.addBlock(genesisBlock, node); err != nil {
+		return nil, err
+	}
+
+	return newChain, nil
 }
 
-func (c *Chain) Height() int {
-	return c.headers.Height()
+// load rebuilds the headers and block tree from storage - the active branch is found by
+// walking back from the stored tip, then any side branches are hung off it
+func (c *Chain) load(tipHash string) error {
+
+	branch, err := loadBranch(c.blockStore, tipHash)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(types.HashBlock(branch[0]), types.HashBlock(c.genesis.Block())) {
+		return fmt.Errorf("stored chain has a different genesis block")
+	}
+
+	var parent *blockNode
+
+	for _, b := range branch {
+		c.headers.Add(b.Header)
+		parent = c.tree.Insert(b.Header, parent)
+	}
+
+	c.tip = parent
+
+	return c.loadSideBranches()
 }
 
-func (c *Chain) addBlock(b *proto.Block) error {
+// loadBranch walks back from [tipHash] to the first block, returning the branch genesis first
+func loadBranch(bs BlockStorer, tipHash string) ([]*proto.Block, error) {
 
-	c.headers.Add(b.Header)
+	branch := []*proto.Block{}
 
-	for _, tx := range b.Transactions {
+	for hash := tipHash; ; {
 
-		if err := c.txStore.Put(tx); err != nil {
-			return err
+		b, err := bs.GetBlock(hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load active branch: %v", err)
 		}
 
-		hash := hex.EncodeToString(types.HashTransaction(tx))
+		branch = append(branch, b)
 
-		for index, output := range tx.Outputs {
+		if len(b.Header.PrevHash) == 0 {
+			break
+		}
 
-			utxo := &UTXO{
-				Hash:     hash,
-				Amount:   output.Amount,
-				OutIndex: index,
-				Spent:    false,
-			}
+		hash = hex.EncodeToString(b.Header.PrevHash)
+	}
 
-			// key := fmt.Sprintf("%s_%d", hash, it)
+	for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+		branch[i], branch[j] = branch[j], branch[i]
+	}
 
-			if err := c.utxoStore.Put(utxo); err != nil {
-				return err
-			}
+	return branch, nil
+}
+
+func (c *Chain) loadSideBranches() error {
+
+	pending := []*proto.Block{}
+
+	err := c.blockStore.ForEachBlock(func(b *proto.Block) error {
+		if !c.tree.Has(hex.EncodeToString(types.HashBlock(b))) {
+			pending = append(pending, b)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		for _, input := range tx.Inputs {
+	// Blocks come back in no particular order - keep going until nothing else links up
+	for progress := true; progress; {
 
-			key := fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
-			utxo, err := c.utxoStore.Get(key)
+		progress = false
+		rest := pending[:0]
 
-			if err != nil {
-				panic(err)
-			}
+		for _, b := range pending {
 
-			utxo.Spent = true
+			parent := c.tree.Get(hex.EncodeToString(b.Header.PrevHash))
 
-			if err := c.utxoStore.Put(utxo); err != nil {
-				return err
+			if parent == nil {
+				rest = append(rest, b)
+				continue
 			}
 
-			// fmt.Println("\n-----------------------------------------------")
-			// fmt.Printf("\n*** >>> [utxo.Hash] - %+v", utxo.Hash)
-			// fmt.Printf("\n*** >>> [utxo.OutIndex] - %+v", utxo.OutIndex)
-			// fmt.Printf("\n*** >>> [utxo.Amount] - %+v", utxo.Amount)
-			// fmt.Printf("\n*** >>> [utxo.Spent] - %+v", utxo.Spent)
-			// fmt.Println("\n-----------------------------------------------")
+			c.tree.Insert(b.Header, parent)
+			progress = true
 		}
+
+		pending = rest
 	}
 
-	return c.blockStore.PutBlock(b)
+	return nil
 }
 
-func (c *Chain) AddBlock(b *proto.Block) error {
+// OnOrphanedTxs registers [fn] to take back the transactions a reorg or a disconnect knocks
+// off the active branch
+func (c *Chain) OnOrphanedTxs(fn func([]*proto.Transaction)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.orphanHandler = fn
+}
 
-	if err := c.ValidateBlock(b); err != nil {
-		return err
+// OnBlockConnected registers [fn] to take each block once it's connected to the active branch
+func (c *Chain) OnBlockConnected(fn func(*proto.Block)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.blockHandler = fn
+}
+
+// connected hands off [b], now on the active branch
+func (c *Chain) connected(b *proto.Block) {
+	if c.blockHandler != nil {
+		c.blockHandler(b)
 	}
+}
 
-	return c.addBlock(b)
+// SetMaxClockDrift sets how far ahead of our clock a block's timestamp may be
+func (c *Chain) SetMaxClockDrift(drift time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.maxClockDrift = drift
 }
 
-func (c *Chain) GetBlockByHash(hash []byte) (*proto.Block, error) {
-	hashHex := hex.EncodeToString(hash)
-	return c.blockStore.GetBlock(hashHex)
+// OnDoubleSign registers [fn] to take the evidence whenever an accepted block's signer
+// turns out to have signed another at the same height - staking engines only
+func (c *Chain) OnDoubleSign(fn func(*proto.Evidence)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.doubleSignHandler = fn
 }
 
-func (c *Chain) GetBlockByHeight(height int) (*proto.Block, error) {
+// watchSigner hands off the evidence if [b]'s signer has signed twice
+func (c *Chain) watchSigner(b *proto.Block) {
 
-	if c.Height() < height {
-		return nil, fmt.Errorf("given height (%d) too high - current height: (%d)", height, c.Height())
+	if _, ok := c.engine.(consensus.Staking); !ok {
+		return
 	}
 
-	header := c.headers.Get(height)
-	hash := types.HashHeader(header)
+	ev := c.signed.record(b)
 
-	return c.GetBlockByHash(hash)
+	if ev != nil && c.doubleSignHandler != nil {
+		fmt.Printf("\n*** >>> DOUBLE SIGN <<< *** || signer: [%x] || height: (%d)", b.PublicKey, b.Header.Height)
+		c.doubleSignHandler(ev)
+	}
 }
 
-func (c *Chain) ValidateBlock(newBlock *proto.Block) error {
+func (c *Chain) Height() int {
+	return c.headers.Height()
+}
+
+func (c *Chain) Genesis() *Genesis {
+	return c.genesis
+}
+
+func (c *Chain) Engine() consensus.Engine {
+	return c.engine
+}
 
-	// Validate [newBlock] signature
-	if !types.VerifyBlock(newBlock) {
-		return fmt.Errorf("failed to verify block signature")
+// GetHeader finds a header on any branch - with GenesisHeader, this is the view of the
+// chain the consensus engine gets
+func (c *Chain) GetHeader(hash []byte) *proto.Header {
+
+	if node := c.tree.Get(hex.EncodeToString(hash)); node != nil {
+		return node.header
+	}
+
+	return nil
+}
+
+func (c *Chain) GenesisHeader() *proto.Header {
+	header, _ := c.headers.Get(0)
+	return header
+}
+
+// Stakes lists the validators with coins bonded as of block [hash] - for staking engines
+func (c *Chain) Stakes(hash []byte) ([]consensus.Stake, error) {
+	return c.stakes.Stakes(hash)
+}
+
+func (c *Chain) newBatchView() *batchView {
+	return &batchView{
+		batch:      NewBatch(),
+		blockStore: c.blockStore,
+		utxoStore:  c.utxoStore,
 	}
+}
 
-	// Validate if the [prevHash] is the hash of the current block
-	cBlock, err := c.GetBlockByHeight(c.Height())
+func (c *Chain) commit(batch *Batch) error {
+	return commitBatch(c.blockStore, c.txStore, c.utxoStore, batch)
+}
 
+// addBlock connects [b] on top of the active branch - all of its writes are committed
+// together, and the in-memory state only moves once they have been
+func (c *Chain) addBlock(b *proto.Block, node *blockNode) error {
+
+	forfeited, err := c.stakes.forfeited(hex.EncodeToString(b.Header.PrevHash), b)
 	if err != nil {
-		return fmt.Errorf("failed to get block by height: %+v", err)
+		return err
 	}
 
-	cBlockHash := types.HashBlock(cBlock)
+	view := c.newBatchView()
 
-	if !bytes.Equal(cBlockHash, newBlock.Header.PrevHash) {
-		return fmt.Errorf("previous block hash invalid")
+	if err := stageConnect(view, b, node.height, forfeited); err != nil {
+		return err
 	}
 
-	for _, tx := range newBlock.Transactions {
-		if err := c.ValidateTransaction(tx); err != nil {
-			return err
-		}
+	view.batch.SetTip(node.hash)
+
+	if err := c.commit(view.batch); err != nil {
+		return err
 	}
 
+	c.headers.Add(b.Header)
+	c.tip = node
+
+	c.connected(b)
+
 	return nil
 }
 
-func (c *Chain) ValidateTransaction(tx *proto.Transaction) error {
+// DisconnectTip rolls the active branch back by one block, restoring the UTXO set to
+// exactly what it was before that block was connected. The block stays in storage but
+// is forgotten by the fork choice, so it won't be picked up again unless it's re-added
+func (c *Chain) DisconnectTip() (*proto.Block, error) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.tip.parent == nil {
+		return nil, fmt.Errorf("cannot disconnect the genesis block")
+	}
+
+	b, err := c.blockStore.GetBlock(c.tip.hash)
+	if err != nil {
+		return nil, err
+	}
+
+	view := c.newBatchView()
+
+	if err := stageDisconnect(view, b); err != nil {
+		return nil, err
+	}
+
+	view.batch.SetTip(c.tip.parent.hash)
+
+	if err := c.commit(view.batch); err != nil {
+		return nil, err
+	}
+
+	disconnected := c.tip
+
+	c.headers.RemoveLast()
+	c.tip = c.tip.parent
+	c.tree.Remove(disconnected)
+
+	c.releaseOrphanedTxs([]*proto.Block{b}, nil)
+
+	return b, nil
+}
+
+func (c *Chain) AddBlock(b *proto.Block) error {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.ValidateBlock(b); err != nil {
+		return err
+	}
+
+	if err := c.verifyCommit(b); err != nil {
+		return err
+	}
+
+	c.watchSigner(b)
+
+	parent := c.tree.Get(hex.EncodeToString(b.Header.PrevHash))
+	node := c.tree.Insert(b.Header, parent)
+
+	// Extends the active branch - the common case
+	if parent == c.tip {
+
+		if err := c.addBlock(b, node); err != nil {
+			c.tree.Remove(node)
+			return err
+		}
+
+		return nil
+	}
 
-	if !types.VerifyTransaction(tx) {
-		return fmt.Errorf("invalid transaction signature")
+	// Side branch - keep the block around in case the branch overtakes ours
+	if err := c.blockStore.PutBlock(b); err != nil {
+		c.tree.Remove(node)
+		return err
 	}
 
-	// Check if all inputs are unspent ----------------------------------
-	hash := hex.EncodeToString(types.HashTransaction(tx))
-	nInputs := len(tx.Inputs)
+	if node.weight <= c.tip.weight {
+		return nil
+	}
 
-	sumInputs := 0
-	for i := 0; i < nInputs; i++ {
+	return c.reorganize(node)
+}
+
+// reorganize moves the active branch over to the one ending at [newTip] - the old branch
+// is rolled back to the fork point and the new one replayed on top, all in one batch. If
+// any block on the new branch turns out to be invalid, that part of the branch is dropped
+// and nothing is written, leaving the old branch in place
+func (c *Chain) reorganize(newTip *blockNode) error {
 
-		prevHash := hex.EncodeToString(tx.Inputs[i].PrevTxHash)
-		key := fmt.Sprintf("%s_%d", prevHash, i)
+	var (
+		fork   = findFork(c.tip, newTip)
+		view   = c.newBatchView()
+		detach = []*proto.Block{}
+		attach = []*blockNode{}
+	)
 
-		utxo, err := c.utxoStore.Get(key)
-		sumInputs += int(utxo.Amount)
+	for it := c.tip; it != fork; it = it.parent {
 
+		b, err := c.blockStore.GetBlock(it.hash)
 		if err != nil {
 			return err
 		}
 
-		if utxo.Spent {
-			return fmt.Errorf("output [%d] of tx [%s] is spent", i, hash)
+		if err := stageDisconnect(view, b); err != nil {
+			return err
+		}
+
+		detach = append(detach, b)
+	}
+
+	for it := newTip; it != fork; it = it.parent {
+		attach = append([]*blockNode{it}, attach...)
+	}
+
+	attached := []*proto.Block{}
+
+	for _, node := range attach {
+
+		var forfeited []string
+
+		b, err := c.blockStore.GetBlock(node.hash)
+
+		if err == nil {
+			err = c.validateTransactions(b, view, node.height)
+		}
+		if err == nil {
+			forfeited, err = c.stakes.forfeited(node.parent.hash, b)
+		}
+		if err == nil {
+			err = stageConnect(view, b, node.height, forfeited)
+		}
+
+		if err != nil {
+			c.tree.Remove(node)
+			return fmt.Errorf("reorg to [%s] aborted: %w", newTip.hash, err)
 		}
+
+		attached = append(attached, b)
+	}
+
+	view.batch.SetTip(newTip.hash)
+
+	if err := c.commit(view.batch); err != nil {
+		return err
 	}
 
-	sumOutputs := 0
-	for _, output := range tx.Outputs {
-		sumOutputs += int(output.Amount)
+	headers := make([]*proto.Header, len(attached))
+	for i, b := range attached {
+		headers[i] = b.Header
 	}
 
-	if sumInputs < sumOutputs {
-		return fmt.Errorf("insufficient balance")
+	c.headers.Replace(fork.height, headers)
+
+	c.tip = newTip
+
+	for _, b := range attached {
+		c.connected(b)
 	}
 
+	fmt.Printf("\n*** >>> REORG <<< *** || fork height: (%d) || dropped: (%d) || added: (%d)", fork.height, len(detach), len(attach))
+
+	c.releaseOrphanedTxs(detach, attached)
+
 	return nil
 }
 
-func createGenesisBlock() *proto.Block {
+// releaseOrphanedTxs hands off every tx from the [detached] blocks that didn't make it into the new branch
+func (c *Chain) releaseOrphanedTxs(detached []*proto.Block, attached []*proto.Block) {
+
+	if c.orphanHandler == nil {
+		return
+	}
+
+	included := make(map[string]bool)
+	for _, b := range attached {
+		for _, tx := range b.Transactions {
+			included[hex.EncodeToString(types.HashTransaction(tx))] = true
+		}
+	}
+
+	orphaned := []*proto.Transaction{}
+	for _, b := range detached {
+		for _, tx := range b.Transactions {
+			// A coinbase is only any good in the block it was minted for
+			if tx.Kind == proto.TxKind_COINBASE {
+				continue
+			}
+			if !included[hex.EncodeToString(types.HashTransaction(tx))] {
+				orphaned = append(orphaned, tx)
+			}
+		}
+	}
+
+	if len(orphaned) > 0 {
+		c.orphanHandler(orphaned)
+	}
+}
+
+func (c *Chain) GetBlockByHash(hash []byte) (*proto.Block, error) {
+	hashHex := hex.EncodeToString(hash)
+	return c.blockStore.GetBlock(hashHex)
+}
+
+func (c *Chain) HasBlock(hash []byte) bool {
+	_, err := c.GetBlockByHash(hash)
+	return err == nil
+}
+
+func (c *Chain) GetBlockByHeight(height int) (*proto.Block, error) {
+
+	header, err := c.headers.Get(height)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.GetBlockByHash(types.HashHeader(header))
+}
+
+var ErrTxNotFound = errors.New("transaction not found")
+
+// GetTxProof proves tx [txHash] is in block [blockHash] - or anywhere on the active chain,
+// newest first, if [blockHash] is empty
+func (c *Chain) GetTxProof(txHash []byte, blockHash []byte) (*proto.TxProof, error) {
+
+	prove := func(b *proto.Block) (*proto.TxProof, error) {
+
+		for i, tx := range b.Transactions {
+
+			if !bytes.Equal(types.HashTransaction(tx), txHash) {
+				continue
+			}
+
+			proof, err := types.GetMerkleProof(b, i)
+			if err != nil {
+				return nil, err
+			}
+
+			return &proto.TxProof{
+				Header: &proto.SignedHeader{
+					Header:    b.Header,
+					PublicKey: b.PublicKey,
+					Signature: b.Signature,
+				},
+				Transaction: tx,
+				Proof:       proof,
+			}, nil
+		}
+
+		return nil, ErrTxNotFound
+	}
+
+	if len(blockHash) > 0 {
+
+		b, err := c.GetBlockByHash(blockHash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: block [%x] unknown", ErrTxNotFound, blockHash)
+		}
+
+		return prove(b)
+	}
+
+	for height := c.Height(); height >= 0; height-- {
+
+		b, err := c.GetBlockByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+
+		if proof, err := prove(b); err != ErrTxNotFound {
+			return proof, err
+		}
+	}
+
+	return nil, ErrTxNotFound
+}
+
+func (c *Chain) ValidateBlock(newBlock *proto.Block) error {
+
+	if newBlock.Header == nil {
+		return validationErrorf(CodeMalformed, "block has no header")
+	}
+
+	hash := hex.EncodeToString(types.HashBlock(newBlock))
+
+	// Validate [newBlock] signature, and that the header commits to the body it came with
+	if !types.VerifyHeader(newBlock.Header, newBlock.PublicKey, newBlock.Signature) {
+		return fmt.Errorf("block [%s]: %w", hash, ErrBadSignature)
+	}
+
+	if !types.VerifyRootHash(newBlock) {
+		return fmt.Errorf("block [%s]: %w", hash, ErrBadMerkleRoot)
+	}
+
+	if !types.VerifyEvidenceHash(newBlock) {
+		return validationErrorf(CodeBadEvidence, "block [%s]: evidence hash does not match the evidence", hash)
+	}
+
+	if c.tree.Has(hash) {
+		return fmt.Errorf("block [%s]: %w", hash, ErrKnownBlock)
+	}
+
+	// Validate the [prevHash] points at a block we know about, on any branch
+	parent := c.tree.Get(hex.EncodeToString(newBlock.Header.PrevHash))
+
+	if parent == nil {
+		return fmt.Errorf("block [%s]: %w", hash, ErrUnknownParent)
+	}
+
+	if err := checkHeader(newBlock.Header, parent.height, medianTimePast(parent)); err != nil {
+		return fmt.Errorf("block [%s]: %w", hash, err)
+	}
+
+	if err := checkClock(newBlock.Header, time.Now(), c.maxClockDrift); err != nil {
+		return fmt.Errorf("block [%s]: %w", hash, err)
+	}
+
+	if err := c.engine.VerifyHeader(c, parent.header, newBlock.Header, newBlock.PublicKey); err != nil {
+		return fmt.Errorf("block [%s]: %w", hash, fromConsensus(err))
+	}
 
-	privKey := crypto.NewPrivateKeyFromString(originSeed)
+	// Evidence only needs the stakes, which every branch has
+	if err := verifyEvidence(c.engine, c.stakes, newBlock.Evidence, parent.hash, parent.height+1); err != nil {
+		return fmt.Errorf("block [%s]: %w", hash, err)
+	}
 
-	block := &proto.Block{
-		Header: &proto.Header{
-			Version: 1,
-		},
+	// Transactions can only be checked against the UTXO set of the branch they build on,
+	// so blocks for a side branch get theirs checked if and when that branch is connected
+	if parent != c.tip {
+		return nil
 	}
 
-	genesisTX := &proto.Transaction{
-		Version: 1,
-		Inputs:  []*proto.TxInput{},
-		Outputs: []*proto.TxOutput{
-			{
-				Amount:  123,
-				Address: privKey.PubKey().Address().Bytes(),
-			},
-		},
+	return c.validateTransactions(newBlock, c.utxoStore, parent.height+1)
+}
+
+// verifyCommit holds [b] to the engine's commit certificate, for engines that have them
+func (c *Chain) verifyCommit(b *proto.Block) error {
+
+	finality, ok := c.engine.(consensus.Finality)
+	if !ok {
+		return nil
 	}
 
-	block.Transactions = append(block.Transactions, genesisTX)
+	if err := finality.VerifyCommit(c, b); err != nil {
+		return fmt.Errorf("block [%x]: %w", types.HashBlock(b), fromConsensus(err))
+	}
+
+	return nil
+}
+
+// ValidateEvidence checks [ev] could go in the next block on the active branch
+func (c *Chain) ValidateEvidence(ev *proto.Evidence) error {
+
+	tip := c.headers.Last()
+
+	return verifyEvidence(c.engine, c.stakes, []*proto.Evidence{ev}, hex.EncodeToString(types.HashHeader(tip)), int(tip.Height)+1)
+}
+
+// ValidateProposal checks [b] could go on top of the active branch as it stands - for
+// blocks still being voted on, which have no commit certificate yet
+func (c *Chain) ValidateProposal(b *proto.Block) error {
 
-	types.SignBlock(privKey, block)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if b.Header == nil {
+		return validationErrorf(CodeMalformed, "block has no header")
+	}
+
+	if !bytes.Equal(b.Header.PrevHash, types.HashHeader(c.headers.Last())) {
+		return validationErrorf(CodeUnknownParent, "block [%x] does not build on the tip", types.HashBlock(b))
+	}
 
-	return block
+	return c.ValidateBlock(b)
 }
@@ -2,15 +2,22 @@ package node
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/i101dev/blocker/consensus"
 	"github.com/i101dev/blocker/crypto"
 	"github.com/i101dev/blocker/proto"
 	"github.com/i101dev/blocker/types"
 	"github.com/i101dev/blocker/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func RandomBlock(t *testing.T, chain *Chain) *proto.Block {
@@ -22,7 +29,28 @@ func RandomBlock(t *testing.T, chain *Chain) *proto.Block {
 
 	require.Nil(t, err)
 
+	block.Header.Height = prevBlock.Header.Height + 1
 	block.Header.PrevHash = types.HashBlock(prevBlock)
+	block.Transactions = withCoinbase(block.Header.Height, privKey, nil)
+	types.SignBlock(privKey, block)
+
+	return block
+}
+
+func NextBlock(t *testing.T, chain *Chain, privKey *crypto.PrivateKey) *proto.Block {
+
+	prevBlock, err := chain.GetBlockByHeight(chain.Height())
+	require.Nil(t, err)
+
+	block := &proto.Block{
+		Header: &proto.Header{
+			Version:   1,
+			Height:    int32(chain.Height() + 1),
+			PrevHash:  types.HashBlock(prevBlock),
+			Timestamp: time.Now().UnixNano(),
+		},
+		Transactions: withCoinbase(int32(chain.Height()+1), privKey, nil),
+	}
 	types.SignBlock(privKey, block)
 
 	return block
@@ -111,7 +139,8 @@ func TestAddBlockWithTX(t *testing.T) {
 	sig := types.SignTransaction(senderPrivKey, tx)
 	tx.Inputs[0].Signature = sig.Bytes()
 
-	block.Transactions = append(block.Transactions, tx)
+	// Signed over by the sender, so its coinbase pays the sender
+	block.Transactions = append(withCoinbase(block.Header.Height, senderPrivKey, nil), tx)
 	types.SignBlock(senderPrivKey, block)
 	require.Nil(t, chain.AddBlock(block))
 
@@ -171,5 +200,446 @@ func TestAddBlockWithTXInsufficientFunds(t *testing.T) {
 	tx.Inputs[0].Signature = sig.Bytes()
 
 	block.Transactions = append(block.Transactions, tx)
+	types.SignBlock(senderPrivKey, block)
 	require.NotNil(t, chain.AddBlock(block))
 }
+
+func BlockOn(t *testing.T, parent *proto.Block, privKey *crypto.PrivateKey, txx ...*proto.Transaction) *proto.Block {
+
+	block := &proto.Block{
+		Header: &proto.Header{
+			Version:   1,
+			Height:    parent.Header.Height + 1,
+			PrevHash:  types.HashBlock(parent),
+			Timestamp: time.Now().UnixNano(),
+		},
+		Transactions: withCoinbase(parent.Header.Height+1, privKey, txx),
+	}
+	types.SignBlock(privKey, block)
+
+	return block
+}
+
+// withCoinbase puts a coinbase paying [privKey] nothing, for [height], in front of [txx] -
+// unless [txx] starts with a coinbase of its own
+func withCoinbase(height int32, privKey *crypto.PrivateKey, txx []*proto.Transaction) []*proto.Transaction {
+
+	if len(txx) > 0 && txx[0].Kind == proto.TxKind_COINBASE {
+		return txx
+	}
+
+	coinbase := NewCoinbase(int(height), privKey.PubKey().Address().Bytes(), 0)
+
+	return append([]*proto.Transaction{coinbase}, txx...)
+}
+
+// What each validator in a test genesis stakes, on staking engines
+const testStake = 100
+
+// testGenesis is a genesis for [engine] with [n] fresh validators - each staking
+// [testStake] if the engine goes by stake
+func testGenesis(engine consensus.Engine, n int) (*Genesis, []*crypto.PrivateKey) {
+
+	var (
+		privKeys = make([]*crypto.PrivateKey, n)
+		genesis  = &Genesis{Engine: engine}
+	)
+
+	if _, ok := engine.(consensus.Staking); ok {
+		genesis.Stake = testStake
+	}
+
+	for i := range privKeys {
+		privKeys[i] = crypto.GeneratePrivateKey()
+		genesis.Validators = append(genesis.Validators, privKeys[i].PubKey().Bytes())
+	}
+
+	return genesis, privKeys
+}
+
+func genesisSpendTX(t *testing.T, chain *Chain, amount uint64) *proto.Transaction {
+
+	var (
+		senderPrivKey = crypto.NewPrivateKeyFromString(originSeed)
+		receiver      = crypto.GeneratePrivateKey().PubKey().Address().Bytes()
+	)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	tx := &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{
+			{
+				PrevOutIndex: 0,
+				PrevTxHash:   types.HashTransaction(genesis.Transactions[0]),
+				PubKey:       senderPrivKey.PubKey().Bytes(),
+			},
+		},
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  amount,
+				Address: receiver,
+			},
+		},
+	}
+
+	tx.Inputs[0].Signature = types.SignTransaction(senderPrivKey, tx).Bytes()
+
+	return tx
+}
+
+func TestReorgToHeavierBranch(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+		orphans = []*proto.Transaction{}
+	)
+
+	chain.OnOrphanedTxs(func(txx []*proto.Transaction) {
+		orphans = append(orphans, txx...)
+	})
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	genesisKey := fmt.Sprintf("%s_0", hex.EncodeToString(types.HashTransaction(genesis.Transactions[0])))
+	tx := genesisSpendTX(t, chain, 100)
+	txKey := fmt.Sprintf("%s_0", hex.EncodeToString(types.HashTransaction(tx)))
+
+	// Active branch: genesis -> a1 (spends the genesis output) -> a2
+	a1 := BlockOn(t, genesis, privKey, tx)
+	a2 := BlockOn(t, a1, privKey)
+	require.Nil(t, chain.AddBlock(a1))
+	require.Nil(t, chain.AddBlock(a2))
+
+	utxo, err := chain.utxoStore.Get(genesisKey)
+	require.Nil(t, err)
+	require.True(t, utxo.Spent)
+
+	// Competing branch: genesis -> b1 -> b2 -> b3
+	b1 := BlockOn(t, genesis, privKey)
+	b2 := BlockOn(t, b1, privKey)
+	b3 := BlockOn(t, b2, privKey)
+
+	require.Nil(t, chain.AddBlock(b1))
+	require.Nil(t, chain.AddBlock(b2))
+
+	// Equal weight - first seen branch stays active
+	tip, err := chain.GetBlockByHeight(2)
+	require.Nil(t, err)
+	require.Equal(t, types.HashBlock(a2), types.HashBlock(tip))
+
+	require.Nil(t, chain.AddBlock(b3))
+	require.Equal(t, 3, chain.Height())
+
+	for height, want := range []*proto.Block{genesis, b1, b2, b3} {
+		have, err := chain.GetBlockByHeight(height)
+		require.Nil(t, err)
+		require.Equal(t, types.HashBlock(want), types.HashBlock(have))
+	}
+
+	// a1's spend is rolled back and its output is gone
+	utxo, err = chain.utxoStore.Get(genesisKey)
+	require.Nil(t, err)
+	require.False(t, utxo.Spent)
+
+	_, err = chain.utxoStore.Get(txKey)
+	require.NotNil(t, err)
+
+	require.Len(t, orphans, 1)
+	require.Equal(t, types.HashTransaction(tx), types.HashTransaction(orphans[0]))
+}
+
+func TestHeightReadsDuringReorg(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+		done    = make(chan struct{})
+		reads   sync.WaitGroup
+		wrong   atomic.Bool
+	)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	// Readers asking for heights the reorgs keep taking away and giving back get a
+	// block or an error - never a panic
+	for i := 0; i < 4; i++ {
+		reads.Add(1)
+		go func() {
+			defer reads.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for height := 0; height <= 12; height++ {
+					if b, err := chain.GetBlockByHeight(height); err == nil && int(b.Header.Height) != height {
+						wrong.Store(true)
+					}
+				}
+			}
+		}()
+	}
+
+	// Each branch overtakes the last by one block
+	tip := genesis
+	for branch := 1; branch <= 10; branch++ {
+
+		parent := genesis
+		for i := 0; i <= branch; i++ {
+			b := BlockOn(t, parent, privKey)
+			require.Nil(t, chain.AddBlock(b))
+			parent = b
+		}
+
+		tip = parent
+	}
+
+	close(done)
+	reads.Wait()
+
+	require.False(t, wrong.Load())
+
+	require.Equal(t, 11, chain.Height())
+	require.Equal(t, types.HashBlock(tip), types.HashHeader(chain.headers.Last()))
+
+	_, err = chain.GetBlockByHeight(12)
+	require.NotNil(t, err)
+	_, err = chain.GetBlockByHeight(-1)
+	require.NotNil(t, err)
+}
+
+func TestReorgToInvalidBranchIsUndone(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	a1 := BlockOn(t, genesis, privKey)
+	require.Nil(t, chain.AddBlock(a1))
+
+	// b2 overspends the genesis output - only caught once its branch is connected
+	b1 := BlockOn(t, genesis, privKey)
+	b2 := BlockOn(t, b1, privKey, genesisSpendTX(t, chain, 1000))
+
+	require.Nil(t, chain.AddBlock(b1))
+	require.NotNil(t, chain.AddBlock(b2))
+
+	require.Equal(t, 1, chain.Height())
+
+	tip, err := chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+	require.Equal(t, types.HashBlock(a1), types.HashBlock(tip))
+
+	// The rest of the branch is still usable
+	b2 = BlockOn(t, b1, privKey)
+	require.Nil(t, chain.AddBlock(b2))
+	require.Equal(t, 2, chain.Height())
+}
+
+// nonceEngine is Solo with nonce 2 blocks weighing ten times as much, and nonce 1 blocks
+// against the rules
+type nonceEngine struct {
+	*consensus.Solo
+}
+
+var errNonceOne = errors.New("nonce 1 blocks are not allowed")
+
+func (e nonceEngine) VerifyHeader(chain consensus.ChainReader, parent *proto.Header, header *proto.Header, signer []byte) error {
+
+	if header.Nonce == 1 {
+		return errNonceOne
+	}
+
+	return nil
+}
+
+func (e nonceEngine) Weight(header *proto.Header) uint64 {
+
+	if header.Nonce == 2 {
+		return 10
+	}
+
+	return 1
+}
+
+func TestChainFollowsEngine(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		genesis = &Genesis{Engine: nonceEngine{consensus.NewSolo(time.Second)}}
+	)
+
+	chain, err := OpenChainWithGenesis(genesis, NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	require.Nil(t, err)
+
+	parent, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	banned := BlockOn(t, parent, privKey)
+	banned.Header.Nonce = 1
+	types.SignBlock(privKey, banned)
+
+	err = chain.AddBlock(banned)
+	require.Equal(t, CodeConsensus, CodeOf(err))
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	for i := 0; i < 3; i++ {
+		block := BlockOn(t, parent, privKey)
+		require.Nil(t, chain.AddBlock(block))
+		parent = block
+	}
+
+	// One heavy block outweighs the longer branch
+	genesisBlock, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	heavy := BlockOn(t, genesisBlock, privKey)
+	heavy.Header.Nonce = 2
+	types.SignBlock(privKey, heavy)
+
+	require.Nil(t, chain.AddBlock(heavy))
+	require.Equal(t, 1, chain.Height())
+
+	tip, err := chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+	require.Equal(t, types.HashBlock(heavy), types.HashBlock(tip))
+}
+
+func TestAddBlockUnknownParent(t *testing.T) {
+
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	block := util.RandomBlock()
+	types.SignBlock(crypto.GeneratePrivateKey(), block)
+
+	require.NotNil(t, chain.AddBlock(block))
+	require.Equal(t, 0, chain.Height())
+}
+
+func snapshotUTXOs(store *MemoryUTXOStore) map[string]UTXO {
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	snapshot := make(map[string]UTXO)
+	for key, utxo := range store.data {
+		snapshot[key] = *utxo
+	}
+
+	return snapshot
+}
+
+func TestDisconnectTipRestoresUTXOs(t *testing.T) {
+
+	var (
+		senderPrivKey   = crypto.NewPrivateKeyFromString(originSeed)
+		receiverPrivKey = crypto.GeneratePrivateKey()
+		chain           = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	)
+
+	require.Nil(t, chain.AddBlock(NextBlock(t, chain, senderPrivKey)))
+
+	before := snapshotUTXOs(chain.utxoStore.(*MemoryUTXOStore))
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	txA := &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash: types.HashTransaction(genesis.Transactions[0]),
+				PubKey:     senderPrivKey.PubKey().Bytes(),
+			},
+		},
+		Outputs: []*proto.TxOutput{
+			{Amount: 100, Address: receiverPrivKey.PubKey().Address().Bytes()},
+			{Amount: 23, Address: senderPrivKey.PubKey().Address().Bytes()},
+		},
+	}
+	txA.Inputs[0].Signature = types.SignTransaction(senderPrivKey, txA).Bytes()
+
+	// Spends an output created earlier in the same block
+	txB := &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash: types.HashTransaction(txA),
+				PubKey:     receiverPrivKey.PubKey().Bytes(),
+			},
+		},
+		Outputs: []*proto.TxOutput{
+			{Amount: 100, Address: senderPrivKey.PubKey().Address().Bytes()},
+		},
+	}
+	txB.Inputs[0].Signature = types.SignTransaction(receiverPrivKey, txB).Bytes()
+
+	block := NextBlock(t, chain, senderPrivKey)
+	block.Transactions = []*proto.Transaction{txA, txB}
+	types.SignBlock(senderPrivKey, block)
+
+	// Connect directly - validation only checks txs against the UTXO set as of the parent
+	chain.lock.Lock()
+	require.Nil(t, chain.addBlock(block, chain.tree.Insert(block.Header, chain.tip)))
+	chain.lock.Unlock()
+
+	require.NotEqual(t, before, snapshotUTXOs(chain.utxoStore.(*MemoryUTXOStore)))
+
+	disconnected, err := chain.DisconnectTip()
+	require.Nil(t, err)
+	require.Equal(t, types.HashBlock(block), types.HashBlock(disconnected))
+	require.Equal(t, 1, chain.Height())
+	require.Equal(t, before, snapshotUTXOs(chain.utxoStore.(*MemoryUTXOStore)))
+
+	// Back down to genesis, which stays put
+	_, err = chain.DisconnectTip()
+	require.Nil(t, err)
+	_, err = chain.DisconnectTip()
+	require.NotNil(t, err)
+	require.Equal(t, 0, chain.Height())
+}
+
+func TestGetTxProof(t *testing.T) {
+
+	var (
+		privKey = crypto.NewPrivateKeyFromString(originSeed)
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	)
+
+	tx := genesisSpendTX(t, chain, 100)
+
+	block := NextBlock(t, chain, privKey)
+	block.Transactions = append(block.Transactions, tx)
+	types.SignBlock(privKey, block)
+	require.Nil(t, chain.AddBlock(block))
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, chain.AddBlock(NextBlock(t, chain, privKey)))
+	}
+
+	txHash := types.HashTransaction(tx)
+
+	for _, blockHash := range [][]byte{nil, types.HashBlock(block)} {
+
+		res, err := chain.GetTxProof(txHash, blockHash)
+		require.Nil(t, err)
+
+		require.Equal(t, txHash, types.HashTransaction(res.Transaction))
+		require.True(t, types.VerifyHeader(res.Header.Header, res.Header.PublicKey, res.Header.Signature))
+		require.True(t, types.VerifyMerkleProof(res.Header.Header.RootHash, txHash, res.Proof))
+	}
+
+	_, err := chain.GetTxProof(util.RandomHash(), nil)
+	require.True(t, errors.Is(err, ErrTxNotFound))
+
+	_, err = chain.GetTxProof(txHash, util.RandomHash())
+	require.True(t, errors.Is(err, ErrTxNotFound))
+}
@@ -0,0 +1,81 @@
+package node
+
+import (
+	"bytes"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+)
+
+// ----------------------------------------------------------------------------------
+// Coinbase
+//
+// New coins come into circulation through the first transaction of each block, which
+// pays the proposer the block subsidy plus whatever the block's transactions leave over
+// as fees. The subsidy halves on a fixed schedule, and what a coinbase pays out can't be
+// spent until enough blocks have gone by that a reorg is unlikely to take it back. Every
+// block but the genesis has one, even if it claims nothing.
+
+const (
+	DefaultSubsidy          = 50
+	DefaultHalvingInterval  = 10_000
+	DefaultCoinbaseMaturity = 10
+)
+
+// Subsidy is what the coinbase at [height] may mint, on top of the fees
+func (g *Genesis) Subsidy(height int) uint64 {
+
+	if g.HalvingInterval <= 0 {
+		return g.InitialSubsidy
+	}
+
+	halvings := height / g.HalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+
+	return g.InitialSubsidy >> halvings
+}
+
+// NewCoinbase pays [amount] to [address] for the block at [height]
+func NewCoinbase(height int, address []byte, amount uint64) *proto.Transaction {
+	return &proto.Transaction{
+		Version: 1,
+		Kind:    proto.TxKind_COINBASE,
+		Height:  int32(height),
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  amount,
+				Address: address,
+			},
+		},
+	}
+}
+
+// checkCoinbase checks [tx] is put together the way the coinbase for [b], at [height],
+// should be - what it claims is checked once the block's fees are known
+func checkCoinbase(b *proto.Block, tx *proto.Transaction, height int) error {
+
+	if len(tx.Inputs) > 0 {
+		return validationErrorf(CodeBadCoinbase, "coinbase spends inputs")
+	}
+
+	if len(tx.Validator) > 0 {
+		return validationErrorf(CodeBadCoinbase, "coinbase names a validator")
+	}
+
+	if int(tx.Height) != height {
+		return validationErrorf(CodeBadCoinbase, "coinbase is for height (%d), not (%d)", tx.Height, height)
+	}
+
+	if len(tx.Outputs) != 1 {
+		return validationErrorf(CodeBadCoinbase, "coinbase has (%d) outputs - it pays the proposer in one", len(tx.Outputs))
+	}
+
+	proposer, err := crypto.PubKeyFromBytes(b.PublicKey)
+	if err != nil || !bytes.Equal(tx.Outputs[0].Address, proposer.Address().Bytes()) {
+		return validationErrorf(CodeBadCoinbase, "coinbase does not pay the block's proposer")
+	}
+
+	return nil
+}
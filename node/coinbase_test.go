@@ -0,0 +1,162 @@
+package node
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubsidyHalves(t *testing.T) {
+
+	genesis := &Genesis{InitialSubsidy: 50, HalvingInterval: 10}
+
+	require.Equal(t, uint64(50), genesis.Subsidy(1))
+	require.Equal(t, uint64(50), genesis.Subsidy(9))
+	require.Equal(t, uint64(25), genesis.Subsidy(10))
+	require.Equal(t, uint64(12), genesis.Subsidy(25))
+	require.Equal(t, uint64(0), genesis.Subsidy(640))
+
+	// No interval, no halving
+	genesis.HalvingInterval = 0
+	require.Equal(t, uint64(50), genesis.Subsidy(1_000_000))
+}
+
+func TestCoinbaseClaimsSubsidyAndFees(t *testing.T) {
+
+	var (
+		blockStore = NewMemoryBlockStore()
+		txStore    = NewMemoryTXStore()
+		utxoStore  = NewMemoryUTXOStore()
+		chain      = NewChain(blockStore, txStore, utxoStore)
+		origin     = crypto.NewPrivateKeyFromString(originSeed)
+		proposer   = crypto.GeneratePrivateKey()
+		address    = proposer.PubKey().Address().Bytes()
+	)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	// Leaves a fee of 23
+	tx := spendTX(origin, genesis.Transactions[0], []uint32{0}, 100)
+
+	fee, err := chain.TransactionFee(tx)
+	require.Nil(t, err)
+	require.Equal(t, uint64(23), fee)
+
+	due := DefaultSubsidy + fee
+
+	cases := map[string][]*proto.Transaction{
+		"claims too much":   {NewCoinbase(1, address, due+1), tx},
+		"wrong height":      {NewCoinbase(2, address, due), tx},
+		"pays someone else": {NewCoinbase(1, origin.PubKey().Address().Bytes(), due), tx},
+		"not first":         {tx, NewCoinbase(1, address, due)},
+		"two coinbases":     {NewCoinbase(1, address, due), NewCoinbase(1, address, 0)},
+	}
+
+	split := NewCoinbase(1, address, due)
+	split.Outputs = append(split.Outputs, &proto.TxOutput{Amount: 0, Address: address})
+	cases["two outputs"] = []*proto.Transaction{split, tx}
+
+	spending := NewCoinbase(1, address, due)
+	spending.Inputs = tx.Inputs
+	cases["spends inputs"] = []*proto.Transaction{spending}
+
+	for name, txx := range cases {
+		require.Equal(t, CodeBadCoinbase, CodeOf(chain.AddBlock(BlockOn(t, genesis, proposer, txx...))), name)
+	}
+
+	// A coinbase only comes in a block, and nothing else mints coins
+	require.Equal(t, CodeBadCoinbase, CodeOf(chain.ValidateTransaction(NewCoinbase(1, address, due))))
+
+	minting := &proto.Transaction{Version: 1, Outputs: []*proto.TxOutput{{Amount: 1, Address: address}}}
+	require.Equal(t, CodeMalformed, CodeOf(chain.ValidateTransaction(minting)))
+
+	coinbase := NewCoinbase(1, address, due)
+
+	block := BlockOn(t, genesis, proposer, coinbase, tx)
+	require.Nil(t, chain.AddBlock(block))
+
+	utxo, err := utxoStore.Get(fmt.Sprintf("%s_%d", hex.EncodeToString(types.HashTransaction(coinbase)), 0))
+	require.Nil(t, err)
+	require.Equal(t, due, utxo.Amount)
+	require.Equal(t, 1, utxo.MintedAt)
+
+	// Minted at height 1, so locked until height 11
+	payout := spendTX(proposer, coinbase, []uint32{0}, due)
+
+	for chain.Height() < DefaultCoinbaseMaturity {
+		requireTxError(t, chain.ValidateTransaction(payout), ErrLockedInput, 0)
+		require.Nil(t, chain.AddBlock(NextBlock(t, chain, proposer)))
+	}
+
+	require.Nil(t, chain.ValidateTransaction(payout))
+	require.Nil(t, chain.AddBlock(NextBlock(t, chain, proposer)))
+
+	report, err := VerifyDBWithGenesis(DefaultGenesis(), blockStore, txStore, utxoStore, false)
+	require.Nil(t, err)
+	require.True(t, report.OK(), report.String())
+}
+
+func TestBlockNeedsCoinbase(t *testing.T) {
+
+	var (
+		chain    = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+		proposer = crypto.GeneratePrivateKey()
+	)
+
+	empty := NextBlock(t, chain, proposer)
+	empty.Transactions = nil
+	types.SignBlock(proposer, empty)
+
+	// Transactions alone don't make up for it either
+	spending := NextBlock(t, chain, proposer)
+	spending.Transactions = []*proto.Transaction{genesisSpendTX(t, chain, 100)}
+	types.SignBlock(proposer, spending)
+
+	for _, block := range []*proto.Block{empty, spending} {
+		err := chain.AddBlock(block)
+		require.Equal(t, CodeBadCoinbase, CodeOf(err))
+		require.Contains(t, err.Error(), "no coinbase")
+	}
+
+	require.Equal(t, 0, chain.Height())
+
+	// Even one claiming nothing will do
+	require.Nil(t, chain.AddBlock(NextBlock(t, chain, proposer)))
+}
+
+func TestCreateBlockPaysProposer(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		origin  = crypto.NewPrivateKeyFromString(originSeed)
+		n       = NewNode(ServerConfig{ListenAddr: freeAddr(t), PrivateKey: privKey})
+	)
+
+	genesis, err := n.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	var (
+		tx      = spendTX(origin, genesis.Transactions[0], []uint32{0}, 100)
+		invalid = spendTX(origin, genesis.Transactions[0], []uint32{0}, 200)
+	)
+
+	header, _ := n.prepareHeader(time.Now())
+
+	block, err := n.createBlock(header, []*proto.Transaction{invalid, tx})
+	require.Nil(t, err)
+
+	// The invalid tx is dropped - the coinbase takes the subsidy and the other's fee
+	require.Len(t, block.Transactions, 2)
+	require.Equal(t, proto.TxKind_COINBASE, block.Transactions[0].Kind)
+	require.Equal(t, uint64(DefaultSubsidy+23), block.Transactions[0].Outputs[0].Amount)
+	require.Equal(t, privKey.PubKey().Address().Bytes(), block.Transactions[0].Outputs[0].Address)
+
+	require.Nil(t, n.chain.AddBlock(block))
+}
@@ -0,0 +1,1222 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+
+	pb "google.golang.org/protobuf/proto"
+)
+
+// ------------------------------------------------------------------------
+// File-backed storage
+//
+// Every store sits on a keyed log: an append-only data file of checksummed records plus
+// an index file mapping each key to the offset of its latest record. Overwrites and
+// deletes (tombstones) append too, so nothing is ever rewritten in place - a crash can
+// only ever leave a torn record at the tail, which is cut off on the next open. The index
+// is a cache of the data file: whatever it misses is recovered by scanning the tail.
+//
+// Record layout (little endian):
+//
+//	crc32 (4) | keyLen (2) | valLen (4) | key | value
+//
+// The checksum covers everything after itself. A valLen of 0xFFFFFFFF marks a tombstone.
+
+const (
+	recordHeaderLen = 10
+	tombstoneLen    = math.MaxUint32
+
+	// an index entry's value - offset (8) | size (8) | tombstone (1)
+	indexEntryLen = 17
+
+	// compact a log once it's at least this big and mostly dead records
+	compactMinSize = 4 << 20
+
+	defaultSyncInterval = time.Second
+)
+
+var errTornRecord = errors.New("torn or corrupt record")
+
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every write - nothing acknowledged is ever lost
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background every [DiskStoreConfig.SyncInterval]
+	SyncInterval
+	// SyncNever leaves flushing to the OS, apart from on Close
+	SyncNever
+)
+
+type DiskStoreConfig struct {
+	Dir          string
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+// ------------------------------------------------------------------------
+type logEntry struct {
+	offset int64
+	size   int64
+}
+
+type keyedLog struct {
+	lock sync.RWMutex
+
+	path  string
+	data  *os.File
+	idx   *os.File
+	index map[string]logEntry
+
+	size    int64 // end of the data file
+	idxSize int64 // end of the index file
+	live    int64 // bytes taken up by the latest record of each key
+	policy  SyncPolicy
+	dirty   bool
+
+	// records the last load had to find in the data file, for want of index entries
+	rescanned int
+}
+
+func encodeRecord(key string, value []byte, deleted bool) []byte {
+
+	valLen := uint32(len(value))
+	if deleted {
+		valLen = tombstoneLen
+		value = nil
+	}
+
+	buf := make([]byte, recordHeaderLen+len(key)+len(value))
+
+	binary.LittleEndian.PutUint16(buf[4:6], uint16(len(key)))
+	binary.LittleEndian.PutUint32(buf[6:10], valLen)
+	copy(buf[recordHeaderLen:], key)
+	copy(buf[recordHeaderLen+len(key):], value)
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+
+	return buf
+}
+
+// decodeRecord reads the next record, which can't run past [limit] bytes - io.EOF
+// only on a clean end of file
+func decodeRecord(r io.Reader, limit int64) (key string, value []byte, deleted bool, n int64, err error) {
+
+	header := make([]byte, recordHeaderLen)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return "", nil, false, 0, io.EOF
+		}
+		return "", nil, false, 0, errTornRecord
+	}
+
+	keyLen := int(binary.LittleEndian.Uint16(header[4:6]))
+	valLen := binary.LittleEndian.Uint32(header[6:10])
+
+	deleted = valLen == tombstoneLen
+	if deleted {
+		valLen = 0
+	}
+
+	if int64(recordHeaderLen+keyLen)+int64(valLen) > limit {
+		return "", nil, false, 0, errTornRecord
+	}
+
+	body := make([]byte, keyLen+int(valLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", nil, false, 0, errTornRecord
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+
+	if crc.Sum32() != binary.LittleEndian.Uint32(header[0:4]) {
+		return "", nil, false, 0, errTornRecord
+	}
+
+	n = int64(recordHeaderLen + len(body))
+
+	return string(body[:keyLen]), body[keyLen:], deleted, n, nil
+}
+
+// encodeIndexEntry points [key] at its record - the offset, the size, and whether it's
+// a tombstone. The entry itself is never one, so it always keeps its place in the data.
+func encodeIndexEntry(key string, e logEntry, deleted bool) []byte {
+
+	val := make([]byte, indexEntryLen)
+	binary.LittleEndian.PutUint64(val[0:8], uint64(e.offset))
+	binary.LittleEndian.PutUint64(val[8:16], uint64(e.size))
+	if deleted {
+		val[16] = 1
+	}
+
+	return encodeRecord(key, val, false)
+}
+
+// decodeIndexEntry undoes encodeIndexEntry - false if [val] isn't an entry
+func decodeIndexEntry(val []byte) (logEntry, bool, bool) {
+
+	// Entries written before tombstones kept their place have no flag - a live record
+	if len(val) != indexEntryLen && len(val) != indexEntryLen-1 {
+		return logEntry{}, false, false
+	}
+
+	e := logEntry{
+		offset: int64(binary.LittleEndian.Uint64(val[0:8])),
+		size:   int64(binary.LittleEndian.Uint64(val[8:16])),
+	}
+
+	return e, len(val) == indexEntryLen && val[16] == 1, true
+}
+
+func openKeyedLog(path string, policy SyncPolicy) (*keyedLog, error) {
+
+	data, err := os.OpenFile(path+".dat", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := os.OpenFile(path+".idx", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	l := &keyedLog{
+		path:   path,
+		data:   data,
+		idx:    idx,
+		index:  make(map[string]logEntry),
+		policy: policy,
+	}
+
+	if err := l.load(); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to load [%s]: %v", path, err)
+	}
+
+	return l, nil
+}
+
+// load rebuilds the in-memory index - from the index file as far as it goes, then by
+// scanning whatever the data file has past that. Torn tails are truncated off both
+func (l *keyedLog) load() error {
+
+	dataStat, err := l.data.Stat()
+	if err != nil {
+		return err
+	}
+
+	idxStat, err := l.idx.Stat()
+	if err != nil {
+		return err
+	}
+
+	dataSize := dataStat.Size()
+
+	var (
+		idxPos  int64
+		scanPos int64
+		reader  = bufio.NewReader(io.NewSectionReader(l.idx, 0, idxStat.Size()))
+	)
+
+	for {
+		key, val, tombstone, n, err := decodeRecord(reader, idxStat.Size()-idxPos)
+		if err != nil || tombstone {
+			break
+		}
+
+		e, deleted, ok := decodeIndexEntry(val)
+		if !ok {
+			break
+		}
+
+		// The index got ahead of the data file - rescan from here instead
+		if e.offset+e.size > dataSize {
+			break
+		}
+
+		l.apply(key, e, deleted)
+
+		idxPos += n
+		scanPos = e.offset + e.size
+	}
+
+	if err := l.idx.Truncate(idxPos); err != nil {
+		return err
+	}
+
+	reader = bufio.NewReader(io.NewSectionReader(l.data, scanPos, dataSize-scanPos))
+	l.size = scanPos
+
+	for {
+		key, _, deleted, n, err := decodeRecord(reader, dataSize-l.size)
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Printf("\n*** >>> truncating torn tail of [%s.dat] at offset (%d)", l.path, l.size)
+			break
+		}
+
+		e := logEntry{offset: l.size, size: n}
+		entry := encodeIndexEntry(key, e, deleted)
+
+		if _, err := l.idx.WriteAt(entry, idxPos); err != nil {
+			return err
+		}
+
+		l.apply(key, e, deleted)
+
+		idxPos += int64(len(entry))
+		l.size += n
+		l.rescanned++
+	}
+
+	l.idxSize = idxPos
+
+	return l.data.Truncate(l.size)
+}
+
+func (l *keyedLog) apply(key string, e logEntry, deleted bool) {
+
+	if prev, ok := l.index[key]; ok {
+		l.live -= prev.size
+		delete(l.index, key)
+	}
+
+	if !deleted {
+		l.index[key] = e
+		l.live += e.size
+	}
+}
+
+func (l *keyedLog) write(key string, value []byte, deleted bool) error {
+
+	if err := l.appendRecord(key, value, deleted); err != nil {
+		return err
+	}
+
+	return l.flush()
+}
+
+// writeMany appends every record before syncing once
+func (l *keyedLog) writeMany(ops []walOp) error {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, op := range ops {
+		if err := l.appendRecord(op.key, op.value, op.deleted); err != nil {
+			return err
+		}
+	}
+
+	return l.flush()
+}
+
+func (l *keyedLog) appendRecord(key string, value []byte, deleted bool) error {
+
+	rec := encodeRecord(key, value, deleted)
+	e := logEntry{offset: l.size, size: int64(len(rec))}
+
+	if _, err := l.data.WriteAt(rec, e.offset); err != nil {
+		return err
+	}
+
+	entry := encodeIndexEntry(key, e, deleted)
+
+	if _, err := l.idx.WriteAt(entry, l.idxSize); err != nil {
+		return err
+	}
+
+	l.size += e.size
+	l.idxSize += int64(len(entry))
+	l.apply(key, e, deleted)
+
+	return nil
+}
+
+// flush syncs according to the policy and compacts if the log is due
+func (l *keyedLog) flush() error {
+
+	if l.policy == SyncAlways {
+		if err := l.data.Sync(); err != nil {
+			return err
+		}
+	} else {
+		l.dirty = true
+	}
+
+	if l.size >= compactMinSize && l.live < l.size/2 {
+		return l.compact()
+	}
+
+	return nil
+}
+
+func (l *keyedLog) Put(key string, value []byte) error {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.write(key, value, false)
+}
+
+func (l *keyedLog) Delete(key string) error {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.index[key]; !ok {
+		return nil
+	}
+
+	return l.write(key, nil, true)
+}
+
+func (l *keyedLog) Get(key string) ([]byte, bool, error) {
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	e, ok := l.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	value, err := l.read(key, e)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return value, true, nil
+}
+
+func (l *keyedLog) read(key string, e logEntry) ([]byte, error) {
+
+	buf := make([]byte, e.size)
+
+	if _, err := l.data.ReadAt(buf, e.offset); err != nil {
+		return nil, err
+	}
+
+	recKey, value, _, _, err := decodeRecord(bytes.NewReader(buf), e.size)
+	if err != nil {
+		return nil, fmt.Errorf("[%s.dat] offset (%d): %v", l.path, e.offset, err)
+	}
+	if recKey != key {
+		return nil, fmt.Errorf("[%s.dat] offset (%d): expected key [%s] - found [%s]", l.path, e.offset, key, recKey)
+	}
+
+	return value, nil
+}
+
+func (l *keyedLog) Len() int {
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	return len(l.index)
+}
+
+// ForEach visits every live key in the order it was last written
+func (l *keyedLog) ForEach(fn func(key string, value []byte) error) error {
+
+	l.lock.RLock()
+
+	keys := make([]string, 0, len(l.index))
+	for key := range l.index {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return l.index[keys[i]].offset < l.index[keys[j]].offset
+	})
+
+	l.lock.RUnlock()
+
+	for _, key := range keys {
+
+		value, ok, err := l.Get(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compact rewrites the log with only the live records, and an index to go with them. The
+// old index is removed before the new data file is swapped in, so a crash part way
+// through only costs a rescan. The log keeps its old files until the new ones are in
+// place, so a failure along the way leaves it as it was.
+func (l *keyedLog) compact() error {
+
+	var (
+		dataPath = l.path + ".dat.compact"
+		idxPath  = l.path + ".idx.compact"
+	)
+
+	data, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	idx, err := os.OpenFile(idxPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		data.Close()
+		os.Remove(dataPath)
+		return err
+	}
+
+	fail := func(err error) error {
+		data.Close()
+		idx.Close()
+		os.Remove(dataPath)
+		os.Remove(idxPath)
+		return err
+	}
+
+	keys := make([]string, 0, len(l.index))
+	for key := range l.index {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return l.index[keys[i]].offset < l.index[keys[j]].offset
+	})
+
+	var (
+		dataW   = bufio.NewWriter(data)
+		idxW    = bufio.NewWriter(idx)
+		index   = make(map[string]logEntry, len(keys))
+		size    int64
+		idxSize int64
+	)
+
+	for _, key := range keys {
+
+		value, err := l.read(key, l.index[key])
+		if err != nil {
+			return fail(err)
+		}
+
+		rec := encodeRecord(key, value, false)
+		e := logEntry{offset: size, size: int64(len(rec))}
+		entry := encodeIndexEntry(key, e, false)
+
+		if _, err := dataW.Write(rec); err != nil {
+			return fail(err)
+		}
+		if _, err := idxW.Write(entry); err != nil {
+			return fail(err)
+		}
+
+		index[key] = e
+		size += e.size
+		idxSize += int64(len(entry))
+	}
+
+	for _, f := range []struct {
+		w *bufio.Writer
+		f *os.File
+	}{{dataW, data}, {idxW, idx}} {
+		if err := f.w.Flush(); err != nil {
+			return fail(err)
+		}
+		if err := f.f.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := os.Remove(l.path + ".idx"); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(dataPath, l.path+".dat"); err != nil {
+		return fail(err)
+	}
+
+	// The new data file is in place - from here on the log has to use it. Without its
+	// index on disk the next open rescans, which is all losing the rename costs
+	idxErr := os.Rename(idxPath, l.path+".idx")
+
+	l.data.Close()
+	l.idx.Close()
+
+	l.data = data
+	l.idx = idx
+	l.index = index
+	l.size = size
+	l.idxSize = idxSize
+	l.live = size
+
+	return idxErr
+}
+
+func (l *keyedLog) Sync() error {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.dirty {
+		return nil
+	}
+
+	if err := l.data.Sync(); err != nil {
+		return err
+	}
+	if err := l.idx.Sync(); err != nil {
+		return err
+	}
+
+	l.dirty = false
+
+	return nil
+}
+
+func (l *keyedLog) Close() error {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	err := l.data.Sync()
+
+	if cerr := l.data.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := l.idx.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// ------------------------------------------------------------------------
+// DiskStore ties the logs for each store together under one data directory
+type DiskStore struct {
+	cfg DiskStoreConfig
+
+	batchLock sync.Mutex
+
+	blocks *keyedLog
+	undo   *keyedLog
+	txs    *keyedLog
+	utxos  *keyedLog
+
+	tipLock sync.RWMutex
+	tip     string
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func OpenDiskStore(cfg DiskStoreConfig) (*DiskStore, error) {
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = defaultSyncInterval
+	}
+
+	db := &DiskStore{
+		cfg:  cfg,
+		quit: make(chan struct{}),
+	}
+
+	var err error
+
+	open := func(name string) *keyedLog {
+		if err != nil {
+			return nil
+		}
+		var l *keyedLog
+		l, err = openKeyedLog(filepath.Join(cfg.Dir, name), cfg.Sync)
+		return l
+	}
+
+	db.blocks = open("blocks")
+	db.undo = open("undo")
+	db.txs = open("txs")
+	db.utxos = open("utxos")
+
+	if err != nil {
+		db.closeLogs()
+		return nil, err
+	}
+
+	tip, err := os.ReadFile(filepath.Join(cfg.Dir, "TIP"))
+	if err != nil && !os.IsNotExist(err) {
+		db.closeLogs()
+		return nil, err
+	}
+
+	db.tip = string(tip)
+
+	if err := db.replayWAL(); err != nil {
+		db.closeLogs()
+		return nil, fmt.Errorf("failed to replay write-ahead log: %v", err)
+	}
+
+	if cfg.Sync == SyncInterval {
+		db.wg.Add(1)
+		go db.syncLoop()
+	}
+
+	return db, nil
+}
+
+func (db *DiskStore) logs() []*keyedLog {
+	return []*keyedLog{db.blocks, db.undo, db.txs, db.utxos}
+}
+
+func (db *DiskStore) syncLoop() {
+
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.cfg.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.quit:
+			return
+		case <-ticker.C:
+			if err := db.Sync(); err != nil {
+				fmt.Printf("\n*** >>> [%s] background sync failed - %v", db.cfg.Dir, err)
+			}
+		}
+	}
+}
+
+func (db *DiskStore) Sync() error {
+
+	for _, l := range db.logs() {
+		if err := l.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *DiskStore) closeLogs() error {
+
+	var err error
+
+	for _, l := range db.logs() {
+		if l == nil {
+			continue
+		}
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+func (db *DiskStore) Close() error {
+
+	close(db.quit)
+	db.wg.Wait()
+
+	return db.closeLogs()
+}
+
+func (db *DiskStore) Blocks() *DiskBlockStore {
+	return &DiskBlockStore{db: db}
+}
+
+func (db *DiskStore) TXs() *DiskTXStore {
+	return &DiskTXStore{db: db}
+}
+
+func (db *DiskStore) UTXOs() *DiskUTXOStore {
+	return &DiskUTXOStore{db: db}
+}
+
+// ------------------------------------------------------------------------
+// Atomic batches
+//
+// A batch is journaled to the write-ahead log in full, terminated by a commit record,
+// before any of it is applied to the logs. Applying is idempotent, so if the process
+// dies part way through, the next open just replays the journal. A journal without its
+// commit record never happened.
+
+const walCommitKey = "commit"
+
+type walOp struct {
+	log     string
+	key     string
+	value   []byte
+	deleted bool
+}
+
+func (db *DiskStore) walPath() string {
+	return filepath.Join(db.cfg.Dir, "batch.wal")
+}
+
+func (db *DiskStore) logByName(name string) *keyedLog {
+	switch name {
+	case "blocks":
+		return db.blocks
+	case "undo":
+		return db.undo
+	case "txs":
+		return db.txs
+	case "utxos":
+		return db.utxos
+	}
+	return nil
+}
+
+func batchOps(b *Batch) ([]walOp, error) {
+
+	ops := []walOp{}
+
+	for _, tx := range b.txs {
+
+		data, err := pb.Marshal(tx)
+		if err != nil {
+			return nil, err
+		}
+
+		ops = append(ops, walOp{log: "txs", key: hex.EncodeToString(types.HashTransaction(tx)), value: data})
+	}
+
+	for _, block := range b.blocks {
+
+		data, err := pb.Marshal(block)
+		if err != nil {
+			return nil, err
+		}
+
+		ops = append(ops, walOp{log: "blocks", key: hex.EncodeToString(types.HashBlock(block)), value: data})
+	}
+
+	for hash, undo := range b.undo {
+
+		data, err := json.Marshal(undo)
+		if err != nil {
+			return nil, err
+		}
+
+		ops = append(ops, walOp{log: "undo", key: hash, value: data})
+	}
+
+	for _, key := range b.utxoKeys {
+
+		utxo := b.utxoState[key]
+
+		if utxo == nil {
+			ops = append(ops, walOp{log: "utxos", key: key, deleted: true})
+			continue
+		}
+
+		data, err := json.Marshal(utxo)
+		if err != nil {
+			return nil, err
+		}
+
+		ops = append(ops, walOp{log: "utxos", key: key, value: data})
+	}
+
+	if b.tip != "" {
+		ops = append(ops, walOp{log: "tip", value: []byte(b.tip)})
+	}
+
+	return ops, nil
+}
+
+func (db *DiskStore) WriteBatch(b *Batch) error {
+
+	db.batchLock.Lock()
+	defer db.batchLock.Unlock()
+
+	ops, err := batchOps(b)
+	if err != nil {
+		return err
+	}
+
+	journal := []byte{}
+	for _, op := range ops {
+		journal = append(journal, encodeRecord(op.log+"/"+op.key, op.value, op.deleted)...)
+	}
+	journal = append(journal, encodeRecord(walCommitKey, nil, false)...)
+
+	if err := writeFileAtomic(db.walPath(), journal, db.durable()); err != nil {
+		return err
+	}
+
+	if err := db.applyOps(ops); err != nil {
+		return err
+	}
+
+	return os.Remove(db.walPath())
+}
+
+// durable reports whether a batch has to be on disk before its journal goes - anything
+// but [SyncNever]
+func (db *DiskStore) durable() bool {
+	return db.cfg.Sync != SyncNever
+}
+
+// applyOps writes [ops] to their logs and the TIP file - synced before returning unless
+// the policy never syncs, since the journal is removed straight after
+func (db *DiskStore) applyOps(ops []walOp) error {
+
+	perLog := make(map[string][]walOp)
+	names := []string{}
+
+	for _, op := range ops {
+
+		if op.log == "tip" {
+			continue
+		}
+
+		if _, ok := perLog[op.log]; !ok {
+			names = append(names, op.log)
+		}
+
+		perLog[op.log] = append(perLog[op.log], op)
+	}
+
+	for _, name := range names {
+
+		l := db.logByName(name)
+		if l == nil {
+			return fmt.Errorf("unknown log [%s]", name)
+		}
+
+		if err := l.writeMany(perLog[name]); err != nil {
+			return err
+		}
+
+		if db.durable() {
+			if err := l.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, op := range ops {
+		if op.log == "tip" {
+			return db.setTip(string(op.value), db.durable())
+		}
+	}
+
+	return nil
+}
+
+func (db *DiskStore) replayWAL() error {
+
+	journal, err := os.ReadFile(db.walPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var (
+		ops       = []walOp{}
+		reader    = bytes.NewReader(journal)
+		committed = false
+	)
+
+	for {
+		key, value, deleted, _, err := decodeRecord(reader, int64(reader.Len()))
+		if err != nil {
+			break
+		}
+
+		if key == walCommitKey {
+			committed = true
+			break
+		}
+
+		name, opKey, ok := strings.Cut(key, "/")
+		if !ok {
+			return fmt.Errorf("malformed journal entry [%s]", key)
+		}
+
+		ops = append(ops, walOp{log: name, key: opKey, value: value, deleted: deleted})
+	}
+
+	if committed {
+		fmt.Printf("\n*** >>> [%s] replaying (%d) journaled writes", db.cfg.Dir, len(ops))
+
+		if err := db.applyOps(ops); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(db.walPath())
+}
+
+// writeFileAtomic swaps in the new contents with a rename so readers never see half a file
+func writeFileAtomic(path string, data []byte, fsync bool) error {
+
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	if !fsync {
+		return nil
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// ------------------------------------------------------------------------
+type DiskBlockStore struct {
+	db *DiskStore
+}
+
+func (s *DiskBlockStore) batchWriter() BatchWriter {
+	return s.db
+}
+
+func (s *DiskBlockStore) PutBlock(b *proto.Block) error {
+
+	data, err := pb.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	return s.db.blocks.Put(hex.EncodeToString(types.HashBlock(b)), data)
+}
+
+func (s *DiskBlockStore) GetBlock(hash string) (*proto.Block, error) {
+
+	data, ok, err := s.db.blocks.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("failed to get block [%s]", hash)
+	}
+
+	block := &proto.Block{}
+	if err := pb.Unmarshal(data, block); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+func (s *DiskBlockStore) PutUndo(hash string, undo *BlockUndo) error {
+
+	data, err := json.Marshal(undo)
+	if err != nil {
+		return err
+	}
+
+	return s.db.undo.Put(hash, data)
+}
+
+func (s *DiskBlockStore) GetUndo(hash string) (*BlockUndo, error) {
+
+	data, ok, err := s.db.undo.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("failed to get undo record for block [%s]", hash)
+	}
+
+	undo := &BlockUndo{}
+	if err := json.Unmarshal(data, undo); err != nil {
+		return nil, err
+	}
+
+	return undo, nil
+}
+
+func (s *DiskBlockStore) SetTip(hash string) error {
+	return s.db.setTip(hash, s.db.cfg.Sync == SyncAlways)
+}
+
+func (db *DiskStore) setTip(hash string, fsync bool) error {
+
+	db.tipLock.Lock()
+	defer db.tipLock.Unlock()
+
+	if err := writeFileAtomic(filepath.Join(db.cfg.Dir, "TIP"), []byte(hash), fsync); err != nil {
+		return err
+	}
+
+	db.tip = hash
+
+	return nil
+}
+
+func (s *DiskBlockStore) GetTip() (string, error) {
+
+	s.db.tipLock.RLock()
+	defer s.db.tipLock.RUnlock()
+
+	return s.db.tip, nil
+}
+
+func (s *DiskBlockStore) ForEachBlock(fn func(*proto.Block) error) error {
+
+	return s.db.blocks.ForEach(func(key string, value []byte) error {
+
+		block := &proto.Block{}
+		if err := pb.Unmarshal(value, block); err != nil {
+			return fmt.Errorf("block [%s]: %v", key, err)
+		}
+
+		return fn(block)
+	})
+}
+
+// ------------------------------------------------------------------------
+type DiskTXStore struct {
+	db *DiskStore
+}
+
+func (s *DiskTXStore) batchWriter() BatchWriter {
+	return s.db
+}
+
+func (s *DiskTXStore) Put(tx *proto.Transaction) error {
+
+	data, err := pb.Marshal(tx)
+	if err != nil {
+		return err
+	}
+
+	return s.db.txs.Put(hex.EncodeToString(types.HashTransaction(tx)), data)
+}
+
+func (s *DiskTXStore) Get(hash string) (*proto.Transaction, error) {
+
+	data, ok, err := s.db.txs.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("failed to get TX by hash: %s", hash)
+	}
+
+	tx := &proto.Transaction{}
+	if err := pb.Unmarshal(data, tx); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// ------------------------------------------------------------------------
+type DiskUTXOStore struct {
+	db *DiskStore
+}
+
+func (s *DiskUTXOStore) batchWriter() BatchWriter {
+	return s.db
+}
+
+func (s *DiskUTXOStore) Put(utxo *UTXO) error {
+
+	data, err := json.Marshal(utxo)
+	if err != nil {
+		return err
+	}
+
+	return s.db.utxos.Put(utxo.Key(), data)
+}
+
+func (s *DiskUTXOStore) Get(hash string) (*UTXO, error) {
+
+	data, ok, err := s.db.utxos.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("failed to fetch UTXO with hash - %s", hash)
+	}
+
+	utxo := &UTXO{}
+	if err := json.Unmarshal(data, utxo); err != nil {
+		return nil, err
+	}
+
+	return utxo, nil
+}
+
+func (s *DiskUTXOStore) Delete(hash string) error {
+	return s.db.utxos.Delete(hash)
+}
+
+func (s *DiskUTXOStore) ForEach(fn func(*UTXO) error) error {
+
+	return s.db.utxos.ForEach(func(key string, value []byte) error {
+
+		utxo := &UTXO{}
+		if err := json.Unmarshal(value, utxo); err != nil {
+			return fmt.Errorf("utxo [%s]: %v", key, err)
+		}
+
+		return fn(utxo)
+	})
+}
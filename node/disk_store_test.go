@@ -0,0 +1,260 @@
+package node
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestDiskStore(t *testing.T, dir string) *DiskStore {
+
+	db, err := OpenDiskStore(DiskStoreConfig{Dir: dir, Sync: SyncNever})
+	require.Nil(t, err)
+
+	return db
+}
+
+func TestDiskStoreReopenChain(t *testing.T) {
+
+	var (
+		dir     = t.TempDir()
+		privKey = crypto.GeneratePrivateKey()
+		db      = openTestDiskStore(t, dir)
+		chain   = NewChain(db.Blocks(), db.TXs(), db.UTXOs())
+	)
+
+	for i := 0; i < 20; i++ {
+		require.Nil(t, chain.AddBlock(NextBlock(t, chain, privKey)))
+	}
+
+	tx := genesisSpendTX(t, chain, 100)
+	block := NextBlock(t, chain, privKey)
+	block.Transactions = append(block.Transactions, tx)
+	types.SignBlock(privKey, block)
+	require.Nil(t, chain.AddBlock(block))
+
+	// A side branch that should survive the restart too
+	parent, err := chain.GetBlockByHeight(19)
+	require.Nil(t, err)
+	side := BlockOn(t, parent, privKey)
+	require.Nil(t, chain.AddBlock(side))
+
+	hashes := [][]byte{}
+	for i := 0; i <= chain.Height(); i++ {
+		b, err := chain.GetBlockByHeight(i)
+		require.Nil(t, err)
+		hashes = append(hashes, types.HashBlock(b))
+	}
+	nBlocks := chain.tree.Len()
+
+	require.Nil(t, db.Close())
+
+	db = openTestDiskStore(t, dir)
+	defer db.Close()
+
+	reopened, err := OpenChain(db.Blocks(), db.TXs(), db.UTXOs())
+	require.Nil(t, err)
+	require.Equal(t, len(hashes)-1, reopened.Height())
+	require.Equal(t, nBlocks, reopened.tree.Len())
+
+	for i, want := range hashes {
+		have, err := reopened.GetBlockByHeight(i)
+		require.Nil(t, err)
+		require.Equal(t, want, types.HashBlock(have))
+	}
+
+	utxo, err := reopened.utxoStore.Get(fmt.Sprintf("%x_0", types.HashTransaction(tx)))
+	require.Nil(t, err)
+	require.Equal(t, uint64(100), utxo.Amount)
+	require.False(t, utxo.Spent)
+
+	fetchedTx, err := reopened.txStore.Get(fmt.Sprintf("%x", types.HashTransaction(tx)))
+	require.Nil(t, err)
+	require.Equal(t, types.HashTransaction(tx), types.HashTransaction(fetchedTx))
+
+	// Undo data made it to disk as well
+	_, err = reopened.DisconnectTip()
+	require.Nil(t, err)
+
+	_, err = reopened.utxoStore.Get(fmt.Sprintf("%x_0", types.HashTransaction(tx)))
+	require.NotNil(t, err)
+
+	utxo, err = reopened.utxoStore.Get(fmt.Sprintf("%x_0", tx.Inputs[0].PrevTxHash))
+	require.Nil(t, err)
+	require.False(t, utxo.Spent)
+
+	require.Nil(t, reopened.AddBlock(NextBlock(t, reopened, privKey)))
+}
+
+func TestKeyedLogTruncatesTornTail(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test")
+
+	l, err := openKeyedLog(path, SyncAlways)
+	require.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.Nil(t, l.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	require.Nil(t, l.Close())
+
+	// Half a record, as if the process died mid-write
+	rec := encodeRecord("key-10", []byte("value-10"), false)
+	f, err := os.OpenFile(path+".dat", os.O_APPEND|os.O_WRONLY, 0644)
+	require.Nil(t, err)
+	_, err = f.Write(rec[:len(rec)/2])
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	l, err = openKeyedLog(path, SyncAlways)
+	require.Nil(t, err)
+	defer l.Close()
+
+	require.Equal(t, 10, l.Len())
+
+	_, ok, err := l.Get("key-10")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	require.Nil(t, l.Put("key-10", []byte("value-10")))
+
+	value, ok, err := l.Get("key-10")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("value-10"), value)
+}
+
+func TestKeyedLogRebuildsIndex(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test")
+
+	l, err := openKeyedLog(path, SyncNever)
+	require.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.Nil(t, l.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	require.Nil(t, l.Delete("key-3"))
+	require.Nil(t, l.Put("key-4", []byte("updated")))
+	require.Nil(t, l.Close())
+
+	require.Nil(t, os.Remove(path+".idx"))
+
+	l, err = openKeyedLog(path, SyncNever)
+	require.Nil(t, err)
+	defer l.Close()
+
+	require.Equal(t, 9, l.Len())
+
+	_, ok, err := l.Get("key-3")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	value, ok, err := l.Get("key-4")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("updated"), value)
+}
+
+func TestKeyedLogCompact(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test")
+
+	l, err := openKeyedLog(path, SyncNever)
+	require.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		require.Nil(t, l.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	for i := 0; i < 100; i += 2 {
+		require.Nil(t, l.Delete(fmt.Sprintf("key-%d", i)))
+	}
+
+	sizeBefore := l.size
+	require.Nil(t, l.compact())
+	require.Less(t, l.size, sizeBefore)
+	require.Equal(t, l.live, l.size)
+	require.Nil(t, l.Close())
+
+	l, err = openKeyedLog(path, SyncNever)
+	require.Nil(t, err)
+	defer l.Close()
+
+	require.Equal(t, 50, l.Len())
+
+	for i := 0; i < 100; i++ {
+		value, ok, err := l.Get(fmt.Sprintf("key-%d", i))
+		require.Nil(t, err)
+		require.Equal(t, i%2 == 1, ok)
+		if ok {
+			require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value)
+		}
+	}
+}
+
+func TestKeyedLogSurvivesFailedCompact(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test")
+
+	l, err := openKeyedLog(path, SyncNever)
+	require.Nil(t, err)
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		require.Nil(t, l.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+
+	// With the index gone from under it, the swap fails part way
+	require.Nil(t, os.Remove(path+".idx"))
+	require.NotNil(t, l.compact())
+
+	// The log carries on with the files it had
+	require.Nil(t, l.Put("key-10", []byte("value-10")))
+
+	for i := 0; i <= 10; i++ {
+		value, ok, err := l.Get(fmt.Sprintf("key-%d", i))
+		require.Nil(t, err)
+		require.True(t, ok)
+		require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value)
+	}
+
+	_, err = os.Stat(path + ".dat.compact")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestKeyedLogIndexKeepsTombstones(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test")
+
+	l, err := openKeyedLog(path, SyncNever)
+	require.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.Nil(t, l.Put(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	require.Nil(t, l.Delete("key-3"))
+	require.Nil(t, l.Put("key-10", []byte("value-10")))
+	require.Nil(t, l.Close())
+
+	// Everything comes back from the index, past the delete - nothing from the data file
+	l, err = openKeyedLog(path, SyncNever)
+	require.Nil(t, err)
+	defer l.Close()
+
+	require.Equal(t, 0, l.rescanned)
+	require.Equal(t, 10, l.Len())
+
+	_, ok, err := l.Get("key-3")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	value, ok, err := l.Get("key-10")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("value-10"), value)
+}
@@ -0,0 +1,177 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/i101dev/blocker/consensus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ------------------------------------------------------------------------
+// Everything validation can turn a block or transaction down for. A ValidationError
+// carries its code through wrapping, so callers - and peers on the other end of an RPC -
+// can tell the reasons apart without parsing messages.
+
+type ErrorCode int
+
+const (
+	CodeUnknown ErrorCode = iota
+	CodeMalformed
+	CodeBadSignature
+	CodeUnknownInput
+	CodeSpentInput
+	CodeNotOwner
+	CodeDuplicateInput
+	CodeDoubleSpend
+	CodeAmountOverflow
+	CodeInsufficientFunds
+	CodeBadMerkleRoot
+	CodeBadHeight
+	CodeTimestampOutOfRange
+	CodeUnknownParent
+	CodeKnownBlock
+	CodeWrongProposer
+	CodeConsensus
+	CodeBadCommit
+	CodeBadDifficulty
+	CodeInsufficientWork
+	CodeLockedInput
+	CodeBadStaking
+	CodeBadEvidence
+	CodeBadVersion
+	CodeBadCoinbase
+	CodeLowFee
+)
+
+var codeNames = map[ErrorCode]string{
+	CodeUnknown:             "unknown",
+	CodeMalformed:           "malformed",
+	CodeBadSignature:        "bad signature",
+	CodeUnknownInput:        "unknown input",
+	CodeSpentInput:          "spent input",
+	CodeNotOwner:            "not owner",
+	CodeDuplicateInput:      "duplicate input",
+	CodeDoubleSpend:         "double spend",
+	CodeAmountOverflow:      "amount overflow",
+	CodeInsufficientFunds:   "insufficient funds",
+	CodeBadMerkleRoot:       "bad merkle root",
+	CodeBadHeight:           "bad height",
+	CodeTimestampOutOfRange: "timestamp out of range",
+	CodeUnknownParent:       "unknown parent",
+	CodeKnownBlock:          "known block",
+	CodeWrongProposer:       "wrong proposer",
+	CodeConsensus:           "consensus",
+	CodeBadCommit:           "bad commit",
+	CodeBadDifficulty:       "bad difficulty",
+	CodeInsufficientWork:    "insufficient work",
+	CodeLockedInput:         "locked input",
+	CodeBadStaking:          "bad staking",
+	CodeBadEvidence:         "bad evidence",
+	CodeBadVersion:          "bad version",
+	CodeBadCoinbase:         "bad coinbase",
+	CodeLowFee:              "low fee",
+}
+
+func (c ErrorCode) String() string {
+
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("code(%d)", int(c))
+}
+
+// GRPCCode is the status a peer sees when a request is turned down for [c]
+func (c ErrorCode) GRPCCode() codes.Code {
+
+	switch c {
+	case CodeUnknown:
+		return codes.Unknown
+	case CodeKnownBlock:
+		return codes.AlreadyExists
+	// Fine on its own, but doesn't fit the state the chain is in right now
+	case CodeUnknownInput, CodeSpentInput, CodeDoubleSpend, CodeUnknownParent, CodeBadHeight, CodeLockedInput:
+		return codes.FailedPrecondition
+	default:
+		return codes.InvalidArgument
+	}
+}
+
+type ValidationError struct {
+	Code   ErrorCode
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+// Is matches on code alone, so a detailed error still matches the plain sentinel for it
+func (e *ValidationError) Is(target error) bool {
+	t, ok := target.(*ValidationError)
+	return ok && t.Code == e.Code
+}
+
+func (e *ValidationError) GRPCStatus() *status.Status {
+	return status.New(e.Code.GRPCCode(), e.Reason)
+}
+
+func validationErrorf(code ErrorCode, format string, args ...any) *ValidationError {
+	return &ValidationError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// consensusCodes tells apart the ways a block can break the engine's rules - anything
+// else an engine turns down comes through as CodeConsensus
+var consensusCodes = map[error]ErrorCode{
+	consensus.ErrWrongProposer: CodeWrongProposer,
+	consensus.ErrBadCommit:     CodeBadCommit,
+
+	consensus.ErrBadDifficulty:    CodeBadDifficulty,
+	consensus.ErrInsufficientWork: CodeInsufficientWork,
+}
+
+// fromConsensus gives an error from the consensus engine its code
+func fromConsensus(err error) *ValidationError {
+
+	for target, code := range consensusCodes {
+		if errors.Is(err, target) {
+			return &ValidationError{Code: code, Reason: err.Error()}
+		}
+	}
+
+	return &ValidationError{Code: CodeConsensus, Reason: err.Error()}
+}
+
+// CodeOf digs the code out of [err], CodeUnknown if it isn't a validation failure
+func CodeOf(err error) ErrorCode {
+
+	var v *ValidationError
+
+	if errors.As(err, &v) {
+		return v.Code
+	}
+
+	return CodeUnknown
+}
+
+var (
+	ErrMalformed         = &ValidationError{CodeMalformed, "malformed"}
+	ErrBadSignature      = &ValidationError{CodeBadSignature, "invalid signature"}
+	ErrUnknownInput      = &ValidationError{CodeUnknownInput, "input spends an unknown output"}
+	ErrSpentInput        = &ValidationError{CodeSpentInput, "input spends an output that is already spent"}
+	ErrNotOwner          = &ValidationError{CodeNotOwner, "input pubkey does not own the output it spends"}
+	ErrDuplicateInput    = &ValidationError{CodeDuplicateInput, "transaction spends the same output twice"}
+	ErrDoubleSpend       = &ValidationError{CodeDoubleSpend, "output already spent earlier in the block"}
+	ErrAmountOverflow    = &ValidationError{CodeAmountOverflow, "amounts overflow"}
+	ErrInsufficientFunds = &ValidationError{CodeInsufficientFunds, "insufficient balance"}
+	ErrBadMerkleRoot     = &ValidationError{CodeBadMerkleRoot, "merkle root does not match the transactions"}
+	ErrBadHeight         = &ValidationError{CodeBadHeight, "bad block height"}
+	ErrTimestamp         = &ValidationError{CodeTimestampOutOfRange, "timestamp out of range"}
+	ErrBadVersion        = &ValidationError{CodeBadVersion, "unsupported block version"}
+	ErrUnknownParent     = &ValidationError{CodeUnknownParent, "previous block hash invalid - unknown parent"}
+	ErrKnownBlock        = &ValidationError{CodeKnownBlock, "block already known"}
+	ErrWrongProposer     = &ValidationError{CodeWrongProposer, "block not signed by the scheduled proposer"}
+	ErrLockedInput       = &ValidationError{CodeLockedInput, "input spends a bonded output"}
+)
@@ -0,0 +1,112 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/i101dev/blocker/util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidationErrorSurvivesWrapping(t *testing.T) {
+
+	err := fmt.Errorf("reorg aborted: %w", &TxError{TxHash: "aa", Input: 0, Err: ErrSpentInput})
+
+	require.Equal(t, CodeSpentInput, CodeOf(err))
+	require.True(t, errors.Is(err, ErrSpentInput))
+	require.False(t, errors.Is(err, ErrDoubleSpend))
+
+	// A detailed error still matches the sentinel for its code
+	detailed := validationErrorf(CodeBadHeight, "height (%d) does not follow the tip", 7)
+	require.True(t, errors.Is(detailed, ErrBadHeight))
+
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	require.Equal(t, err.Error(), st.Message())
+
+	require.Equal(t, CodeUnknown, CodeOf(fmt.Errorf("disk on fire")))
+}
+
+func TestVerifyRejectsMalformedKeysWithoutPanic(t *testing.T) {
+
+	var (
+		privKey = crypto.NewPrivateKeyFromString(originSeed)
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	tx := spendTX(privKey, genesis.Transactions[0], []uint32{0}, 100)
+	tx.Inputs[0].PubKey = tx.Inputs[0].PubKey[:5]
+	require.Equal(t, CodeBadSignature, CodeOf(chain.ValidateTransaction(tx)))
+
+	tx = spendTX(privKey, genesis.Transactions[0], []uint32{0}, 100)
+	tx.Inputs[0].Signature = tx.Inputs[0].Signature[:10]
+	require.Equal(t, CodeBadSignature, CodeOf(chain.ValidateTransaction(tx)))
+
+	block := NextBlock(t, chain, privKey)
+	block.PublicKey = nil
+	require.Equal(t, CodeBadSignature, CodeOf(chain.AddBlock(block)))
+}
+
+func TestAddBlockRejectsTamperedBody(t *testing.T) {
+
+	var (
+		privKey = crypto.NewPrivateKeyFromString(originSeed)
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	block := BlockOn(t, genesis, privKey, spendTX(privKey, genesis.Transactions[0], []uint32{0}, 100))
+
+	// Redirect the payment after the block was signed
+	block.Transactions[0].Outputs[0].Address = crypto.GeneratePrivateKey().PubKey().Address().Bytes()
+
+	require.Equal(t, CodeBadMerkleRoot, CodeOf(chain.AddBlock(block)))
+	require.Equal(t, 0, chain.Height())
+}
+
+func TestHandleBlockReturnsStatusCodes(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		n       = NewNode(ServerConfig{ListenAddr: freeAddr(t)})
+	)
+
+	startNode(t, n, nil)
+	time.Sleep(time.Millisecond * 200)
+
+	client, err := makeNodeClient(n.ListenAddr)
+	require.Nil(t, err)
+
+	send := func(b *proto.Block) codes.Code {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := client.HandleBlock(ctx, b)
+		return status.Code(err)
+	}
+
+	block := NextBlock(t, n.chain, privKey)
+	block.Signature[0] ^= 0xff
+	require.Equal(t, codes.InvalidArgument, send(block))
+
+	require.Equal(t, codes.InvalidArgument, send(&proto.Block{}))
+
+	orphan := util.RandomBlock()
+	types.SignBlock(privKey, orphan)
+	require.Equal(t, codes.FailedPrecondition, send(orphan))
+
+	require.Equal(t, codes.OK, send(NextBlock(t, n.chain, privKey)))
+}
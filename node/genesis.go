@@ -0,0 +1,112 @@
+package node
+
+import (
+	"fmt"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// ----------------------------------------------------------------------------------
+// Genesis is what every node on a network has to agree on before the first block. The
+// validator set goes into the genesis header, so nodes configured with different sets
+// end up on different chains rather than quietly disagreeing about who may propose.
+type Genesis struct {
+	// Validators in proposing order, for engines that have them
+	Validators [][]byte
+
+	// The consensus rules the network runs - Solo at the default block time if nil
+	Engine consensus.Engine
+
+	// What each of the validators starts out with bonded to itself, for staking engines
+	Stake uint64
+
+	// What a block's coinbase may mint at first, halving every [HalvingInterval] blocks -
+	// never, if that's zero
+	InitialSubsidy  uint64
+	HalvingInterval int
+
+	// How many blocks a coinbase's output waits before it can be spent
+	CoinbaseMaturity int
+}
+
+func DefaultGenesis() *Genesis {
+	return &Genesis{
+		Engine:           consensus.NewSolo(consensus.DefaultBlockTime),
+		InitialSubsidy:   DefaultSubsidy,
+		HalvingInterval:  DefaultHalvingInterval,
+		CoinbaseMaturity: DefaultCoinbaseMaturity,
+	}
+}
+
+func (g *Genesis) engine() consensus.Engine {
+
+	if g.Engine == nil {
+		return consensus.NewSolo(consensus.DefaultBlockTime)
+	}
+
+	return g.Engine
+}
+
+// OriginKey owns the coins the genesis block mints - anyone can read it here, so it's no
+// use for anything but demos and tests
+func OriginKey() *crypto.PrivateKey {
+	return crypto.NewPrivateKeyFromString(originSeed)
+}
+
+func (g *Genesis) Block() *proto.Block {
+
+	privKey := crypto.NewPrivateKeyFromString(originSeed)
+
+	block := &proto.Block{
+		Header: &proto.Header{
+			Version:    BlockVersion,
+			Validators: g.Validators,
+		},
+	}
+
+	genesisTX := &proto.Transaction{
+		Version: 1,
+		Inputs:  []*proto.TxInput{},
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  123,
+				Address: privKey.PubKey().Address().Bytes(),
+			},
+		},
+	}
+
+	block.Transactions = append(block.Transactions, genesisTX)
+
+	if g.Stake > 0 {
+		for _, validator := range g.Validators {
+
+			pubKey, err := crypto.PubKeyFromBytes(validator)
+			if err != nil {
+				panic(fmt.Sprintf("genesis validator [%x]: %v", validator, err))
+			}
+
+			block.Transactions = append(block.Transactions, &proto.Transaction{
+				Version:   1,
+				Kind:      proto.TxKind_BOND,
+				Validator: validator,
+				Outputs: []*proto.TxOutput{
+					{
+						Amount:  g.Stake,
+						Address: pubKey.Address().Bytes(),
+					},
+				},
+			})
+		}
+	}
+
+	types.SignBlock(privKey, block)
+
+	return block
+}
+
+func createGenesisBlock() *proto.Block {
+	return DefaultGenesis().Block()
+}
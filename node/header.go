@@ -0,0 +1,80 @@
+package node
+
+import (
+	"slices"
+	"time"
+
+	"github.com/i101dev/blocker/proto"
+)
+
+// ----------------------------------------------------------------------------------
+// Header rules - what every block has to get right about where and when it goes, under
+// any engine. A block has to come right after its parent, in a version we know the rules
+// for, and be later than the median of the blocks before it - the median rather than the
+// parent, so one proposer with a fast clock can't drag everyone after it forward.
+
+// BlockVersion is the only header version this node knows the rules for
+const BlockVersion = 1
+
+// medianTimeSpan is how many headers back the median time is taken over
+const medianTimeSpan = 11
+
+// DefaultMaxClockDrift is how far ahead of our clock a block's timestamp may be before
+// we turn it away
+const DefaultMaxClockDrift = time.Second * 15
+
+// checkHeader holds [header] to the rules for going on top of a parent at [parentHeight],
+// given the median time of the blocks up to and including the parent
+func checkHeader(header *proto.Header, parentHeight int, medianTime int64) error {
+
+	if header.Version != BlockVersion {
+		return validationErrorf(CodeBadVersion, "unsupported block version (%d)", header.Version)
+	}
+
+	if int(header.Height) != parentHeight+1 {
+		return validationErrorf(CodeBadHeight, "block height (%d) does not follow its parent at (%d)", header.Height, parentHeight)
+	}
+
+	if header.Timestamp <= medianTime {
+		return validationErrorf(CodeTimestampOutOfRange, "block timestamp (%s) is not after the median time (%s)",
+			formatTimestamp(header.Timestamp), formatTimestamp(medianTime))
+	}
+
+	return nil
+}
+
+// checkClock turns away [header] if it's from more than [drift] into the future
+func checkClock(header *proto.Header, now time.Time, drift time.Duration) error {
+
+	if limit := now.Add(drift); time.Unix(0, header.Timestamp).After(limit) {
+		return validationErrorf(CodeTimestampOutOfRange, "block timestamp (%s) is more than %s ahead of our clock",
+			formatTimestamp(header.Timestamp), drift)
+	}
+
+	return nil
+}
+
+// medianTime is the median of [timestamps] - the later of the middle two for an even count
+func medianTime(timestamps []int64) int64 {
+
+	sorted := slices.Clone(timestamps)
+	slices.Sort(sorted)
+
+	return sorted[len(sorted)/2]
+}
+
+// medianTimePast is the median time of the blocks up to and including [node], on its branch
+func medianTimePast(node *blockNode) int64 {
+
+	timestamps := make([]int64, 0, medianTimeSpan)
+
+	for it := node; it != nil && len(timestamps) < medianTimeSpan; it = it.parent {
+		timestamps = append(timestamps, it.header.Timestamp)
+	}
+
+	return medianTime(timestamps)
+}
+
+func formatTimestamp(ts int64) string {
+	return time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+}
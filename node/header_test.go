@@ -0,0 +1,76 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMedianTime(t *testing.T) {
+
+	require.Equal(t, int64(5), medianTime([]int64{5}))
+	require.Equal(t, int64(3), medianTime([]int64{9, 1, 3}))
+	require.Equal(t, int64(7), medianTime([]int64{7, 1, 9, 3}))
+}
+
+func TestHeaderRules(t *testing.T) {
+
+	var (
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+		privKey = crypto.GeneratePrivateKey()
+	)
+
+	parent, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	// Genesis at 0, then blocks a second apart - the median is the block at 2s
+	for i := 0; i < 3; i++ {
+		block := blockAt(t, parent, privKey, time.Second)
+		require.Nil(t, chain.AddBlock(block))
+		parent = block
+	}
+
+	resigned := func(edit func(*proto.Header)) *proto.Block {
+		block := blockAt(t, parent, privKey, time.Second)
+		edit(block.Header)
+		types.SignBlock(privKey, block)
+		return block
+	}
+
+	cases := []struct {
+		name string
+		edit func(*proto.Header)
+		want ErrorCode
+	}{
+		{"height skips ahead", func(h *proto.Header) { h.Height++ }, CodeBadHeight},
+		{"height repeats the parent's", func(h *proto.Header) { h.Height-- }, CodeBadHeight},
+		{"version too old", func(h *proto.Header) { h.Version = 0 }, CodeBadVersion},
+		{"version too new", func(h *proto.Header) { h.Version = BlockVersion + 1 }, CodeBadVersion},
+		{"timestamp at the median", func(h *proto.Header) { h.Timestamp = int64(time.Second * 2) }, CodeTimestampOutOfRange},
+		{"timestamp before the median", func(h *proto.Header) { h.Timestamp = int64(time.Second) }, CodeTimestampOutOfRange},
+		{"timestamp too far ahead", func(h *proto.Header) { h.Timestamp = time.Now().Add(time.Minute).UnixNano() }, CodeTimestampOutOfRange},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.want, CodeOf(chain.AddBlock(resigned(c.edit))), c.name)
+	}
+	require.Equal(t, 3, chain.Height())
+
+	// Behind the parent is fine, so long as it's past the median
+	behind := resigned(func(h *proto.Header) { h.Timestamp = int64(time.Millisecond * 2500) })
+	require.Nil(t, chain.AddBlock(behind))
+
+	// A more forgiving clock lets the block from the future in
+	ahead := BlockOn(t, behind, privKey)
+	ahead.Header.Timestamp = time.Now().Add(time.Minute).UnixNano()
+	types.SignBlock(privKey, ahead)
+
+	require.Equal(t, CodeTimestampOutOfRange, CodeOf(chain.AddBlock(ahead)))
+	chain.SetMaxClockDrift(time.Hour)
+	require.Nil(t, chain.AddBlock(ahead))
+	require.Equal(t, 5, chain.Height())
+}
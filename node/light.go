@@ -0,0 +1,400 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// --------------------------------------------------------------
+// LightNode follows the chain by headers alone. It keeps no blocks and no UTXO set -
+// whatever it knows about a transaction comes from a merkle proof a full peer handed
+// over, checked against a header it has verified itself.
+
+type LightConfig struct {
+	// Full nodes to pull headers and proofs from
+	Peers []string
+
+	// The network's genesis - DefaultGenesis if nil. Headers are held to its engine's rules,
+	// so it can't be a staking engine: checking a proposer there takes the stakes, and the
+	// stakes take the blocks.
+	Genesis *Genesis
+}
+
+type LightNode struct {
+	peers  []proto.NodeClient
+	engine consensus.Engine
+
+	// Held for a whole sync, so two never interleave their header writes
+	syncLock sync.Mutex
+	headers  *HeaderList
+	index    *headerIndex
+
+	lock      sync.RWMutex
+	confirmed map[string]*lightTx
+
+	quit chan struct{}
+}
+
+// lightTx is a transaction proven to sit in block [blockHash] at [height]
+type lightTx struct {
+	tx        *proto.Transaction
+	blockHash []byte
+	height    int
+}
+
+var errHeadersFork = errors.New("headers do not link to our chain")
+
+const lightSyncInterval = time.Second * 5
+
+func NewLightNode(cfg LightConfig) (*LightNode, error) {
+
+	if cfg.Genesis == nil {
+		cfg.Genesis = DefaultGenesis()
+	}
+
+	engine := cfg.Genesis.engine()
+
+	if _, ok := engine.(consensus.Staking); ok {
+		return nil, fmt.Errorf("light nodes can't follow a proof-of-stake chain - checking a proposer takes the stakes, which only the blocks have")
+	}
+
+	genesis := cfg.Genesis.Block().Header
+
+	l := &LightNode{
+		engine:    engine,
+		headers:   NewHeaderList(),
+		index:     newHeaderIndex(genesis),
+		confirmed: make(map[string]*lightTx),
+		quit:      make(chan struct{}),
+	}
+
+	for _, addr := range cfg.Peers {
+
+		client, err := makeNodeClient(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		l.peers = append(l.peers, client)
+	}
+
+	l.headers.Add(genesis)
+
+	return l, nil
+}
+
+func (l *LightNode) Height() int {
+	return l.headers.Height()
+}
+
+func (l *LightNode) Header(height int) (*proto.Header, error) {
+
+	return l.headers.Get(height)
+}
+
+// Start keeps syncing headers every sync interval until Stop is called
+func (l *LightNode) Start() {
+
+	ticker := time.NewTicker(lightSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := l.Sync(); err != nil {
+			log.Printf("\n*** >>> [light] sync failed - %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+func (l *LightNode) Stop() {
+	close(l.quit)
+}
+
+// Sync pulls headers from every peer in turn, switching to a peer's branch whenever it
+// is longer than ours
+func (l *LightNode) Sync() error {
+
+	l.syncLock.Lock()
+	defer l.syncLock.Unlock()
+
+	var errs []error
+
+	for _, peer := range l.peers {
+		if err := l.syncFrom(peer); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// One peer coming through is enough
+	if len(errs) == len(l.peers) {
+		return errors.Join(errs...)
+	}
+
+	return nil
+}
+
+func (l *LightNode) syncFrom(peer proto.NodeClient) error {
+
+	for {
+		// Starting back at our tip, so a peer on another branch the same length shows up
+		from := max(1, l.Height())
+
+		headers, err := l.fetchHeaders(peer, from)
+
+		// The peer is on another branch - back off until we find where it forked from ours
+		for back := 2; errors.Is(err, errHeadersFork); back *= 2 {
+
+			from = max(1, l.Height()+1-back)
+			headers, err = l.fetchHeaders(peer, from)
+
+			if from == 1 && errors.Is(err, errHeadersFork) {
+				return fmt.Errorf("peer does not share our genesis block")
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		// A branch no heavier than ours isn't worth switching to
+		if !l.outweighs(from, headers) {
+			return nil
+		}
+
+		l.headers.Replace(from-1, headers)
+
+		if len(headers) < maxHeadersPerRequest {
+			return nil
+		}
+	}
+}
+
+// outweighs reports whether [headers], from height [from] on, weigh more by our engine
+// than the headers we have from [from] to our tip
+func (l *LightNode) outweighs(from int, headers []*proto.Header) bool {
+
+	var ours, theirs uint64
+
+	for height := from; height <= l.Height(); height++ {
+
+		header, err := l.headers.Get(height)
+		if err != nil {
+			return false
+		}
+
+		ours += l.engine.Weight(header)
+	}
+
+	for _, header := range headers {
+		theirs += l.engine.Weight(header)
+	}
+
+	return theirs > ours
+}
+
+// fetchHeaders gets the headers from [from] on and checks they are signed by whoever's
+// turn it was and chain on to our header at [from]-1
+func (l *LightNode) fetchHeaders(peer proto.NodeClient, from int) ([]*proto.Header, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncRequestTimeout)
+	defer cancel()
+
+	res, err := peer.GetHeaders(ctx, &proto.HeadersRequest{
+		FromHeight: int32(from),
+		Count:      maxHeadersPerRequest,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	parent, err := l.headers.Get(from - 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		prevHash = types.HashHeader(parent)
+		headers  = make([]*proto.Header, 0, len(res.Headers))
+	)
+
+	for i, sh := range res.Headers {
+
+		if sh.Header == nil {
+			return nil, fmt.Errorf("peer sent an empty header")
+		}
+
+		if !bytes.Equal(sh.Header.PrevHash, prevHash) {
+			if i == 0 {
+				return nil, errHeadersFork
+			}
+			return nil, fmt.Errorf("header at height (%d) does not link to its parent", sh.Header.Height)
+		}
+
+		if int(sh.Header.Height) != from+i {
+			return nil, fmt.Errorf("header height (%d) - expected (%d)", sh.Header.Height, from+i)
+		}
+
+		if !types.VerifyHeader(sh.Header, sh.PublicKey, sh.Signature) {
+			return nil, fmt.Errorf("header at height (%d): %w", sh.Header.Height, ErrBadSignature)
+		}
+
+		if err := l.engine.VerifyHeader(l.index, parent, sh.Header, sh.PublicKey); err != nil {
+			return nil, fmt.Errorf("header at height (%d): %w", sh.Header.Height, fromConsensus(err))
+		}
+
+		l.index.Add(sh.Header)
+
+		headers = append(headers, sh.Header)
+		parent = sh.Header
+		prevHash = types.HashHeader(sh.Header)
+	}
+
+	return headers, nil
+}
+
+// onChain reports whether block [hash] at [height] is on the header chain we follow
+func (l *LightNode) onChain(hash []byte, height int) bool {
+
+	header, err := l.headers.Get(height)
+
+	return err == nil && bytes.Equal(types.HashHeader(header), hash)
+}
+
+// --------------------------------------------------------------
+// Payments
+
+// VerifyPayment asks the peers to prove tx [txHash] is on the chain and checks the proof
+// against our own headers. The tx counts towards balances from then on.
+func (l *LightNode) VerifyPayment(txHash []byte) (*proto.Transaction, error) {
+
+	var errs []error
+
+	for _, peer := range l.peers {
+
+		tx, err := l.verifyPaymentFrom(peer, txHash)
+		if err == nil {
+			return tx, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	return nil, fmt.Errorf("failed to verify tx [%x]: %w", txHash, errors.Join(errs...))
+}
+
+func (l *LightNode) verifyPaymentFrom(peer proto.NodeClient, txHash []byte) (*proto.Transaction, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncRequestTimeout)
+	defer cancel()
+
+	res, err := peer.GetTxProof(ctx, &proto.TxProofRequest{TxHash: txHash})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Header == nil || res.Header.Header == nil || res.Transaction == nil {
+		return nil, fmt.Errorf("incomplete proof")
+	}
+
+	var (
+		header    = res.Header.Header
+		blockHash = types.HashHeader(header)
+		height    = int(header.Height)
+	)
+
+	if !bytes.Equal(types.HashTransaction(res.Transaction), txHash) {
+		return nil, fmt.Errorf("proof is for a different transaction")
+	}
+
+	// A header we haven't synced up to yet may just be new - catch up once before giving up
+	if !l.onChain(blockHash, height) && height > l.Height() {
+		if err := l.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !l.onChain(blockHash, height) {
+		return nil, fmt.Errorf("block [%x] at height (%d) is not on our chain", blockHash, height)
+	}
+
+	if !types.VerifyMerkleProof(header.RootHash, txHash, res.Proof) {
+		return nil, fmt.Errorf("merkle proof does not match block [%x]", blockHash)
+	}
+
+	l.lock.Lock()
+	l.confirmed[hex.EncodeToString(txHash)] = &lightTx{
+		tx:        res.Transaction,
+		blockHash: blockHash,
+		height:    height,
+	}
+	l.lock.Unlock()
+
+	return res.Transaction, nil
+}
+
+// Confirmations is how deep tx [txHash] is buried - 0 if it isn't proven to be on the
+// chain, or its block has been reorganized away since
+func (l *LightNode) Confirmations(txHash []byte) int {
+
+	l.lock.RLock()
+	ltx, ok := l.confirmed[hex.EncodeToString(txHash)]
+	l.lock.RUnlock()
+
+	if !ok || !l.onChain(ltx.blockHash, ltx.height) {
+		return 0
+	}
+
+	return l.Height() - ltx.height + 1
+}
+
+// GetBalance adds up the outputs paid to [address] by verified transactions, less those
+// another verified transaction spends. Only txs passed through VerifyPayment are known.
+func (l *LightNode) GetBalance(address []byte) uint64 {
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	var (
+		live  = make(map[string]*lightTx)
+		spent = make(map[string]bool)
+	)
+
+	for hash, ltx := range l.confirmed {
+
+		if !l.onChain(ltx.blockHash, ltx.height) {
+			continue
+		}
+
+		live[hash] = ltx
+
+		for _, input := range ltx.tx.Inputs {
+			spent[inputKey(input)] = true
+		}
+	}
+
+	var balance uint64
+
+	for hash, ltx := range live {
+		for i, output := range ltx.tx.Outputs {
+			if bytes.Equal(output.Address, address) && !spent[fmt.Sprintf("%s_%d", hash, i)] {
+				balance += output.Amount
+			}
+		}
+	}
+
+	return balance
+}
@@ -0,0 +1,292 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// tamperingPeer passes requests on to a real peer and doctors the proofs coming back
+type tamperingPeer struct {
+	proto.NodeClient
+	tamper func(*proto.TxProof)
+}
+
+func (p *tamperingPeer) GetTxProof(ctx context.Context, req *proto.TxProofRequest, opts ...grpc.CallOption) (*proto.TxProof, error) {
+
+	res, err := p.NodeClient.GetTxProof(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	p.tamper(res)
+
+	return res, nil
+}
+
+// resigningPeer passes headers on from a real peer signed over by another key
+type resigningPeer struct {
+	proto.NodeClient
+	privKey *crypto.PrivateKey
+}
+
+func (p *resigningPeer) GetHeaders(ctx context.Context, req *proto.HeadersRequest, opts ...grpc.CallOption) (*proto.Headers, error) {
+
+	res, err := p.NodeClient.GetHeaders(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sh := range res.Headers {
+		sh.PublicKey = p.privKey.PubKey().Bytes()
+		sh.Signature = p.privKey.Sign(types.HashHeader(sh.Header)).Bytes()
+	}
+
+	return res, nil
+}
+
+// lightTestNode is a full node with a few blocks, one of them paying [receiver], on a
+// chain [privKey] is the only validator of
+func lightTestNode(t *testing.T, privKey *crypto.PrivateKey, receiver *crypto.PrivateKey) (*Node, *proto.Transaction) {
+
+	full := NewNode(ServerConfig{
+		ListenAddr: freeAddr(t),
+		Genesis: &Genesis{
+			Validators: [][]byte{privKey.PubKey().Bytes()},
+			Engine:     consensus.NewPoA(consensus.PoAConfig{ProposerTimeout: time.Second}),
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, full.chain.AddBlock(NextBlock(t, full.chain, privKey)))
+	}
+
+	genesis, err := full.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	origin := crypto.NewPrivateKeyFromString(originSeed)
+	tx := spendTX(origin, genesis.Transactions[0], []uint32{0}, 100, 23)
+	tx.Outputs[0].Address = receiver.PubKey().Address().Bytes()
+
+	// Signed again over the new address
+	tx.Inputs[0].Signature = nil
+	tx.Inputs[0].Signature = types.SignTransaction(origin, tx).Bytes()
+
+	tip, err := full.chain.GetBlockByHeight(full.chain.Height())
+	require.Nil(t, err)
+	require.Nil(t, full.chain.AddBlock(BlockOn(t, tip, privKey, tx)))
+
+	for i := 0; i < 2; i++ {
+		require.Nil(t, full.chain.AddBlock(NextBlock(t, full.chain, privKey)))
+	}
+
+	startNode(t, full, nil)
+	time.Sleep(time.Millisecond * 200)
+
+	return full, tx
+}
+
+func TestLightNodeVerifiesPayment(t *testing.T) {
+
+	var (
+		privKey  = crypto.GeneratePrivateKey()
+		receiver = crypto.GeneratePrivateKey()
+		origin   = crypto.NewPrivateKeyFromString(originSeed)
+	)
+
+	full, tx := lightTestNode(t, privKey, receiver)
+
+	light, err := NewLightNode(LightConfig{
+		Peers:   []string{full.ListenAddr},
+		Genesis: full.chain.Genesis(),
+	})
+	require.Nil(t, err)
+
+	require.Nil(t, light.Sync())
+	require.Equal(t, full.chain.Height(), light.Height())
+
+	txHash := types.HashTransaction(tx)
+	require.Equal(t, uint64(0), light.GetBalance(receiver.PubKey().Address().Bytes()))
+
+	got, err := light.VerifyPayment(txHash)
+	require.Nil(t, err)
+	require.Equal(t, txHash, types.HashTransaction(got))
+
+	require.Equal(t, 3, light.Confirmations(txHash))
+	require.Equal(t, uint64(100), light.GetBalance(receiver.PubKey().Address().Bytes()))
+	require.Equal(t, uint64(23), light.GetBalance(origin.PubKey().Address().Bytes()))
+
+	// New blocks bury it deeper
+	require.Nil(t, full.chain.AddBlock(NextBlock(t, full.chain, privKey)))
+	require.Nil(t, light.Sync())
+	require.Equal(t, 4, light.Confirmations(txHash))
+}
+
+func TestLightNodeRejectsBadProofs(t *testing.T) {
+
+	var (
+		privKey  = crypto.GeneratePrivateKey()
+		receiver = crypto.GeneratePrivateKey()
+	)
+
+	full, tx := lightTestNode(t, privKey, receiver)
+
+	light, err := NewLightNode(LightConfig{Peers: []string{full.ListenAddr}, Genesis: full.chain.Genesis()})
+	require.Nil(t, err)
+	require.Nil(t, light.Sync())
+
+	honest := light.peers[0]
+	txHash := types.HashTransaction(tx)
+
+	tampers := []func(*proto.TxProof){
+		// A tx that pays more than the one in the block
+		func(res *proto.TxProof) { res.Transaction.Outputs[0].Amount = 1000 },
+		func(res *proto.TxProof) { res.Proof.Siblings = append(res.Proof.Siblings, types.EmptyRootHash) },
+		func(res *proto.TxProof) { res.Proof = nil },
+		// A header that isn't the one on the chain
+		func(res *proto.TxProof) { res.Header.Header.Timestamp++ },
+	}
+
+	for _, tamper := range tampers {
+		light.peers = []proto.NodeClient{&tamperingPeer{NodeClient: honest, tamper: tamper}}
+
+		_, err := light.VerifyPayment(txHash)
+		require.NotNil(t, err)
+	}
+
+	require.Equal(t, 0, light.Confirmations(txHash))
+	require.Equal(t, uint64(0), light.GetBalance(receiver.PubKey().Address().Bytes()))
+}
+
+func TestLightNodeRejectsUnknownValidator(t *testing.T) {
+
+	full, _ := lightTestNode(t, crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey())
+
+	light, err := NewLightNode(LightConfig{Peers: []string{full.ListenAddr}, Genesis: full.chain.Genesis()})
+	require.Nil(t, err)
+
+	// Well-signed headers, just not by the validator
+	light.peers[0] = &resigningPeer{NodeClient: light.peers[0], privKey: crypto.GeneratePrivateKey()}
+
+	require.NotNil(t, light.Sync())
+	require.Equal(t, 0, light.Height())
+}
+
+func TestLightNodeSwitchesToHeavierBranch(t *testing.T) {
+
+	var (
+		genesis, privKeys = testGenesis(consensus.NewPoA(poaTestConfig), 2)
+		fallback          = NewNode(ServerConfig{ListenAddr: freeAddr(t), Genesis: genesis})
+		inTurn            = NewNode(ServerConfig{ListenAddr: freeAddr(t), Genesis: genesis})
+	)
+
+	root, err := fallback.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	// Both branches three blocks long - one with every block in turn, the other with the
+	// last two from the validator next in line
+	var (
+		a = root
+		b = root
+	)
+
+	for height := 1; height <= 3; height++ {
+
+		b = blockAt(t, b, privKeys[height%2], time.Second)
+		require.Nil(t, inTurn.chain.AddBlock(b))
+
+		if height == 1 {
+			a = b
+		} else {
+			a = slotBlockAt(t, a, privKeys[(height+1)%2], time.Second*2, 1)
+		}
+		require.Nil(t, fallback.chain.AddBlock(a))
+	}
+
+	startNode(t, fallback, nil)
+	startNode(t, inTurn, nil)
+	time.Sleep(time.Millisecond * 200)
+
+	light, err := NewLightNode(LightConfig{Peers: []string{fallback.ListenAddr}, Genesis: genesis})
+	require.Nil(t, err)
+	require.Nil(t, light.Sync())
+	require.Equal(t, 3, light.Height())
+
+	fallbackPeer := light.peers[0]
+
+	inTurnPeer, err := makeNodeClient(inTurn.ListenAddr)
+	require.Nil(t, err)
+
+	// The same length, but heavier
+	light.peers = []proto.NodeClient{inTurnPeer}
+	require.Nil(t, light.Sync())
+
+	header, err := light.Header(3)
+	require.Nil(t, err)
+	require.Equal(t, types.HashBlock(b), types.HashHeader(header))
+
+	// And no going back to the lighter one
+	light.peers = []proto.NodeClient{fallbackPeer}
+	require.Nil(t, light.Sync())
+
+	header, err = light.Header(3)
+	require.Nil(t, err)
+	require.Equal(t, types.HashBlock(b), types.HashHeader(header))
+}
+
+func TestLightNodeRejectsStakingGenesis(t *testing.T) {
+
+	genesis, _ := testGenesis(consensus.NewPoS(posTestConfig), 1)
+
+	_, err := NewLightNode(LightConfig{Genesis: genesis})
+	require.NotNil(t, err)
+}
+
+func TestLightNodeFollowsReorg(t *testing.T) {
+
+	var (
+		privKey  = crypto.GeneratePrivateKey()
+		receiver = crypto.GeneratePrivateKey()
+	)
+
+	full, tx := lightTestNode(t, privKey, receiver)
+
+	light, err := NewLightNode(LightConfig{Peers: []string{full.ListenAddr}, Genesis: full.chain.Genesis()})
+	require.Nil(t, err)
+	require.Nil(t, light.Sync())
+
+	txHash := types.HashTransaction(tx)
+	_, err = light.VerifyPayment(txHash)
+	require.Nil(t, err)
+
+	// A longer branch forking off below the block with the payment
+	parent, err := full.chain.GetBlockByHeight(2)
+	require.Nil(t, err)
+
+	for i := 0; i < 5; i++ {
+		parent = BlockOn(t, parent, privKey)
+		require.Nil(t, full.chain.AddBlock(parent))
+	}
+	require.Equal(t, 7, full.chain.Height())
+
+	require.Nil(t, light.Sync())
+	require.Equal(t, 7, light.Height())
+
+	for i := 0; i <= light.Height(); i++ {
+		b, err := full.chain.GetBlockByHeight(i)
+		require.Nil(t, err)
+		h, err := light.Header(i)
+		require.Nil(t, err)
+		require.Equal(t, types.HashBlock(b), types.HashHeader(h))
+	}
+
+	require.Equal(t, 0, light.Confirmations(txHash))
+	require.Equal(t, uint64(0), light.GetBalance(receiver.PubKey().Address().Bytes()))
+}
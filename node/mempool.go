@@ -0,0 +1,424 @@
+package node
+
+import (
+	"container/heap"
+	"container/list"
+	"encoding/hex"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	pb "google.golang.org/protobuf/proto"
+)
+
+// --------------------------------------------------------------
+// Mempool holds the transactions waiting for a block, best paying first. What a tx pays
+// is its fee - whatever its inputs hold beyond its outputs - for each byte it takes up
+// in the block, so a big tx has to pay more than a small one to get in ahead of it.
+//
+// A tx stays in the pool until a block confirms it - or until it goes stale, or the pool
+// fills up with txs paying better and it gets pushed out.
+
+const (
+	// Fee rates are per this many bytes
+	feeRateBytes = 1000
+
+	// How much of a block its transactions may take up, unless configured otherwise
+	DefaultMaxBlockBytes = 1 << 20
+
+	// What a tx has to pay per 1000 bytes to get into the mempool of a node that asks for
+	// a minimum relay fee
+	DefaultMinRelayFee = 1
+)
+
+// FeeRate is what [fee] works out to per 1000 bytes, for a tx [size] bytes long
+func FeeRate(fee uint64, size int) uint64 {
+
+	hi, lo := bits.Mul64(fee, feeRateBytes)
+	if hi >= uint64(size) {
+		return math.MaxUint64
+	}
+
+	rate, _ := bits.Div64(hi, lo, uint64(size))
+
+	return rate
+}
+
+// RelayFee is the least a tx [size] bytes long has to pay at [rate] per 1000 bytes
+func RelayFee(rate uint64, size int) uint64 {
+
+	hi, lo := bits.Mul64(rate, uint64(size))
+	if hi >= feeRateBytes {
+		return math.MaxUint64
+	}
+
+	fee, rem := bits.Div64(hi, lo, feeRateBytes)
+	if rem > 0 {
+		fee++
+	}
+
+	return fee
+}
+
+type MempoolConfig struct {
+	// How many txs the pool holds, and how many bytes they may add up to - no limit if zero
+	MaxCount int
+	MaxBytes int
+
+	// How long a tx may wait for a block before it's dropped - forever if zero
+	Expiry time.Duration
+}
+
+func DefaultMempoolConfig() MempoolConfig {
+	return MempoolConfig{
+		MaxCount: 10_000,
+		MaxBytes: 32 << 20,
+		Expiry:   time.Hour * 24,
+	}
+}
+
+type mempoolEntry struct {
+	tx    *proto.Transaction
+	hash  string
+	fee   uint64
+	size  int
+	added time.Time
+
+	// arrival order - the earlier of two txs paying the same goes first
+	seq uint64
+
+	// place in each of the queues, kept up to date by them, and in the arrival order
+	index   [2]int
+	arrival *list.Element
+}
+
+// paysMore compares the fee rates exactly - [e]'s fee over its size against [other]'s
+func (e *mempoolEntry) paysMore(other *mempoolEntry) bool {
+
+	aHi, aLo := bits.Mul64(e.fee, uint64(other.size))
+	bHi, bLo := bits.Mul64(other.fee, uint64(e.size))
+
+	if aHi != bHi {
+		return aHi > bHi
+	}
+	if aLo != bLo {
+		return aLo > bLo
+	}
+
+	return e.seq < other.seq
+}
+
+const (
+	bestFirst = iota
+	worstFirst
+)
+
+// feeQueue is a heap of the entries - best paying on top, or worst paying for the one
+// eviction goes by
+type feeQueue struct {
+	order   int
+	entries []*mempoolEntry
+}
+
+func (q *feeQueue) Len() int { return len(q.entries) }
+
+func (q *feeQueue) Less(i, j int) bool {
+
+	if q.order == worstFirst {
+		return q.entries[j].paysMore(q.entries[i])
+	}
+
+	return q.entries[i].paysMore(q.entries[j])
+}
+
+func (q *feeQueue) Swap(i, j int) {
+	q.entries[i], q.entries[j] = q.entries[j], q.entries[i]
+	q.entries[i].index[q.order] = i
+	q.entries[j].index[q.order] = j
+}
+
+func (q *feeQueue) Push(x any) {
+	entry := x.(*mempoolEntry)
+	entry.index[q.order] = len(q.entries)
+	q.entries = append(q.entries, entry)
+}
+
+func (q *feeQueue) Pop() any {
+	old := q.entries
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	q.entries = old[:len(old)-1]
+	return entry
+}
+
+type Mempool struct {
+	lock sync.RWMutex
+	cfg  MempoolConfig
+	txx  map[string]*mempoolEntry
+
+	best  feeQueue
+	worst feeQueue
+
+	// oldest first, for expiry
+	arrivals *list.List
+
+	seq   uint64
+	bytes int
+
+	// the tx in the pool spending each output, so no two can spend the same one
+	spends map[string]string
+
+	clock func() time.Time
+}
+
+func NewMempool() *Mempool {
+	return NewMempoolWithConfig(DefaultMempoolConfig())
+}
+
+func NewMempoolWithConfig(cfg MempoolConfig) *Mempool {
+	return &Mempool{
+		cfg:      cfg,
+		txx:      make(map[string]*mempoolEntry),
+		best:     feeQueue{order: bestFirst},
+		worst:    feeQueue{order: worstFirst},
+		arrivals: list.New(),
+		spends:   make(map[string]string),
+		clock:    time.Now,
+	}
+}
+
+func (pool *Mempool) Len() int {
+
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return len(pool.txx)
+}
+
+// Bytes is how much the txs in the pool add up to
+func (pool *Mempool) Bytes() int {
+
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.bytes
+}
+
+func (pool *Mempool) Has(tx *proto.Transaction) bool {
+
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+	_, ok := pool.txx[hash]
+	return ok
+}
+
+// Add queues [tx], paying [fee] - false if it's already in the pool, and an error if
+// it spends an output another tx in the pool already does, or if the pool is full of
+// txs paying at least as well
+func (pool *Mempool) Add(tx *proto.Transaction, fee uint64) (bool, error) {
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.expire()
+
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+
+	if _, ok := pool.txx[hash]; ok {
+		return false, nil
+	}
+
+	for i, input := range tx.Inputs {
+		if other, ok := pool.spends[inputKey(input)]; ok {
+			return false, &TxError{
+				TxHash: hash,
+				Input:  i,
+				Err:    validationErrorf(CodeDoubleSpend, "output already spent by tx [%s] in the mempool", other),
+			}
+		}
+	}
+
+	entry := &mempoolEntry{
+		tx:    tx,
+		hash:  hash,
+		fee:   fee,
+		size:  pb.Size(tx),
+		added: pool.clock(),
+		seq:   pool.seq,
+	}
+
+	if err := pool.makeRoom(entry); err != nil {
+		return false, &TxError{TxHash: hash, Input: -1, Err: err}
+	}
+
+	pool.seq++
+
+	for _, input := range tx.Inputs {
+		pool.spends[inputKey(input)] = hash
+	}
+
+	pool.txx[hash] = entry
+	pool.bytes += entry.size
+	heap.Push(&pool.best, entry)
+	heap.Push(&pool.worst, entry)
+	entry.arrival = pool.arrivals.PushBack(entry)
+
+	return true, nil
+}
+
+// makeRoom evicts the worst paying txs until [entry] fits - so long as they all pay less
+// than it does. If they don't, nothing is evicted.
+func (pool *Mempool) makeRoom(entry *mempoolEntry) error {
+
+	var (
+		count   = len(pool.txx) + 1
+		bytes   = pool.bytes + entry.size
+		evicted = []*mempoolEntry{}
+	)
+
+	full := func() bool {
+		return (pool.cfg.MaxCount > 0 && count > pool.cfg.MaxCount) ||
+			(pool.cfg.MaxBytes > 0 && bytes > pool.cfg.MaxBytes)
+	}
+
+	for full() {
+
+		if pool.worst.Len() == 0 || !entry.paysMore(pool.worst.entries[0]) {
+
+			// Everything taken off the eviction queue so far goes back on
+			for _, e := range evicted {
+				heap.Push(&pool.worst, e)
+			}
+
+			return validationErrorf(CodeLowFee, "mempool is full - tx pays (%d) per 1000 bytes, no more than what's in it",
+				FeeRate(entry.fee, entry.size))
+		}
+
+		worst := heap.Pop(&pool.worst).(*mempoolEntry)
+		evicted = append(evicted, worst)
+
+		count--
+		bytes -= worst.size
+	}
+
+	for _, e := range evicted {
+		heap.Remove(&pool.best, e.index[bestFirst])
+		pool.forget(e)
+	}
+
+	return nil
+}
+
+// Template lists the best paying transactions for a block, until they add up to
+// [maxBytes] - any too big to fit are passed over for smaller ones. They stay in the
+// pool until a block confirms them.
+func (pool *Mempool) Template(maxBytes int) []*proto.Transaction {
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.expire()
+
+	entries := make([]*mempoolEntry, len(pool.best.entries))
+	copy(entries, pool.best.entries)
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].paysMore(entries[j])
+	})
+
+	var (
+		txx       = []*proto.Transaction{}
+		remaining = maxBytes
+	)
+
+	for _, entry := range entries {
+
+		if entry.size > remaining {
+			continue
+		}
+
+		txx = append(txx, entry.tx)
+		remaining -= entry.size
+	}
+
+	return txx
+}
+
+// Remove drops [tx] from the pool, if it's there
+func (pool *Mempool) Remove(tx *proto.Transaction) {
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if entry, ok := pool.txx[hex.EncodeToString(types.HashTransaction(tx))]; ok {
+		pool.remove(entry)
+	}
+}
+
+// RemoveConfirmed drops the txs [b] confirms, and any that spend what they spend - those
+// can never go in a block on top of it
+func (pool *Mempool) RemoveConfirmed(b *proto.Block) {
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for _, tx := range b.Transactions {
+
+		if entry, ok := pool.txx[hex.EncodeToString(types.HashTransaction(tx))]; ok {
+			pool.remove(entry)
+			continue
+		}
+
+		for _, input := range tx.Inputs {
+			if hash, ok := pool.spends[inputKey(input)]; ok {
+				pool.remove(pool.txx[hash])
+			}
+		}
+	}
+
+	pool.expire()
+}
+
+// expire drops every tx that has waited longer than the expiry
+func (pool *Mempool) expire() {
+
+	if pool.cfg.Expiry <= 0 {
+		return
+	}
+
+	cutoff := pool.clock().Add(-pool.cfg.Expiry)
+
+	for front := pool.arrivals.Front(); front != nil; front = pool.arrivals.Front() {
+
+		entry := front.Value.(*mempoolEntry)
+		if entry.added.After(cutoff) {
+			return
+		}
+
+		pool.remove(entry)
+	}
+}
+
+func (pool *Mempool) remove(entry *mempoolEntry) {
+	heap.Remove(&pool.best, entry.index[bestFirst])
+	heap.Remove(&pool.worst, entry.index[worstFirst])
+	pool.forget(entry)
+}
+
+// forget drops what the pool knows of [entry] besides its place in the queues
+func (pool *Mempool) forget(entry *mempoolEntry) {
+
+	delete(pool.txx, entry.hash)
+	pool.bytes -= entry.size
+	pool.arrivals.Remove(entry.arrival)
+
+	for _, input := range entry.tx.Inputs {
+		delete(pool.spends, inputKey(input))
+	}
+}
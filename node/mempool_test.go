@@ -0,0 +1,342 @@
+package node
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pb "google.golang.org/protobuf/proto"
+)
+
+// paddedTX is a tx paying [amount] of at least [size] bytes - the padding goes in the
+// output address
+func paddedTX(amount uint64, size int) *proto.Transaction {
+
+	tx := &proto.Transaction{Version: 1, Outputs: []*proto.TxOutput{{Amount: amount}}}
+
+	for pb.Size(tx) < size {
+		tx.Outputs[0].Address = append(tx.Outputs[0].Address, 0)
+	}
+
+	return tx
+}
+
+func TestFeeRate(t *testing.T) {
+
+	require.Equal(t, uint64(100), FeeRate(23, 230))
+	require.Equal(t, uint64(0), FeeRate(0, 230))
+	require.Equal(t, uint64(math.MaxUint64), FeeRate(math.MaxUint64, 1))
+
+	// Rounded up, so a tx never pays less than the rate
+	require.Equal(t, uint64(1), RelayFee(1, 230))
+	require.Equal(t, uint64(4), RelayFee(3, 1001))
+	require.Equal(t, uint64(250), RelayFee(1000, 250))
+	require.Equal(t, uint64(0), RelayFee(0, 250))
+}
+
+func TestMempoolTemplateBestPayingFirst(t *testing.T) {
+
+	var (
+		pool  = NewMempool()
+		small = paddedTX(1, 100)
+		cheap = paddedTX(1, 101)
+		big   = paddedTX(1, 1000)
+		tied  = paddedTX(2, 100)
+	)
+
+	require.Equal(t, pb.Size(small), pb.Size(tied))
+
+	// Rates of about 500, 100 and 800 per 1000 bytes - the big tx pays most in all, but
+	// not per byte
+	for _, tx := range []*proto.Transaction{small, cheap, big} {
+		added, err := pool.Add(tx, map[*proto.Transaction]uint64{small: 50, cheap: 10, big: 800}[tx])
+		require.Nil(t, err)
+		require.True(t, added)
+	}
+
+	added, err := pool.Add(small, 50)
+	require.Nil(t, err)
+	require.False(t, added)
+
+	// The txs stay put until a block confirms them
+	require.Equal(t, []*proto.Transaction{big, small, cheap}, pool.Template(DefaultMaxBlockBytes))
+	require.Equal(t, 3, pool.Len())
+
+	// Too big for what's left of the block, so it waits - the smaller ones still fit
+	require.Equal(t, []*proto.Transaction{small, cheap}, pool.Template(500))
+
+	pool.Remove(big)
+	pool.Remove(cheap)
+	require.False(t, pool.Has(big))
+	require.Equal(t, pb.Size(small), pool.Bytes())
+
+	// Same rate, first come first served
+	pool.Add(tied, 50)
+	require.Equal(t, []*proto.Transaction{small, tied}, pool.Template(DefaultMaxBlockBytes))
+}
+
+func TestMempoolEvictsWorstPaying(t *testing.T) {
+
+	var (
+		pool  = NewMempoolWithConfig(MempoolConfig{MaxCount: 2})
+		cheap = paddedTX(1, 100)
+		mid   = paddedTX(2, 100)
+		best  = paddedTX(3, 100)
+		worse = paddedTX(4, 100)
+	)
+
+	pool.Add(cheap, 10)
+	pool.Add(mid, 20)
+
+	// Full - the cheapest makes way for one paying better
+	added, err := pool.Add(best, 30)
+	require.Nil(t, err)
+	require.True(t, added)
+	require.False(t, pool.Has(cheap))
+	require.Equal(t, 2, pool.Len())
+
+	// But nothing makes way for one paying no more than what's there
+	for _, fee := range []uint64{5, 20} {
+		added, err = pool.Add(worse, fee)
+		require.False(t, added)
+		require.Equal(t, CodeLowFee, CodeOf(err))
+		require.Contains(t, err.Error(), "mempool is full")
+	}
+	require.True(t, pool.Has(mid))
+	require.True(t, pool.Has(best))
+
+	// Out of bytes, as many go as it takes to fit - unless that's everything
+	var (
+		bytes = NewMempoolWithConfig(MempoolConfig{MaxBytes: pb.Size(cheap) * 3})
+		large = paddedTX(5, pb.Size(cheap)*2)
+		huge  = paddedTX(6, pb.Size(cheap)*4)
+	)
+
+	bytes.Add(cheap, 10)
+	bytes.Add(mid, 20)
+	bytes.Add(best, 30)
+
+	added, err = bytes.Add(huge, 1000)
+	require.False(t, added)
+	require.Equal(t, CodeLowFee, CodeOf(err))
+	require.Equal(t, 3, bytes.Len())
+
+	added, err = bytes.Add(large, 1000)
+	require.Nil(t, err)
+	require.True(t, added)
+	require.Equal(t, []*proto.Transaction{large, best}, bytes.Template(DefaultMaxBlockBytes))
+	require.LessOrEqual(t, bytes.Bytes(), pb.Size(cheap)*3)
+
+	// The evicted txs' outputs are free to spend again
+	added, err = bytes.Add(cheap, 1000)
+	require.Nil(t, err)
+	require.True(t, added)
+}
+
+func TestMempoolExpiry(t *testing.T) {
+
+	var (
+		now  = time.Now()
+		pool = NewMempoolWithConfig(MempoolConfig{Expiry: time.Hour})
+		old  = paddedTX(1, 100)
+		tx   = paddedTX(2, 100)
+	)
+
+	pool.clock = func() time.Time { return now }
+
+	pool.Add(old, 10)
+	now = now.Add(time.Minute * 30)
+	pool.Add(tx, 1)
+
+	now = now.Add(time.Minute * 30)
+	require.Equal(t, []*proto.Transaction{tx}, pool.Template(DefaultMaxBlockBytes))
+	require.False(t, pool.Has(old))
+
+	now = now.Add(time.Minute * 30)
+	pool.Template(DefaultMaxBlockBytes)
+	require.Equal(t, 0, pool.Len())
+	require.Equal(t, 0, pool.Bytes())
+}
+
+func TestHandleTXEnforcesMinRelayFee(t *testing.T) {
+
+	var (
+		origin = crypto.NewPrivateKeyFromString(originSeed)
+		n      = NewNode(ServerConfig{ListenAddr: freeAddr(t), MinRelayFee: 100})
+	)
+
+	startNode(t, n, nil)
+	time.Sleep(time.Millisecond * 200)
+
+	client, err := makeNodeClient(n.ListenAddr)
+	require.Nil(t, err)
+
+	send := func(tx *proto.Transaction) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := client.HandleTX(ctx, tx)
+		return err
+	}
+
+	genesis, err := n.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	var (
+		stingy   = spendTX(origin, genesis.Transactions[0], []uint32{0}, 120)
+		generous = spendTX(origin, genesis.Transactions[0], []uint32{0}, 100)
+		invalid  = spendTX(origin, genesis.Transactions[0], []uint32{0}, 200)
+	)
+
+	// A fee of 3 is short of what the rate asks for a tx this size, 23 isn't
+	require.Less(t, uint64(3), RelayFee(100, pb.Size(stingy)))
+	require.GreaterOrEqual(t, uint64(23), RelayFee(100, pb.Size(generous)))
+
+	err = send(stingy)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "to be relayed")
+	require.False(t, n.mempool.Has(stingy))
+
+	require.Equal(t, codes.InvalidArgument, status.Code(send(invalid)))
+	require.False(t, n.mempool.Has(invalid))
+
+	require.Nil(t, send(generous))
+	require.True(t, n.mempool.Has(generous))
+}
+
+func TestMempoolRejectsConflicts(t *testing.T) {
+
+	var (
+		chain, privKey, split = splitChain(t)
+		pool                  = NewMempool()
+		first                 = spendTX(privKey, split, []uint32{0}, 50)
+		rival                 = spendTX(privKey, split, []uint32{1, 0}, 60)
+		other                 = spendTX(privKey, split, []uint32{1}, 10)
+	)
+
+	// Each is fine against the chain - just not together
+	for _, tx := range []*proto.Transaction{first, rival, other} {
+		require.Nil(t, chain.ValidateTransaction(tx))
+	}
+
+	added, err := pool.Add(first, 1)
+	require.Nil(t, err)
+	require.True(t, added)
+
+	// Output 0 is taken, at the rival's second input
+	added, err = pool.Add(rival, 100)
+	require.False(t, added)
+	requireTxError(t, err, ErrDoubleSpend, 1)
+	require.False(t, pool.Has(rival))
+
+	added, err = pool.Add(other, 1)
+	require.Nil(t, err)
+	require.True(t, added)
+
+	// Once the others are gone, so is the conflict
+	pool.Remove(first)
+	pool.Remove(other)
+
+	added, err = pool.Add(rival, 100)
+	require.Nil(t, err)
+	require.True(t, added)
+}
+
+func TestHandleTXRejectsWithReason(t *testing.T) {
+
+	var (
+		origin = crypto.NewPrivateKeyFromString(originSeed)
+		n      = NewNode(ServerConfig{ListenAddr: freeAddr(t)})
+	)
+
+	startNode(t, n, nil)
+	time.Sleep(time.Millisecond * 200)
+
+	client, err := makeNodeClient(n.ListenAddr)
+	require.Nil(t, err)
+
+	send := func(tx *proto.Transaction) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := client.HandleTX(ctx, tx)
+		return err
+	}
+
+	genesis, err := n.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	var (
+		tx     = spendTX(origin, genesis.Transactions[0], []uint32{0}, 100)
+		rival  = spendTX(origin, genesis.Transactions[0], []uint32{0}, 99)
+		forged = spendTX(origin, genesis.Transactions[0], []uint32{0}, 100)
+		random = spendTX(origin, tx, []uint32{0}, 100)
+	)
+	forged.Outputs[0].Amount = 1
+
+	require.Nil(t, send(tx))
+	require.True(t, n.mempool.Has(tx))
+
+	// Sent again, it's nothing new
+	require.Nil(t, send(tx))
+
+	cases := []struct {
+		tx     *proto.Transaction
+		code   codes.Code
+		reason string
+	}{
+		{rival, codes.FailedPrecondition, "in the mempool"},
+		{forged, codes.InvalidArgument, "invalid signature"},
+		{random, codes.FailedPrecondition, "unknown output"},
+	}
+
+	for _, c := range cases {
+		err := send(c.tx)
+		require.Equal(t, c.code, status.Code(err), err)
+		require.Contains(t, status.Convert(err).Message(), c.reason)
+		require.False(t, n.mempool.Has(c.tx))
+	}
+}
+
+func TestMempoolFollowsChain(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		origin  = crypto.NewPrivateKeyFromString(originSeed)
+		n       = NewNode(ServerConfig{ListenAddr: freeAddr(t), PrivateKey: privKey})
+	)
+
+	genesis, err := n.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	var (
+		tx    = spendTX(origin, genesis.Transactions[0], []uint32{0}, 100)
+		rival = spendTX(origin, genesis.Transactions[0], []uint32{0}, 99)
+	)
+
+	added, err := n.admit(tx)
+	require.Nil(t, err)
+	require.True(t, added)
+
+	// A block confirming the rival leaves the tx nothing to spend
+	header, _ := n.prepareHeader(time.Now())
+	block, err := n.createBlock(header, []*proto.Transaction{rival})
+	require.Nil(t, err)
+	require.Nil(t, n.chain.AddBlock(block))
+	require.Equal(t, 0, n.mempool.Len())
+
+	// Taken back off, the block gives the rival back - but not its coinbase
+	_, err = n.chain.DisconnectTip()
+	require.Nil(t, err)
+	require.Equal(t, []*proto.Transaction{rival}, n.mempool.Template(n.MaxBlockBytes))
+
+	header, _ = n.prepareHeader(time.Now())
+	block, err = n.createBlock(header, n.mempool.Template(n.MaxBlockBytes))
+	require.Nil(t, err)
+	require.Nil(t, n.chain.AddBlock(block))
+	require.Equal(t, 0, n.mempool.Len())
+}
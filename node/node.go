@@ -1,116 +1,152 @@
 package node
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"math/bits"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/i101dev/blocker/consensus"
 	"github.com/i101dev/blocker/crypto"
 	"github.com/i101dev/blocker/proto"
 	"github.com/i101dev/blocker/types"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	pb "google.golang.org/protobuf/proto"
 )
 
 // --------------------------------------------------------------
-const blockTime = time.Second * 5
+// how often the validator loop asks the engine whether it's time to propose
+const proposeTick = time.Millisecond * 250
 
-// --------------------------------------------------------------
+// How far below our tip a block is forgotten by the gossip de-duplication - by then
+// it's on the chain for good, or never will be
+const seenBlocksDepth = 100
 
-type Mempool struct {
-	lock sync.RWMutex
-	txx  map[string]*proto.Transaction
-}
+// ----------------------------------------------------------------------
 
-func NewMempool() *Mempool {
-	return &Mempool{
-		txx: make(map[string]*proto.Transaction),
-	}
-}
+type ServerConfig struct {
+	Version    string
+	ListenAddr string
+	PrivateKey *crypto.PrivateKey
 
-func (pool *Mempool) Clear() []*proto.Transaction {
+	// Storage backends for the chain - in-memory stores are used for any left nil
+	BlockStorer BlockStorer
+	TXStorer    TXStorer
+	UTXOStorer  UTXOStorer
 
-	pool.lock.Lock()
-	defer pool.lock.Unlock()
+	// The network's genesis - DefaultGenesis if nil
+	Genesis *Genesis
 
-	txx := make([]*proto.Transaction, len(pool.txx))
+	// How far ahead of our clock a block's timestamp may be - DefaultMaxClockDrift if zero
+	MaxClockDrift time.Duration
 
-	it := 0
-	for k, v := range pool.txx {
-		delete(pool.txx, k)
-		txx[it] = v
-		it++
-	}
+	// What a tx has to pay per 1000 bytes for us to take it - nothing if zero
+	MinRelayFee uint64
 
-	return txx
+	// How much of a block we fill with transactions - DefaultMaxBlockBytes if zero
+	MaxBlockBytes int
+
+	// How big the mempool gets and how long txs wait in it - DefaultMempoolConfig if nil
+	Mempool *MempoolConfig
 }
 
-func (pool *Mempool) Len() int {
+type Node struct {
+	// listenAddr string
+	// version    string
+	ServerConfig
+
+	peerLock sync.RWMutex
+	peerList map[proto.NodeClient]*proto.Version
 
-	pool.lock.RLock()
-	defer pool.lock.Unlock()
+	mempool  *Mempool
+	evidence *EvidencePool
+	chain    *Chain
 
-	return len(pool.txx)
-}
+	// Runs block production in place of the validator loop on voting engines
+	voter consensus.Voter
 
-func (pool *Mempool) Has(tx *proto.Transaction) bool {
+	// height of each block we've taken or are taking in, so we only pass it on once
+	seenLock   sync.Mutex
+	seenBlocks map[string]int
+	seenPruned int
 
-	pool.lock.RLock()
-	defer pool.lock.RUnlock()
+	syncLock sync.Mutex
 
-	hash := hex.EncodeToString(types.HashTransaction(tx))
-	_, ok := pool.txx[hash]
-	return ok
+	proto.UnimplementedNodeServer
 }
 
-func (pool *Mempool) Add(tx *proto.Transaction) bool {
+func NewNode(cfg ServerConfig) *Node {
 
-	if pool.Has(tx) {
-		return false
+	if cfg.BlockStorer == nil {
+		cfg.BlockStorer = NewMemoryBlockStore()
+	}
+	if cfg.TXStorer == nil {
+		cfg.TXStorer = NewMemoryTXStore()
+	}
+	if cfg.UTXOStorer == nil {
+		cfg.UTXOStorer = NewMemoryUTXOStore()
 	}
 
-	pool.lock.Lock()
-	defer pool.lock.Unlock()
+	if cfg.Genesis == nil {
+		cfg.Genesis = DefaultGenesis()
+	}
 
-	hash := hex.EncodeToString(types.HashTransaction(tx))
-	pool.txx[hash] = tx
+	chain, err := OpenChainWithGenesis(cfg.Genesis, cfg.BlockStorer, cfg.TXStorer, cfg.UTXOStorer)
+	if err != nil {
+		panic(err)
+	}
 
-	return true
-}
+	if cfg.MaxBlockBytes == 0 {
+		cfg.MaxBlockBytes = DefaultMaxBlockBytes
+	}
 
-// ----------------------------------------------------------------------
+	if cfg.Mempool == nil {
+		mempool := DefaultMempoolConfig()
+		cfg.Mempool = &mempool
+	}
 
-type ServerConfig struct {
-	Version    string
-	ListenAddr string
-	PrivateKey *crypto.PrivateKey
-}
+	if cfg.MaxClockDrift > 0 {
+		chain.SetMaxClockDrift(cfg.MaxClockDrift)
+	}
 
-type Node struct {
-	// listenAddr string
-	// version    string
-	ServerConfig
+	n := &Node{
+		peerList:     make(map[proto.NodeClient]*proto.Version),
+		mempool:      NewMempoolWithConfig(*cfg.Mempool),
+		evidence:     NewEvidencePool(),
+		seenBlocks:   make(map[string]int),
+		chain:        chain,
+		ServerConfig: cfg,
+	}
 
-	peerLock sync.RWMutex
-	peerList map[proto.NodeClient]*proto.Version
+	// Transactions knocked off the active branch go back in line for the next block, and
+	// those a new block confirms come out of it
+	n.chain.OnOrphanedTxs(n.requeue)
+	n.chain.OnBlockConnected(n.mempool.RemoveConfirmed)
 
-	mempool *Mempool
+	// Double signs get punished in the next block we produce
+	n.chain.OnDoubleSign(func(ev *proto.Evidence) {
+		n.evidence.Add(ev)
+	})
 
-	proto.UnimplementedNodeServer
-}
+	if voting, ok := chain.Engine().(consensus.VotingEngine); ok && cfg.PrivateKey != nil {
+		n.voter = voting.NewVoter(&voterBackend{n: n}, cfg.PrivateKey)
+	}
 
-func NewNode(cfg ServerConfig) *Node {
+	return n
+}
 
-	return &Node{
-		peerList:     make(map[proto.NodeClient]*proto.Version),
-		mempool:      NewMempool(),
-		ServerConfig: cfg,
-	}
+func (n *Node) Chain() *Chain {
+	return n.chain
 }
 
 func makeNodeClient(listenAddr string) (proto.NodeClient, error) {
@@ -141,7 +177,9 @@ func (n *Node) Start(bootstrapNodes []string) error {
 		go n.bootstrapNetwork(bootstrapNodes)
 	}
 
-	if n.PrivateKey != nil {
+	if n.voter != nil {
+		n.voter.Start()
+	} else if n.PrivateKey != nil {
 		go n.validatorLoop()
 	}
 
@@ -166,6 +204,10 @@ func (n *Node) addPeer(client proto.NodeClient, nodeDat *proto.Version) {
 	}
 
 	fmt.Printf("\n(%s) - New peer: (%s) - height: (%d)", n.ListenAddr, nodeDat.ListenAddr, nodeDat.Height)
+
+	if int(nodeDat.Height) > n.chain.Height() {
+		go n.syncChain(int(nodeDat.Height))
+	}
 }
 
 // func (n *Node) deletePeer(c proto.NodeClient) {
@@ -189,19 +231,32 @@ func (n *Node) Handshake(ctx context.Context, v *proto.Version) (*proto.Version,
 	return n.getVersion(), nil
 }
 
+// HandleTX takes [tx] into the mempool and passes it on, so long as it could go in the
+// next block and doesn't spend anything a tx already in the pool does. Anything turned
+// away comes back with the reason why.
 func (n *Node) HandleTX(ctx context.Context, tx *proto.Transaction) (*proto.Ack, error) {
 
-	peer, _ := peer.FromContext(ctx)
+	// Peers pass txs back and forth - seen it, nothing more to do
+	if n.mempool.Has(tx) {
+		return &proto.Ack{}, nil
+	}
+
 	hash := hex.EncodeToString(types.HashTransaction(tx))
 
-	if n.mempool.Add(tx) {
+	added, err := n.admit(tx)
+	if err != nil {
+		fmt.Printf("\n*** >>> (%s) rejected [tx] - %v", n.ListenAddr, err)
+		return nil, err
+	}
+
+	if added {
 
-		fmt.Printf("\n*** >>> (%s) received [tx] from peer address: (%s)", n.ListenAddr, peer.Addr)
+		fmt.Printf("\n*** >>> (%s) received [tx] from peer address: (%s)", n.ListenAddr, peerAddr(ctx))
 		fmt.Printf("\n*** >>> [hash] - %s", hash)
 
 		go func() {
 			if err := n.broadcast(tx); err != nil {
-				log.Fatal("\n*** >>> BROADCAST ERROR <<< ***", err)
+				log.Printf("\n*** >>> (%s) failed to broadcast [tx] - %v", n.ListenAddr, err)
 			}
 		}()
 	}
@@ -209,16 +264,164 @@ func (n *Node) HandleTX(ctx context.Context, tx *proto.Transaction) (*proto.Ack,
 	return &proto.Ack{}, nil
 }
 
-func (n *Node) broadcast(msg any) error {
+// admit checks [tx] against the chain and the relay fee, then adds it to the mempool
+func (n *Node) admit(tx *proto.Transaction) (bool, error) {
+
+	fee, err := n.chain.TransactionFee(tx)
+	if err != nil {
+		return false, err
+	}
+
+	size := pb.Size(tx)
+
+	if needed := RelayFee(n.MinRelayFee, size); fee < needed {
+		return false, validationErrorf(CodeLowFee, "tx [%x] pays (%d) - at (%d) bytes it needs (%d) to be relayed",
+			types.HashTransaction(tx), fee, size, needed)
+	}
+
+	return n.mempool.Add(tx, fee)
+}
+
+func (n *Node) HandleBlock(ctx context.Context, b *proto.Block) (*proto.Ack, error) {
+
+	if b.Header == nil {
+		return nil, validationErrorf(CodeMalformed, "block has no header")
+	}
+
+	hash := hex.EncodeToString(types.HashBlock(b))
+
+	if !n.markBlockSeen(hash, int(b.Header.Height)) {
+		return &proto.Ack{}, nil
+	}
+
+	if err := n.chain.AddBlock(b); err != nil {
+
+		n.unmarkBlockSeen(hash)
+
+		// A block from further ahead means we missed some - catch up through sync
+		if int(b.Header.Height) > n.chain.Height()+1 {
+			go n.syncChain(int(b.Header.Height))
+		}
+
+		return nil, err
+	}
+
+	fmt.Printf("\n*** >>> (%s) received [block] from peer address: (%s)", n.ListenAddr, peerAddr(ctx))
+	fmt.Printf("\n*** >>> [hash] - %s || height: (%d)", hash, b.Header.Height)
+
+	go func() {
+		if err := n.broadcast(b); err != nil {
+			log.Printf("\n*** >>> (%s) failed to broadcast block - %v", n.ListenAddr, err)
+		}
+	}()
+
+	return &proto.Ack{}, nil
+}
+
+func (n *Node) GetTxProof(ctx context.Context, req *proto.TxProofRequest) (*proto.TxProof, error) {
+
+	proof, err := n.chain.GetTxProof(req.TxHash, req.BlockHash)
+
+	if errors.Is(err, ErrTxNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return proof, err
+}
+
+// markBlockSeen reports whether the block is new to this node, recording it if so
+func (n *Node) markBlockSeen(hash string, height int) bool {
+
+	n.seenLock.Lock()
+	defer n.seenLock.Unlock()
+
+	if _, ok := n.seenBlocks[hash]; ok {
+		return false
+	}
+
+	n.seenBlocks[hash] = height
+
+	// Forget the blocks that have fallen far enough behind the tip - once every so often,
+	// rather than on every block
+	if tip := n.chain.Height(); tip-n.seenPruned >= seenBlocksDepth {
+
+		for seen, at := range n.seenBlocks {
+			if at < tip-seenBlocksDepth {
+				delete(n.seenBlocks, seen)
+			}
+		}
+
+		n.seenPruned = tip
+	}
+
+	return true
+}
+
+func (n *Node) unmarkBlockSeen(hash string) {
 
+	n.seenLock.Lock()
+	defer n.seenLock.Unlock()
+
+	delete(n.seenBlocks, hash)
+}
+
+func (n *Node) getPeers() []proto.NodeClient {
+
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+
+	peers := make([]proto.NodeClient, 0, len(n.peerList))
 	for peer := range n.peerList {
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// peerAddr is the address of whoever made the call in [ctx] - there's none for a call
+// made in-process
+func peerAddr(ctx context.Context) string {
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+
+	return p.Addr.String()
+}
+
+func (n *Node) broadcast(msg any) error {
+
+	for _, peer := range n.getPeers() {
 
 		switch v := msg.(type) {
 
+		// A peer turning a tx down - for its fee, say - is up to the peer
 		case *proto.Transaction:
-			_, err := peer.HandleTX(context.Background(), v)
-			if err != nil {
-				return err
+			if _, err := peer.HandleTX(context.Background(), v); err != nil {
+				log.Printf("\n*** >>> (%s) peer turned down [tx] - %v", n.ListenAddr, err)
+			}
+
+		case *proto.Block:
+			_, err := peer.HandleBlock(context.Background(), v)
+
+			// A peer that has the block already, or is too far behind to take it yet, is no
+			// failure - and one turning it down mustn't keep it from the rest
+			switch status.Code(err) {
+			case codes.OK, codes.AlreadyExists, codes.FailedPrecondition:
+			default:
+				log.Printf("\n*** >>> (%s) peer turned down [block] - %v", n.ListenAddr, err)
+			}
+
+		// One validator being unreachable mustn't keep the rest from hearing the vote
+		case *proto.Proposal:
+			if _, err := peer.HandleProposal(context.Background(), v); err != nil {
+				log.Printf("\n*** >>> (%s) failed to send proposal - %v", n.ListenAddr, err)
+			}
+
+		case *proto.Vote:
+			if _, err := peer.HandleVote(context.Background(), v); err != nil {
+				log.Printf("\n*** >>> (%s) failed to send vote - %v", n.ListenAddr, err)
 			}
 		}
 	}
@@ -229,15 +432,158 @@ func (n *Node) validatorLoop() {
 
 	fmt.Print("\n**** >>> Starting Validator Loop <<< ***")
 
-	ticker := time.NewTicker(blockTime)
+	ticker := time.NewTicker(proposeTick)
 
 	for {
 		<-ticker.C
 
-		txx := n.mempool.Clear()
+		header, ok := n.prepareHeader(time.Now())
+		if !ok {
+			continue
+		}
+
+		block, err := n.createBlock(header, n.mempool.Template(n.MaxBlockBytes))
+		if err != nil {
+
+			// Someone else's block got there first - start over on top of it
+			if !errors.Is(err, consensus.ErrSealAborted) {
+				log.Printf("\n*** >>> (%s) failed to create block - %v", n.ListenAddr, err)
+			}
+			continue
+		}
+
+		if err := n.chain.AddBlock(block); err != nil {
+			log.Printf("\n*** >>> (%s) failed to add block - %v", n.ListenAddr, err)
+			continue
+		}
+
+		n.markBlockSeen(hex.EncodeToString(types.HashBlock(block)), int(block.Header.Height))
+
+		fmt.Printf("\n*** >>> CREATE NEW BLOCK <<< *** || height: (%d) || lenTx: (%d)", block.Header.Height, len(block.Transactions))
 
-		fmt.Printf("\n*** >>> CREATE NEW BLOCK <<< *** || lenTx: (%d)", len(txx))
+		go func() {
+			if err := n.broadcast(block); err != nil {
+				log.Printf("\n*** >>> (%s) failed to broadcast block - %v", n.ListenAddr, err)
+			}
+		}()
+	}
+}
+
+// requeue puts [txx] back in the mempool if they'd still go in a block - for txs from
+// blocks that dropped off the active branch
+func (n *Node) requeue(txx []*proto.Transaction) {
+	for _, tx := range txx {
+		if fee, err := n.chain.TransactionFee(tx); err == nil {
+			n.mempool.Add(tx, fee)
+		}
+	}
+}
+
+// prepareHeader builds the header for the next block on the current tip - false if the
+// engine won't let this node seal it at [now]
+func (n *Node) prepareHeader(now time.Time) (*proto.Header, bool) {
+
+	parent := n.chain.headers.Last()
+
+	header := &proto.Header{
+		Version:   BlockVersion,
+		Height:    parent.Height + 1,
+		PrevHash:  types.HashHeader(parent),
+		Timestamp: now.UnixNano(),
+	}
+
+	if err := n.chain.Engine().Prepare(n.chain, parent, header, n.PrivateKey.PubKey().Bytes()); err != nil {
+		return nil, false
 	}
+
+	return header, !time.Unix(0, header.Timestamp).After(now)
+}
+
+func (n *Node) createBlock(header *proto.Header, txx []*proto.Transaction) (*proto.Block, error) {
+
+	var (
+		height = int(header.Height)
+		reward = n.chain.Genesis().Subsidy(height)
+		carry  uint64
+		valid  = []*proto.Transaction{nil}
+	)
+
+	// Drop anything the chain would reject so one bad tx can't stall the block
+	for _, tx := range txx {
+
+		fee, err := n.chain.TransactionFee(tx)
+		if err != nil {
+			fmt.Printf("\n*** >>> (%s) dropping invalid [tx] - %v", n.ListenAddr, err)
+			n.mempool.Remove(tx)
+			continue
+		}
+
+		if reward, carry = bits.Add64(reward, fee, 0); carry != 0 {
+			fmt.Printf("\n*** >>> (%s) dropping [tx] - the fees overflow", n.ListenAddr)
+			continue
+		}
+
+		valid = append(valid, tx)
+	}
+
+	// Everything the block is due goes to us, in its coinbase
+	valid[0] = NewCoinbase(height, n.PrivateKey.PubKey().Address().Bytes(), reward)
+
+	engine := n.chain.Engine()
+
+	// Likewise any evidence the chain has moved past - its offender already slashed, or
+	// the double sign too old to punish
+	evidence := n.evidence.Collect(func(ev *proto.Evidence) bool {
+		return n.chain.ValidateEvidence(ev) == nil
+	})
+
+	header.EvidenceHash = types.HashEvidence(evidence)
+
+	block, err := engine.Finalize(n.chain, header, valid)
+	if err != nil {
+		return nil, err
+	}
+
+	block.Evidence = evidence
+
+	moved, stopWatching := n.untilTipMoves(header.PrevHash)
+	defer stopWatching()
+
+	if err := engine.Seal(n.chain, block, n.PrivateKey, moved); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// untilTipMoves returns a channel that's closed once the active branch no longer ends
+// at [tip] - sealing a block on it is wasted effort by then - and a func to stop watching
+func (n *Node) untilTipMoves(tip []byte) (<-chan struct{}, func()) {
+
+	var (
+		moved = make(chan struct{})
+		done  = make(chan struct{})
+	)
+
+	go func() {
+
+		ticker := time.NewTicker(proposeTick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !bytes.Equal(types.HashHeader(n.chain.headers.Last()), tip) {
+					close(moved)
+					return
+				}
+			}
+		}
+	}()
+
+	return moved, func() { close(done) }
 }
 
 // --------------------------------------------------------------------------------------
@@ -297,7 +643,7 @@ func (n *Node) getVersion() *proto.Version {
 	return &proto.Version{
 		ListenAddr: n.ListenAddr,
 		Version:    "blocker-0.1",
-		Height:     0,
+		Height:     int32(n.chain.Height()),
 		PeerList:   n.GetPeerList(),
 	}
 }
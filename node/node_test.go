@@ -0,0 +1,149 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	pb "google.golang.org/protobuf/proto"
+)
+
+// gossipPeer counts the blocks passed on to it
+type gossipPeer struct {
+	proto.NodeClient
+
+	lock   sync.Mutex
+	blocks map[string]int
+}
+
+func (p *gossipPeer) HandleBlock(ctx context.Context, b *proto.Block, opts ...grpc.CallOption) (*proto.Ack, error) {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.blocks[hex.EncodeToString(types.HashBlock(b))]++
+
+	return &proto.Ack{}, nil
+}
+
+func (p *gossipPeer) received(b *proto.Block) int {
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.blocks[hex.EncodeToString(types.HashBlock(b))]
+}
+
+func TestValidatorProducesAndBroadcasts(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		genesis = DefaultGenesis()
+	)
+
+	genesis.Engine = consensus.NewSolo(time.Millisecond * 100)
+
+	var (
+		validator = NewNode(ServerConfig{ListenAddr: freeAddr(t), PrivateKey: privKey, Genesis: genesis})
+		follower  = NewNode(ServerConfig{ListenAddr: freeAddr(t), Genesis: genesis})
+	)
+
+	startNode(t, follower, nil)
+	time.Sleep(time.Millisecond * 200)
+	startNode(t, validator, []string{follower.ListenAddr})
+
+	// The follower has no key of its own - everything it has came from the validator
+	require.Eventually(t, func() bool {
+		return follower.chain.Height() >= 2
+	}, time.Second*10, time.Millisecond*50)
+
+	for height := 1; height <= 2; height++ {
+
+		block, err := follower.chain.GetBlockByHeight(height)
+		require.Nil(t, err)
+
+		require.Equal(t, privKey.PubKey().Bytes(), block.PublicKey)
+		require.True(t, types.VerifyBlock(block))
+
+		require.Equal(t, proto.TxKind_COINBASE, block.Transactions[0].Kind)
+		require.Equal(t, privKey.PubKey().Address().Bytes(), block.Transactions[0].Outputs[0].Address)
+	}
+}
+
+func TestHandleBlockGossipsOnce(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		n       = NewNode(ServerConfig{ListenAddr: freeAddr(t)})
+		peer    = &gossipPeer{blocks: make(map[string]int)}
+	)
+
+	n.addPeer(peer, &proto.Version{ListenAddr: "peer"})
+
+	var (
+		block  = NextBlock(t, n.chain, privKey)
+		forged = pb.Clone(block).(*proto.Block)
+	)
+	forged.Signature = crypto.GeneratePrivateKey().Sign(types.HashBlock(block)).Bytes()
+
+	// Turned down, the block isn't held against the real one - and a call from no peer
+	// at all, like this one, is no trouble
+	_, err := n.HandleBlock(context.Background(), forged)
+	require.NotNil(t, err)
+
+	// Each peer that has the block passes it on to us
+	for i := 0; i < 3; i++ {
+		_, err := n.HandleBlock(context.Background(), block)
+		require.Nil(t, err)
+	}
+
+	require.Equal(t, 1, n.chain.Height())
+	require.Eventually(t, func() bool {
+		return peer.received(block) == 1
+	}, time.Second, time.Millisecond*10)
+
+	time.Sleep(time.Millisecond * 100)
+	require.Equal(t, 1, peer.received(block))
+
+	// Gossip hands it back to us now and then - it goes no further
+	_, err = n.HandleBlock(context.Background(), block)
+	require.Nil(t, err)
+
+	time.Sleep(time.Millisecond * 100)
+	require.Equal(t, 1, peer.received(block))
+}
+
+func TestSeenBlocksArePruned(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		n       = NewNode(ServerConfig{ListenAddr: freeAddr(t)})
+		blocks  = []*proto.Block{}
+	)
+
+	for i := 0; i < seenBlocksDepth*3; i++ {
+		block := NextBlock(t, n.chain, privKey)
+		_, err := n.HandleBlock(context.Background(), block)
+		require.Nil(t, err)
+		blocks = append(blocks, block)
+	}
+
+	n.seenLock.Lock()
+	defer n.seenLock.Unlock()
+
+	// Only what's near the tip is remembered - twice the depth at most, between prunings
+	require.LessOrEqual(t, len(n.seenBlocks), seenBlocksDepth*2+1)
+
+	_, ok := n.seenBlocks[hex.EncodeToString(types.HashBlock(blocks[0]))]
+	require.False(t, ok)
+	_, ok = n.seenBlocks[hex.EncodeToString(types.HashBlock(blocks[len(blocks)-1]))]
+	require.True(t, ok)
+}
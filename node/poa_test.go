@@ -0,0 +1,153 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+var poaTestConfig = consensus.PoAConfig{
+	BlockTime:       time.Second,
+	ProposerTimeout: time.Second,
+}
+
+// blockAt is BlockOn with the timestamp [after] the parent's
+func blockAt(t *testing.T, parent *proto.Block, privKey *crypto.PrivateKey, after time.Duration) *proto.Block {
+
+	block := &proto.Block{
+		Header: &proto.Header{
+			Version:   1,
+			Height:    parent.Header.Height + 1,
+			PrevHash:  types.HashBlock(parent),
+			Timestamp: parent.Header.Timestamp + int64(after),
+		},
+		Transactions: withCoinbase(parent.Header.Height+1, privKey, nil),
+	}
+	types.SignBlock(privKey, block)
+
+	return block
+}
+
+// slotBlockAt is blockAt for the validator in fallback [slot]
+func slotBlockAt(t *testing.T, parent *proto.Block, privKey *crypto.PrivateKey, after time.Duration, slot int) *proto.Block {
+
+	block := blockAt(t, parent, privKey, after)
+	block.Header.Slot = int32(slot)
+	types.SignBlock(privKey, block)
+
+	return block
+}
+
+func TestPoAChainEnforcesSchedule(t *testing.T) {
+
+	genesis, privKeys := testGenesis(consensus.NewPoA(poaTestConfig), 3)
+
+	chain, err := OpenChainWithGenesis(genesis, NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	require.Nil(t, err)
+
+	parent, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	// Height 1 belongs to validator 1 - validator 2 is next in line, validator 0 last
+	require.Equal(t, CodeWrongProposer, CodeOf(chain.AddBlock(blockAt(t, parent, crypto.GeneratePrivateKey(), time.Millisecond))))
+	require.Equal(t, CodeWrongProposer, CodeOf(chain.AddBlock(slotBlockAt(t, parent, privKeys[2], time.Millisecond*999, 1))))
+	require.Equal(t, CodeWrongProposer, CodeOf(chain.AddBlock(slotBlockAt(t, parent, privKeys[0], time.Second, 2))))
+	require.Equal(t, CodeWrongProposer, CodeOf(chain.AddBlock(slotBlockAt(t, parent, privKeys[1], time.Millisecond, 1))))
+	require.Equal(t, 0, chain.Height())
+
+	block := blockAt(t, parent, privKeys[1], time.Millisecond)
+	require.Nil(t, chain.AddBlock(block))
+	parent = block
+
+	// Validator 2 misses height 2 - validator 0 steps in once its slot opens
+	block = slotBlockAt(t, parent, privKeys[0], time.Second, 1)
+	require.Nil(t, chain.AddBlock(block))
+	parent = block
+
+	block = blockAt(t, parent, privKeys[0], time.Second*2)
+	require.Nil(t, chain.AddBlock(block))
+	require.Equal(t, 3, chain.Height())
+	parent = block
+
+	// A fallback block got there first, but the scheduled proposer's outweighs it
+	var (
+		fallback = slotBlockAt(t, parent, privKeys[2], time.Second, 1)
+		inTurn   = blockAt(t, parent, privKeys[1], time.Second*2)
+	)
+
+	require.Greater(t, genesis.Engine.Weight(inTurn.Header), genesis.Engine.Weight(fallback.Header))
+
+	require.Nil(t, chain.AddBlock(fallback))
+	require.Nil(t, chain.AddBlock(inTurn))
+	require.Equal(t, types.HashBlock(inTurn), types.HashHeader(chain.headers.Last()))
+}
+
+func TestProposerTakesItsTurn(t *testing.T) {
+
+	genesis, privKeys := testGenesis(consensus.NewPoA(poaTestConfig), 3)
+
+	nodes := make([]*Node, len(privKeys))
+	for i, privKey := range privKeys {
+		nodes[i] = NewNode(ServerConfig{PrivateKey: privKey, Genesis: genesis})
+	}
+
+	outsider := NewNode(ServerConfig{PrivateKey: crypto.GeneratePrivateKey(), Genesis: genesis})
+
+	var (
+		tip     = time.Unix(0, nodes[0].chain.headers.Last().Timestamp).Add(poaTestConfig.BlockTime)
+		timeout = poaTestConfig.ProposerTimeout
+	)
+
+	turn := func(n *Node, now time.Time) bool {
+		_, ok := n.prepareHeader(now)
+		return ok
+	}
+
+	// Height 1: validator 1, then 2, then 0 as their slots open
+	require.False(t, turn(nodes[1], tip.Add(-time.Millisecond)))
+	require.True(t, turn(nodes[1], tip))
+
+	require.False(t, turn(nodes[2], tip))
+	require.True(t, turn(nodes[2], tip.Add(timeout)))
+
+	require.False(t, turn(nodes[0], tip.Add(timeout)))
+	require.True(t, turn(nodes[0], tip.Add(timeout*2)))
+
+	require.False(t, turn(outsider, tip.Add(time.Hour)))
+
+	// What the proposer makes of its turn goes on the chain
+	header, ok := nodes[1].prepareHeader(tip)
+	require.True(t, ok)
+
+	block, err := nodes[1].createBlock(header, nil)
+	require.Nil(t, err)
+	require.Nil(t, nodes[1].chain.AddBlock(block))
+}
+
+func TestOpenChainRejectsOtherGenesis(t *testing.T) {
+
+	var (
+		genesis, _ = testGenesis(consensus.NewPoA(poaTestConfig), 2)
+		other, _   = testGenesis(consensus.NewPoA(poaTestConfig), 2)
+		bs         = NewMemoryBlockStore()
+		ts         = NewMemoryTXStore()
+		us         = NewMemoryUTXOStore()
+	)
+
+	_, err := OpenChainWithGenesis(genesis, bs, ts, us)
+	require.Nil(t, err)
+
+	_, err = OpenChainWithGenesis(genesis, bs, ts, us)
+	require.Nil(t, err)
+
+	_, err = OpenChainWithGenesis(other, bs, ts, us)
+	require.NotNil(t, err)
+
+	_, err = OpenChain(bs, ts, us)
+	require.NotNil(t, err)
+}
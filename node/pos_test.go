@@ -0,0 +1,213 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+var posTestConfig = consensus.PoSConfig{
+	BlockTime:       time.Second,
+	ProposerTimeout: time.Second,
+	UnbondingPeriod: 3,
+}
+
+// posBlockOn is BlockOn signed by whichever of [privKeys] is first in line on [parent]
+func posBlockOn(t *testing.T, chain *Chain, parent *proto.Block, privKeys []*crypto.PrivateKey, txx ...*proto.Transaction) *proto.Block {
+
+	stakes, err := chain.Stakes(types.HashBlock(parent))
+	require.Nil(t, err)
+
+	proposer := consensus.NewStakeSchedule(stakes, types.HashBlock(parent)).Proposer(0)
+
+	for _, privKey := range privKeys {
+		if bytes.Equal(privKey.PubKey().Bytes(), proposer) {
+			block := blockAt(t, parent, privKey, posTestConfig.BlockTime)
+			block.Transactions = withCoinbase(block.Header.Height, privKey, txx)
+			types.SignBlock(privKey, block)
+			return block
+		}
+	}
+
+	t.Fatalf("no key for proposer [%x]", proposer)
+	return nil
+}
+
+// stakingTX is spendTX for a tx of [kind]
+func stakingTX(privKey *crypto.PrivateKey, kind proto.TxKind, validator []byte, prevTx *proto.Transaction, prevOuts []uint32, amounts ...uint64) *proto.Transaction {
+
+	tx := spendTX(privKey, prevTx, prevOuts, amounts...)
+	tx.Kind = kind
+	tx.Validator = validator
+
+	for _, input := range tx.Inputs {
+		input.Signature = nil
+	}
+
+	sig := types.SignTransaction(privKey, tx).Bytes()
+	for _, input := range tx.Inputs {
+		input.Signature = sig
+	}
+
+	return tx
+}
+
+func stakeOf(t *testing.T, chain *Chain, validator []byte) uint64 {
+
+	stakes, err := chain.Stakes(types.HashHeader(chain.headers.Last()))
+	require.Nil(t, err)
+
+	for _, stake := range stakes {
+		if bytes.Equal(stake.Validator, validator) {
+			return stake.Amount
+		}
+	}
+
+	return 0
+}
+
+func TestPoSBondAndUnbond(t *testing.T) {
+
+	var (
+		genesis, privKeys = testGenesis(consensus.NewPoS(posTestConfig), 2)
+		origin            = crypto.NewPrivateKeyFromString(originSeed)
+		staker            = crypto.GeneratePrivateKey()
+		blockStore        = NewMemoryBlockStore()
+		txStore           = NewMemoryTXStore()
+		utxoStore         = NewMemoryUTXOStore()
+	)
+
+	chain, err := OpenChainWithGenesis(genesis, blockStore, txStore, utxoStore)
+	require.Nil(t, err)
+
+	parent, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	for _, privKey := range privKeys {
+		require.Equal(t, uint64(100), stakeOf(t, chain, privKey.PubKey().Bytes()))
+	}
+
+	// Nothing staked yet, so no turn to propose
+	require.Equal(t, CodeWrongProposer, CodeOf(chain.AddBlock(blockAt(t, parent, staker, time.Hour))))
+
+	// The origin bonds 100 of its coins with the new validator, keeping the rest
+	bondTX := stakingTX(origin, proto.TxKind_BOND, staker.PubKey().Bytes(), parent.Transactions[0], []uint32{0}, 100, 23)
+
+	block := posBlockOn(t, chain, parent, privKeys, bondTX)
+	require.Nil(t, chain.AddBlock(block))
+	parent = block
+
+	require.Equal(t, uint64(100), stakeOf(t, chain, staker.PubKey().Bytes()))
+
+	// A bond can't be spent, only unbonded
+	requireTxError(t, chain.ValidateTransaction(spendTX(origin, bondTX, []uint32{0}, 100)), ErrLockedInput, 0)
+	requireTxError(t, chain.ValidateTransaction(stakingTX(origin, proto.TxKind_UNBOND, nil, bondTX, []uint32{1}, 23)), &ValidationError{Code: CodeBadStaking}, 0)
+
+	signers := append(privKeys, staker)
+
+	unbondTX := stakingTX(origin, proto.TxKind_UNBOND, nil, bondTX, []uint32{0}, 100)
+
+	block = posBlockOn(t, chain, parent, signers, unbondTX)
+	require.Nil(t, chain.AddBlock(block))
+	parent = block
+
+	require.Equal(t, uint64(0), stakeOf(t, chain, staker.PubKey().Bytes()))
+
+	// Unbonded at height 2, so locked until height 5
+	payout := spendTX(origin, unbondTX, []uint32{0}, 100)
+
+	for chain.Height() < 4 {
+		requireTxError(t, chain.ValidateTransaction(payout), ErrLockedInput, 0)
+
+		block = posBlockOn(t, chain, parent, signers)
+		require.Nil(t, chain.AddBlock(block))
+		parent = block
+	}
+
+	require.Nil(t, chain.ValidateTransaction(payout))
+	require.Nil(t, chain.AddBlock(posBlockOn(t, chain, parent, signers, payout)))
+
+	// The stakes replay the same from storage
+	report, err := VerifyDBWithGenesis(genesis, blockStore, txStore, utxoStore, false)
+	require.Nil(t, err)
+	require.True(t, report.OK(), report.String())
+}
+
+func TestStakingNeedsStakingEngine(t *testing.T) {
+
+	var (
+		chain  = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+		origin = crypto.NewPrivateKeyFromString(originSeed)
+	)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	bondTX := stakingTX(origin, proto.TxKind_BOND, origin.PubKey().Bytes(), genesis.Transactions[0], []uint32{0}, 123)
+	requireTxError(t, chain.ValidateTransaction(bondTX), &ValidationError{Code: CodeBadStaking}, -1)
+}
+
+func TestStakeIndexForgetsDeepStates(t *testing.T) {
+
+	var (
+		validator = crypto.GeneratePrivateKey().PubKey().Bytes()
+		blocks    = make(map[string]*proto.Block)
+		hashes    = []string{}
+		parent    []byte
+	)
+
+	// A bond in the first block, nothing after
+	for height := 0; height <= stakeStatesDepth*3; height++ {
+
+		block := &proto.Block{Header: &proto.Header{Version: 1, Height: int32(height), PrevHash: parent}}
+
+		if height == 1 {
+			block.Transactions = []*proto.Transaction{{
+				Version:   1,
+				Kind:      proto.TxKind_BOND,
+				Validator: validator,
+				Outputs:   []*proto.TxOutput{{Amount: 50}},
+			}}
+		}
+
+		parent = types.HashBlock(block)
+		hashes = append(hashes, hex.EncodeToString(parent))
+		blocks[hashes[height]] = block
+	}
+
+	index := newStakeIndex(func(hash string) (*proto.Block, error) {
+		if block, ok := blocks[hash]; ok {
+			return block, nil
+		}
+		return nil, fmt.Errorf("no block [%s]", hash)
+	})
+
+	// Walking up the chain a block at a time, like connecting it
+	for _, hash := range hashes {
+		_, err := index.at(hash)
+		require.Nil(t, err)
+	}
+
+	require.LessOrEqual(t, len(index.states), stakeStatesDepth*2+1)
+	_, ok := index.states[hashes[1]]
+	require.False(t, ok)
+
+	// A state let go is worked out again from the blocks
+	for _, hash := range []string{hashes[1], hashes[len(hashes)-1]} {
+
+		raw, err := hex.DecodeString(hash)
+		require.Nil(t, err)
+
+		stakes, err := index.Stakes(raw)
+		require.Nil(t, err)
+		require.Equal(t, []consensus.Stake{{Validator: validator, Amount: 50}}, stakes)
+	}
+}
@@ -0,0 +1,119 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+// Easy enough to mine in a test - two hashes a block on average - and a short window so
+// the difficulty moves within a handful of blocks
+var powTestConfig = consensus.PoWConfig{
+	BlockTime:      time.Second,
+	RetargetWindow: 3,
+	PowLimit:       0x207fffff,
+}
+
+func powTestChain(t *testing.T) *Chain {
+
+	genesis := &Genesis{Engine: consensus.NewPoW(powTestConfig)}
+
+	chain, err := OpenChainWithGenesis(genesis, NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	require.Nil(t, err)
+
+	return chain
+}
+
+// mineOn mines a block on [parent], [gap] after it
+func mineOn(t *testing.T, chain *Chain, parent *proto.Block, privKey *crypto.PrivateKey, gap time.Duration) *proto.Block {
+
+	engine := chain.Engine()
+
+	header := &proto.Header{
+		Version:   1,
+		Height:    parent.Header.Height + 1,
+		PrevHash:  types.HashBlock(parent),
+		Timestamp: parent.Header.Timestamp + int64(gap),
+	}
+	require.Nil(t, engine.Prepare(chain, parent.Header, header, nil))
+
+	block, err := engine.Finalize(chain, header, withCoinbase(header.Height, privKey, nil))
+	require.Nil(t, err)
+	require.Nil(t, engine.Seal(chain, block, privKey, nil))
+
+	return block
+}
+
+func TestPoWChainChecksWork(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		chain   = powTestChain(t)
+	)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	block := mineOn(t, chain, genesis, privKey, time.Second)
+
+	// Re-signed with a nonce that misses the target
+	unmined := mineOn(t, chain, genesis, privKey, time.Second)
+	for consensus.NewPoW(powTestConfig).VerifyHeader(chain, genesis.Header, unmined.Header, nil) == nil {
+		unmined.Header.Nonce++
+	}
+	types.SignBlock(privKey, unmined)
+	require.Equal(t, CodeInsufficientWork, CodeOf(chain.AddBlock(unmined)))
+
+	// Easier than the limit
+	easier := BlockOn(t, genesis, privKey)
+	easier.Header.Bits = 0x217fffff
+	types.SignBlock(privKey, easier)
+	require.Equal(t, CodeBadDifficulty, CodeOf(chain.AddBlock(easier)))
+
+	require.Nil(t, chain.AddBlock(block))
+	require.Equal(t, 1, chain.Height())
+}
+
+func TestPoWForkChoiceFollowsWork(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		chain   = powTestChain(t)
+	)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	// A long branch of slow blocks, all at the limit
+	parent := genesis
+	for i := 0; i < 5; i++ {
+		parent = mineOn(t, chain, parent, privKey, time.Minute)
+		require.Nil(t, chain.AddBlock(parent))
+	}
+	require.Equal(t, 5, chain.Height())
+
+	// A shorter one whose blocks came quickly enough to push the difficulty up - its last
+	// block alone is worth four of the others
+	var fast []*proto.Block
+
+	parent = genesis
+	for i := 0; i < 4; i++ {
+		parent = mineOn(t, chain, parent, privKey, time.Millisecond)
+		fast = append(fast, parent)
+
+		if i < 3 {
+			require.Nil(t, chain.AddBlock(parent))
+			require.Equal(t, 5, chain.Height())
+		}
+	}
+	require.Equal(t, 4*consensus.Work(powTestConfig.PowLimit), consensus.Work(fast[3].Header.Bits))
+
+	require.Nil(t, chain.AddBlock(fast[3]))
+	require.Equal(t, 4, chain.Height())
+	require.Equal(t, types.HashBlock(fast[3]), types.HashHeader(chain.headers.Last()))
+}
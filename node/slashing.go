@@ -0,0 +1,217 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// ----------------------------------------------------------------------------------
+// Slashing
+//
+// A validator that signs two different blocks at the same height is trying to fork the
+// chain. Anyone who sees both can put the pair in a block as evidence, and the block
+// that does burns everything bonded with the offender and jails it for good - it never
+// proposes again. Only staking engines have stake to take, so only they take evidence.
+
+// maxEvidenceAge is how many blocks back a double sign can still be punished
+const maxEvidenceAge = 100
+
+// checkEvidence makes sure [ev] really is two different headers signed by the same key
+// for the same height
+func checkEvidence(ev *proto.Evidence) error {
+
+	if ev.First == nil || ev.Second == nil || ev.First.Header == nil || ev.Second.Header == nil {
+		return validationErrorf(CodeBadEvidence, "evidence is missing a header")
+	}
+
+	if ev.First.Header.Height != ev.Second.Header.Height {
+		return validationErrorf(CodeBadEvidence, "evidence headers are for different heights (%d) and (%d)",
+			ev.First.Header.Height, ev.Second.Header.Height)
+	}
+
+	if !bytes.Equal(ev.First.PublicKey, ev.Second.PublicKey) {
+		return validationErrorf(CodeBadEvidence, "evidence headers have different signers")
+	}
+
+	if bytes.Equal(types.HashHeader(ev.First.Header), types.HashHeader(ev.Second.Header)) {
+		return validationErrorf(CodeBadEvidence, "evidence is the same header twice")
+	}
+
+	for _, signed := range []*proto.SignedHeader{ev.First, ev.Second} {
+		if !types.VerifyHeader(signed.Header, signed.PublicKey, signed.Signature) {
+			return validationErrorf(CodeBadEvidence, "evidence header [%x] has an invalid signature", types.HashHeader(signed.Header))
+		}
+	}
+
+	return nil
+}
+
+// verifyEvidence checks [evidence] for a block going on top of [parentHash] at [height],
+// against the stakes as of its parent - each offender has to have something left to slash
+func verifyEvidence(engine consensus.Engine, stakes *stakeIndex, evidence []*proto.Evidence, parentHash string, height int) error {
+
+	if len(evidence) == 0 {
+		return nil
+	}
+
+	if _, ok := engine.(consensus.Staking); !ok {
+		return validationErrorf(CodeBadEvidence, "evidence needs a staking engine")
+	}
+
+	state, err := stakes.at(parentHash)
+	if err != nil {
+		return err
+	}
+
+	offenders := make(map[string]bool)
+
+	for _, ev := range evidence {
+
+		if err := checkEvidence(ev); err != nil {
+			return err
+		}
+
+		var (
+			offender = ev.First.PublicKey
+			signedAt = int(ev.First.Header.Height)
+		)
+
+		if signedAt >= height || height-signedAt > maxEvidenceAge {
+			return validationErrorf(CodeBadEvidence, "evidence from height (%d) can't go in a block at height (%d)", signedAt, height)
+		}
+
+		if offenders[string(offender)] {
+			return validationErrorf(CodeBadEvidence, "[%x] is already slashed by this block", offender)
+		}
+		offenders[string(offender)] = true
+
+		if !state.staked(offender) {
+			return validationErrorf(CodeBadEvidence, "[%x] has nothing staked to slash", offender)
+		}
+	}
+
+	return nil
+}
+
+// ----------------------------------------------------------------------------------
+// signedIndex remembers who signed what at each recent height, on any branch, so a
+// second header from the same signer gives it away
+type signedIndex struct {
+	headers map[int32]map[string]*proto.SignedHeader
+}
+
+func newSignedIndex() *signedIndex {
+	return &signedIndex{
+		headers: make(map[int32]map[string]*proto.SignedHeader),
+	}
+}
+
+// record notes [b]'s header and returns the evidence against its signer if it has
+// already signed a different one at the same height
+func (x *signedIndex) record(b *proto.Block) *proto.Evidence {
+
+	var (
+		height = b.Header.Height
+		signer = hex.EncodeToString(b.PublicKey)
+		signed = &proto.SignedHeader{Header: b.Header, PublicKey: b.PublicKey, Signature: b.Signature}
+	)
+
+	// Anything too old to be punished is no use
+	for h := range x.headers {
+		if h+maxEvidenceAge < height {
+			delete(x.headers, h)
+		}
+	}
+
+	atHeight, ok := x.headers[height]
+	if !ok {
+		atHeight = make(map[string]*proto.SignedHeader)
+		x.headers[height] = atHeight
+	}
+
+	prev, ok := atHeight[signer]
+	if !ok {
+		atHeight[signer] = signed
+		return nil
+	}
+
+	if bytes.Equal(types.HashHeader(prev.Header), types.HashHeader(b.Header)) {
+		return nil
+	}
+
+	return &proto.Evidence{First: prev, Second: signed}
+}
+
+// ----------------------------------------------------------------------------------
+// EvidencePool holds double signs waiting to go in a block - one per offender, since
+// one is all it takes
+type EvidencePool struct {
+	lock     sync.Mutex
+	evidence map[string]*proto.Evidence
+}
+
+func NewEvidencePool() *EvidencePool {
+	return &EvidencePool{
+		evidence: make(map[string]*proto.Evidence),
+	}
+}
+
+func (pool *EvidencePool) Add(ev *proto.Evidence) bool {
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	offender := hex.EncodeToString(ev.First.PublicKey)
+
+	if _, ok := pool.evidence[offender]; ok {
+		return false
+	}
+
+	pool.evidence[offender] = ev
+
+	return true
+}
+
+func (pool *EvidencePool) Len() int {
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	return len(pool.evidence)
+}
+
+// Collect returns the evidence [keep] accepts and drops the rest for good - by offender,
+// so the same pool gives the same block
+func (pool *EvidencePool) Collect(keep func(*proto.Evidence) bool) []*proto.Evidence {
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	offenders := make([]string, 0, len(pool.evidence))
+	for offender := range pool.evidence {
+		offenders = append(offenders, offender)
+	}
+	sort.Strings(offenders)
+
+	kept := []*proto.Evidence{}
+
+	for _, offender := range offenders {
+
+		ev := pool.evidence[offender]
+
+		if !keep(ev) {
+			delete(pool.evidence, offender)
+			continue
+		}
+
+		kept = append(kept, ev)
+	}
+
+	return kept
+}
@@ -0,0 +1,213 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+func signedHeader(b *proto.Block) *proto.SignedHeader {
+	return &proto.SignedHeader{Header: b.Header, PublicKey: b.PublicKey, Signature: b.Signature}
+}
+
+// evidenceBlockOn is posBlockOn carrying [evidence]
+func evidenceBlockOn(t *testing.T, chain *Chain, parent *proto.Block, privKeys []*crypto.PrivateKey, evidence ...*proto.Evidence) *proto.Block {
+
+	block := posBlockOn(t, chain, parent, privKeys)
+	block.Evidence = evidence
+
+	for _, privKey := range privKeys {
+		if bytes.Equal(privKey.PubKey().Bytes(), block.PublicKey) {
+			types.SignBlock(privKey, block)
+		}
+	}
+
+	return block
+}
+
+// doubleSign has whoever's first in line on [parent] sign two different blocks for it
+func doubleSign(t *testing.T, chain *Chain, parent *proto.Block, privKeys []*crypto.PrivateKey) (*proto.Block, *proto.Block, *crypto.PrivateKey) {
+
+	var (
+		first  = posBlockOn(t, chain, parent, privKeys)
+		second = posBlockOn(t, chain, parent, privKeys)
+	)
+
+	for _, privKey := range privKeys {
+		if bytes.Equal(privKey.PubKey().Bytes(), first.PublicKey) {
+			second.Header.Timestamp++
+			types.SignBlock(privKey, second)
+			return first, second, privKey
+		}
+	}
+
+	t.Fatalf("no key for proposer [%x]", first.PublicKey)
+	return nil, nil, nil
+}
+
+func bondKey(genesis *proto.Block, validator []byte) string {
+
+	for _, tx := range genesis.Transactions {
+		if tx.Kind == proto.TxKind_BOND && bytes.Equal(tx.Validator, validator) {
+			return fmt.Sprintf("%s_%d", hex.EncodeToString(types.HashTransaction(tx)), 0)
+		}
+	}
+
+	return ""
+}
+
+func TestSlashDoubleSigner(t *testing.T) {
+
+	var (
+		genesis, privKeys = testGenesis(consensus.NewPoS(posTestConfig), 2)
+		blockStore        = NewMemoryBlockStore()
+		txStore           = NewMemoryTXStore()
+		utxoStore         = NewMemoryUTXOStore()
+	)
+
+	chain, err := OpenChainWithGenesis(genesis, blockStore, txStore, utxoStore)
+	require.Nil(t, err)
+
+	var evidence []*proto.Evidence
+	chain.OnDoubleSign(func(ev *proto.Evidence) {
+		evidence = append(evidence, ev)
+	})
+
+	genesisBlock, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	first, second, offender := doubleSign(t, chain, genesisBlock, privKeys)
+
+	// Both are fine on their own - it's only the pair that gives the signer away
+	require.Nil(t, chain.AddBlock(first))
+	require.Empty(t, evidence)
+	require.Nil(t, chain.AddBlock(second))
+	require.Len(t, evidence, 1)
+	require.Nil(t, chain.ValidateEvidence(evidence[0]))
+
+	var (
+		offenderKey = offender.PubKey().Bytes()
+		bond        = bondKey(genesisBlock, offenderKey)
+	)
+
+	block := evidenceBlockOn(t, chain, first, privKeys, evidence[0])
+	require.Nil(t, chain.AddBlock(block))
+
+	// Everything it had at stake is gone, and so is its place in line
+	require.Equal(t, uint64(0), stakeOf(t, chain, offenderKey))
+
+	utxo, err := utxoStore.Get(bond)
+	require.Nil(t, err)
+	require.True(t, utxo.Spent)
+
+	require.Equal(t, CodeWrongProposer, CodeOf(chain.AddBlock(blockAt(t, block, offender, time.Hour))))
+	require.Equal(t, CodeBadEvidence, CodeOf(chain.ValidateEvidence(evidence[0])))
+
+	// The slashing replays the same from storage
+	report, err := VerifyDBWithGenesis(genesis, blockStore, txStore, utxoStore, false)
+	require.Nil(t, err)
+	require.True(t, report.OK(), report.String())
+
+	// Disconnecting the block gives the bond back
+	_, err = chain.DisconnectTip()
+	require.Nil(t, err)
+
+	require.Equal(t, uint64(100), stakeOf(t, chain, offenderKey))
+
+	utxo, err = utxoStore.Get(bond)
+	require.Nil(t, err)
+	require.False(t, utxo.Spent)
+}
+
+func TestEvidenceRejected(t *testing.T) {
+
+	genesis, privKeys := testGenesis(consensus.NewPoS(posTestConfig), 2)
+
+	chain, err := OpenChainWithGenesis(genesis, NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	require.Nil(t, err)
+
+	genesisBlock, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	first, second, offender := doubleSign(t, chain, genesisBlock, privKeys)
+	require.Nil(t, chain.AddBlock(first))
+
+	var (
+		valid    = &proto.Evidence{First: signedHeader(first), Second: signedHeader(second)}
+		stranger = crypto.GeneratePrivateKey()
+		forged   = signedHeader(second)
+	)
+
+	forged.Signature = bytes.Clone(forged.Signature)
+	forged.Signature[0] ^= 0xff
+
+	// Another validator's header for the same height
+	var honest *proto.Block
+	for _, privKey := range privKeys {
+		if privKey != offender {
+			honest = blockAt(t, genesisBlock, privKey, time.Hour)
+		}
+	}
+
+	// Headers for the next height, by the offender and by someone with nothing staked
+	var (
+		next      = blockAt(t, first, offender, time.Hour)
+		nextTwin  = blockAt(t, first, offender, time.Hour*2)
+		unstaked  = blockAt(t, genesisBlock, stranger, time.Hour)
+		unstaked2 = blockAt(t, genesisBlock, stranger, time.Hour*2)
+	)
+
+	cases := map[string][]*proto.Evidence{
+		"missing header":   {{First: signedHeader(first)}},
+		"same header":      {{First: signedHeader(first), Second: signedHeader(first)}},
+		"different height": {{First: signedHeader(first), Second: signedHeader(next)}},
+		"different signer": {{First: signedHeader(first), Second: signedHeader(honest)}},
+		"bad signature":    {{First: signedHeader(first), Second: forged}},
+		"too new":          {{First: signedHeader(next), Second: signedHeader(nextTwin)}},
+		"twice":            {valid, valid},
+		"nothing staked":   {{First: signedHeader(unstaked), Second: signedHeader(unstaked2)}},
+	}
+
+	for name, evidence := range cases {
+		block := evidenceBlockOn(t, chain, first, privKeys, evidence...)
+		require.Equal(t, CodeBadEvidence, CodeOf(chain.AddBlock(block)), name)
+	}
+
+	// Evidence the header doesn't commit to
+	block := evidenceBlockOn(t, chain, first, privKeys, valid)
+	block.Evidence = nil
+	require.Equal(t, CodeBadEvidence, CodeOf(chain.AddBlock(block)))
+
+	require.Nil(t, chain.AddBlock(evidenceBlockOn(t, chain, first, privKeys, valid)))
+}
+
+func TestEvidenceNeedsStakingEngine(t *testing.T) {
+
+	var (
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+		privKey = crypto.GeneratePrivateKey()
+	)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	var (
+		first  = BlockOn(t, genesis, privKey)
+		second = blockAt(t, genesis, privKey, time.Hour)
+	)
+	require.Nil(t, chain.AddBlock(first))
+
+	block := BlockOn(t, first, privKey)
+	block.Evidence = []*proto.Evidence{{First: signedHeader(first), Second: signedHeader(second)}}
+	types.SignBlock(privKey, block)
+
+	require.Equal(t, CodeBadEvidence, CodeOf(chain.AddBlock(block)))
+}
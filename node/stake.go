@@ -0,0 +1,280 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// ----------------------------------------------------------------------------------
+// The stake behind each validator as of a given block, built up from the bonding and
+// unbonding transactions on the block's branch. Bonds are kept by the output holding
+// them, so an unbond only has to name the outputs it spends.
+
+type bond struct {
+	validator []byte
+	amount    uint64
+}
+
+// stakeState never changes once built - a block with no staking in it shares its
+// parent's
+type stakeState struct {
+	bonds map[string]bond
+
+	// validators slashed for double signing - anything bonded with them since doesn't count
+	jailed map[string]bool
+}
+
+func newStakeState() *stakeState {
+	return &stakeState{
+		bonds:  make(map[string]bond),
+		jailed: make(map[string]bool),
+	}
+}
+
+func (s *stakeState) clone() *stakeState {
+
+	next := &stakeState{
+		bonds:  make(map[string]bond, len(s.bonds)),
+		jailed: make(map[string]bool, len(s.jailed)),
+	}
+
+	for key, bond := range s.bonds {
+		next.bonds[key] = bond
+	}
+	for validator := range s.jailed {
+		next.jailed[validator] = true
+	}
+
+	return next
+}
+
+// apply moves the state on past [b] - its transactions first, then its evidence. The
+// bonds the evidence slashes come back too, in the order they're to be forfeited.
+func (s *stakeState) apply(b *proto.Block) (*stakeState, []string) {
+
+	var (
+		next      = s
+		forfeited []string
+	)
+
+	for _, tx := range b.Transactions {
+
+		if tx.Kind != proto.TxKind_BOND && tx.Kind != proto.TxKind_UNBOND {
+			continue
+		}
+
+		if next == s {
+			next = s.clone()
+		}
+
+		switch tx.Kind {
+		case proto.TxKind_BOND:
+			if len(tx.Outputs) > 0 {
+				key := fmt.Sprintf("%s_%d", hex.EncodeToString(types.HashTransaction(tx)), 0)
+				next.bonds[key] = bond{validator: tx.Validator, amount: tx.Outputs[0].Amount}
+			}
+		case proto.TxKind_UNBOND:
+			for _, input := range tx.Inputs {
+				delete(next.bonds, inputKey(input))
+			}
+		}
+	}
+
+	for _, ev := range b.Evidence {
+
+		if next == s {
+			next = s.clone()
+		}
+
+		offender := ev.First.PublicKey
+		next.jailed[string(offender)] = true
+
+		keys := []string{}
+		for key, bond := range next.bonds {
+			if bytes.Equal(bond.validator, offender) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			delete(next.bonds, key)
+		}
+
+		forfeited = append(forfeited, keys...)
+	}
+
+	return next, forfeited
+}
+
+// staked reports whether [validator] has anything bonded that counts
+func (s *stakeState) staked(validator []byte) bool {
+
+	if s.jailed[string(validator)] {
+		return false
+	}
+
+	for _, bond := range s.bonds {
+		if bytes.Equal(bond.validator, validator) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stakes totals the bonds by validator
+func (s *stakeState) stakes() []consensus.Stake {
+
+	totals := make(map[string]uint64)
+
+	for _, bond := range s.bonds {
+		if !s.jailed[string(bond.validator)] {
+			totals[string(bond.validator)] += bond.amount
+		}
+	}
+
+	stakes := make([]consensus.Stake, 0, len(totals))
+
+	for validator, amount := range totals {
+		stakes = append(stakes, consensus.Stake{Validator: []byte(validator), Amount: amount})
+	}
+
+	sort.Slice(stakes, func(i, j int) bool {
+		return bytes.Compare(stakes[i].Validator, stakes[j].Validator) < 0
+	})
+
+	return stakes
+}
+
+// ----------------------------------------------------------------------------------
+// stakeIndex works out the stake as of any stored block, on any branch - a block's
+// state is kept once worked out, so each block near the top of the chain only gets
+// looked at once. States too far below the highest block are let go; asking for one
+// again just works it out afresh from the blocks.
+type stakeIndex struct {
+	lock     sync.Mutex
+	getBlock func(hash string) (*proto.Block, error)
+	states   map[string]stakeEntry
+
+	// The highest block worked out so far, and how high it was at the last pruning
+	top    int
+	pruned int
+}
+
+type stakeEntry struct {
+	state  *stakeState
+	height int
+}
+
+// How far below the highest block stake states are kept
+const stakeStatesDepth = 1000
+
+func newStakeIndex(getBlock func(hash string) (*proto.Block, error)) *stakeIndex {
+	return &stakeIndex{
+		getBlock: getBlock,
+		states:   make(map[string]stakeEntry),
+	}
+}
+
+func (x *stakeIndex) Stakes(hash []byte) ([]consensus.Stake, error) {
+
+	state, err := x.at(hex.EncodeToString(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	return state.stakes(), nil
+}
+
+func (x *stakeIndex) at(hash string) (*stakeState, error) {
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	var (
+		state   *stakeState
+		pending []*proto.Block
+	)
+
+	// Walk back to the nearest block already worked out - or to genesis
+	for it := hash; state == nil; {
+
+		if known, ok := x.states[it]; ok {
+			state = known.state
+			break
+		}
+
+		b, err := x.getBlock(it)
+		if err != nil {
+			return nil, fmt.Errorf("no stakes for block [%s]: %v", it, err)
+		}
+
+		pending = append(pending, b)
+
+		if len(b.Header.PrevHash) == 0 {
+			state = newStakeState()
+			break
+		}
+
+		it = hex.EncodeToString(b.Header.PrevHash)
+	}
+
+	for i := len(pending) - 1; i >= 0; i-- {
+
+		height := int(pending[i].Header.Height)
+
+		state, _ = state.apply(pending[i])
+		x.states[hex.EncodeToString(types.HashBlock(pending[i]))] = stakeEntry{state: state, height: height}
+		x.top = max(x.top, height)
+	}
+
+	// Once every so often, rather than on every block
+	if x.top-x.pruned >= stakeStatesDepth {
+
+		for hash, entry := range x.states {
+			if entry.height < x.top-stakeStatesDepth {
+				delete(x.states, hash)
+			}
+		}
+
+		x.pruned = x.top
+	}
+
+	return state, nil
+}
+
+// forfeited lists the bonds [b] slashes on top of [parentHash] - [b] needn't be stored yet
+func (x *stakeIndex) forfeited(parentHash string, b *proto.Block) ([]string, error) {
+
+	if len(b.Evidence) == 0 {
+		return nil, nil
+	}
+
+	parent, err := x.at(parentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	_, forfeited := parent.apply(b)
+
+	return forfeited, nil
+}
+
+// stakeView pairs a view of the headers with the stakes behind them, for checking
+// blocks outside of a Chain
+type stakeView struct {
+	consensus.ChainReader
+	stakes *stakeIndex
+}
+
+func (v *stakeView) Stakes(hash []byte) ([]consensus.Stake, error) {
+	return v.stakes.Stakes(hash)
+}
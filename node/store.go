@@ -13,6 +13,8 @@ import (
 type UTXOStorer interface {
 	Put(*UTXO) error
 	Get(string) (*UTXO, error)
+	Delete(string) error
+	ForEach(func(*UTXO) error) error
 }
 
 type MemoryUTXOStore struct {
@@ -44,9 +46,37 @@ func (s *MemoryUTXOStore) Put(utxo *UTXO) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	key := fmt.Sprintf("%s_%d", utxo.Hash, utxo.OutIndex)
+	s.data[utxo.Key()] = utxo
 
-	s.data[key] = utxo
+	return nil
+}
+
+func (s *MemoryUTXOStore) Delete(hash string) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.data, hash)
+
+	return nil
+}
+
+func (s *MemoryUTXOStore) ForEach(fn func(*UTXO) error) error {
+
+	s.lock.RLock()
+
+	utxos := make([]*UTXO, 0, len(s.data))
+	for _, utxo := range s.data {
+		utxos = append(utxos, utxo)
+	}
+
+	s.lock.RUnlock()
+
+	for _, utxo := range utxos {
+		if err := fn(utxo); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -100,16 +130,27 @@ func (s *MemoryTXStore) Put(tx *proto.Transaction) error {
 type BlockStorer interface {
 	PutBlock(*proto.Block) error
 	GetBlock(string) (*proto.Block, error)
+	PutUndo(string, *BlockUndo) error
+	GetUndo(string) (*BlockUndo, error)
+
+	// The tip of the active branch - empty until the first block goes in
+	SetTip(string) error
+	GetTip() (string, error)
+
+	ForEachBlock(func(*proto.Block) error) error
 }
 
 type MemoryBlockStore struct {
 	lock   sync.RWMutex
 	blocks map[string]*proto.Block
+	undo   map[string]*BlockUndo
+	tip    string
 }
 
 func NewMemoryBlockStore() *MemoryBlockStore {
 	return &MemoryBlockStore{
 		blocks: make(map[string]*proto.Block),
+		undo:   make(map[string]*BlockUndo),
 	}
 }
 
@@ -137,3 +178,123 @@ func (s *MemoryBlockStore) GetBlock(hash string) (*proto.Block, error) {
 
 	return block, nil
 }
+
+func (s *MemoryBlockStore) PutUndo(hash string, undo *BlockUndo) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.undo[hash] = undo
+
+	return nil
+}
+
+func (s *MemoryBlockStore) GetUndo(hash string) (*BlockUndo, error) {
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	undo, ok := s.undo[hash]
+
+	if !ok {
+		return nil, fmt.Errorf("failed to get undo record for block [%s]", hash)
+	}
+
+	return undo, nil
+}
+
+func (s *MemoryBlockStore) SetTip(hash string) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.tip = hash
+
+	return nil
+}
+
+func (s *MemoryBlockStore) GetTip() (string, error) {
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.tip, nil
+}
+
+func (s *MemoryBlockStore) ForEachBlock(fn func(*proto.Block) error) error {
+
+	s.lock.RLock()
+
+	blocks := make([]*proto.Block, 0, len(s.blocks))
+	for _, block := range s.blocks {
+		blocks = append(blocks, block)
+	}
+
+	s.lock.RUnlock()
+
+	for _, block := range blocks {
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ------------------------------------------------------------------------
+// memoryBatchWriter commits a batch to a set of memory stores atomically - everything
+// is keyed up front, then swapped in while holding all three locks, so no reader ever
+// sees half a batch and there's nothing left that can fail part way through
+type memoryBatchWriter struct {
+	blocks *MemoryBlockStore
+	txs    *MemoryTXStore
+	utxos  *MemoryUTXOStore
+}
+
+func (w *memoryBatchWriter) WriteBatch(b *Batch) error {
+
+	blocks := make(map[string]*proto.Block, len(b.blocks))
+	for _, block := range b.blocks {
+		blocks[hex.EncodeToString(types.HashBlock(block))] = block
+	}
+
+	txs := make(map[string]*proto.Transaction, len(b.txs))
+	for _, tx := range b.txs {
+		txs[hex.EncodeToString(types.HashTransaction(tx))] = tx
+	}
+
+	// Always taken in this order
+	w.blocks.lock.Lock()
+	defer w.blocks.lock.Unlock()
+	w.txs.lock.Lock()
+	defer w.txs.lock.Unlock()
+	w.utxos.lock.Lock()
+	defer w.utxos.lock.Unlock()
+
+	for hash, tx := range txs {
+		w.txs.txx[hash] = tx
+	}
+
+	for hash, block := range blocks {
+		w.blocks.blocks[hash] = block
+	}
+
+	for hash, undo := range b.undo {
+		w.blocks.undo[hash] = undo
+	}
+
+	for _, key := range b.utxoKeys {
+
+		if utxo := b.utxoState[key]; utxo != nil {
+			w.utxos.data[key] = utxo
+		} else {
+			delete(w.utxos.data, key)
+		}
+	}
+
+	if b.tip != "" {
+		w.blocks.tip = b.tip
+	}
+
+	return nil
+}
@@ -0,0 +1,344 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// --------------------------------------------------------------
+const (
+	maxHeadersPerRequest = 500
+	maxBlocksPerRequest  = 16
+	maxBlockRequests     = 4
+	syncRequestTimeout   = time.Second * 30
+)
+
+// --------------------------------------------------------------
+// Server side of the sync protocol
+
+func (n *Node) GetHeaders(ctx context.Context, req *proto.HeadersRequest) (*proto.Headers, error) {
+
+	from := int(req.FromHeight)
+	count := int(req.Count)
+
+	if from < 0 {
+		return nil, fmt.Errorf("invalid start height (%d)", from)
+	}
+	if count <= 0 || count > maxHeadersPerRequest {
+		count = maxHeadersPerRequest
+	}
+
+	res := &proto.Headers{}
+
+	for height := from; height < from+count && height <= n.chain.Height(); height++ {
+
+		block, err := n.chain.GetBlockByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Headers = append(res.Headers, &proto.SignedHeader{
+			Header:    block.Header,
+			PublicKey: block.PublicKey,
+			Signature: block.Signature,
+		})
+	}
+
+	return res, nil
+}
+
+func (n *Node) GetBlocks(req *proto.BlocksRequest, stream proto.Node_GetBlocksServer) error {
+
+	if len(req.Hashes) > maxBlocksPerRequest {
+		return fmt.Errorf("too many blocks requested (%d) - max: (%d)", len(req.Hashes), maxBlocksPerRequest)
+	}
+
+	for _, hash := range req.Hashes {
+
+		block, err := n.chain.GetBlockByHash(hash)
+		if err != nil {
+			return err
+		}
+
+		if err := stream.Send(block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------
+// Client side of the sync protocol
+//
+// Sync runs headers-first against the tallest known peer: a batch of headers is pulled
+// and its linkage checked against our tip, then the bodies are fetched from every peer
+// tall enough to serve them and applied in order. Repeats until the peer runs dry.
+//
+// A peer on another branch won't link to our tip - we back off down our own chain until
+// its headers link up, and download its branch from the fork. The chain switches over
+// once that branch outweighs ours.
+
+// syncChain catches up with the network - [minHeight] lets a caller that has seen
+// a taller block force a sync even when the handshake heights are stale
+func (n *Node) syncChain(minHeight int) {
+
+	if !n.syncLock.TryLock() {
+		return
+	}
+	defer n.syncLock.Unlock()
+
+	peer, peerHeight := n.tallestPeer()
+
+	if peer == nil {
+		return
+	}
+	if peerHeight < minHeight {
+		peerHeight = minHeight
+	}
+	if peerHeight <= n.chain.Height() {
+		return
+	}
+
+	fmt.Printf("\n*** >>> (%s) syncing - local height: (%d) || peer height: (%d)", n.ListenAddr, n.chain.Height(), peerHeight)
+
+	parent := n.chain.headers.Last()
+
+	for {
+		headers, err := n.downloadHeaders(peer, parent)
+
+		// The peer is on another branch - back off until we find where it forked from ours
+		for back := 1; errors.Is(err, errHeadersFork); back *= 2 {
+
+			if parent.Height == 0 {
+				err = fmt.Errorf("peer does not share our genesis block")
+				break
+			}
+
+			if parent, err = n.chain.headers.Get(max(0, n.chain.Height()-back)); err == nil {
+				headers, err = n.downloadHeaders(peer, parent)
+			}
+		}
+		if err != nil {
+			log.Printf("\n*** >>> (%s) header download failed - %v", n.ListenAddr, err)
+			return
+		}
+
+		if len(headers) == 0 {
+			break
+		}
+
+		if err := n.downloadBlocks(peer, headers); err != nil {
+			log.Printf("\n*** >>> (%s) block download failed - %v", n.ListenAddr, err)
+			return
+		}
+
+		if len(headers) < maxHeadersPerRequest {
+			break
+		}
+
+		parent = headers[len(headers)-1]
+	}
+
+	fmt.Printf("\n*** >>> (%s) sync complete - height: (%d)", n.ListenAddr, n.chain.Height())
+}
+
+func (n *Node) tallestPeer() (proto.NodeClient, int) {
+
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+
+	var (
+		tallest proto.NodeClient
+		height  = -1
+	)
+
+	for client, version := range n.peerList {
+		if int(version.Height) > height {
+			tallest = client
+			height = int(version.Height)
+		}
+	}
+
+	return tallest, height
+}
+
+// peersAtHeight returns every peer that advertised at least [height], falling back to [fallback]
+func (n *Node) peersAtHeight(height int, fallback proto.NodeClient) []proto.NodeClient {
+
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+
+	peers := []proto.NodeClient{}
+	for client, version := range n.peerList {
+		if int(version.Height) >= height {
+			peers = append(peers, client)
+		}
+	}
+
+	if len(peers) == 0 {
+		peers = append(peers, fallback)
+	}
+
+	return peers
+}
+
+// downloadHeaders fetches the next batch of headers after [parent] and checks that
+// they form a signed, unbroken chain on top of it - [errHeadersFork] if the first one
+// doesn't link to it at all
+func (n *Node) downloadHeaders(peer proto.NodeClient, parent *proto.Header) ([]*proto.Header, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncRequestTimeout)
+	defer cancel()
+
+	res, err := peer.GetHeaders(ctx, &proto.HeadersRequest{
+		FromHeight: parent.Height + 1,
+		Count:      maxHeadersPerRequest,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		headers    = []*proto.Header{}
+		prevHash   = types.HashHeader(parent)
+		prevHeight = parent.Height
+	)
+
+	for i, sh := range res.Headers {
+
+		if sh.Header == nil {
+			return nil, fmt.Errorf("peer sent an empty header")
+		}
+		if sh.Header.Height != prevHeight+1 {
+			return nil, fmt.Errorf("header height (%d) does not follow (%d)", sh.Header.Height, prevHeight)
+		}
+		if !bytes.Equal(sh.Header.PrevHash, prevHash) {
+			if i == 0 {
+				return nil, errHeadersFork
+			}
+			return nil, fmt.Errorf("header at height (%d) does not link to its parent", sh.Header.Height)
+		}
+		if !types.VerifyHeader(sh.Header, sh.PublicKey, sh.Signature) {
+			return nil, fmt.Errorf("header at height (%d) has an invalid signature", sh.Header.Height)
+		}
+
+		headers = append(headers, sh.Header)
+
+		prevHash = types.HashHeader(sh.Header)
+		prevHeight = sh.Header.Height
+	}
+
+	return headers, nil
+}
+
+// downloadBlocks fetches the bodies for [headers] in parallel and applies them in order
+func (n *Node) downloadBlocks(fallback proto.NodeClient, headers []*proto.Header) error {
+
+	var (
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, maxBlockRequests)
+		blocks = make([]*proto.Block, len(headers))
+		errs   = make(chan error, (len(headers)/maxBlocksPerRequest)+1)
+	)
+
+	it := 0
+
+	for start := 0; start < len(headers); start += maxBlocksPerRequest {
+
+		end := start + maxBlocksPerRequest
+		if end > len(headers) {
+			end = len(headers)
+		}
+
+		// Spread the requests over every peer that can serve the whole range
+		peers := n.peersAtHeight(int(headers[end-1].Height), fallback)
+		peer := peers[it%len(peers)]
+		it++
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(peer proto.NodeClient, start, end int) {
+
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := n.fetchBlocks(peer, headers, blocks, start, end); err != nil {
+				errs <- err
+			}
+
+		}(peer, start, end)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	for _, block := range blocks {
+
+		hash := types.HashBlock(block)
+
+		// Gossip may have delivered some of these while we were downloading
+		if n.chain.HasBlock(hash) {
+			continue
+		}
+
+		if err := n.chain.AddBlock(block); err != nil {
+			return err
+		}
+
+		n.markBlockSeen(hex.EncodeToString(hash), int(block.Header.Height))
+	}
+
+	return nil
+}
+
+// fetchBlocks fills blocks[start:end] with the bodies matching headers[start:end]
+func (n *Node) fetchBlocks(peer proto.NodeClient, headers []*proto.Header, blocks []*proto.Block, start, end int) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncRequestTimeout)
+	defer cancel()
+
+	req := &proto.BlocksRequest{}
+	for i := start; i < end; i++ {
+		req.Hashes = append(req.Hashes, types.HashHeader(headers[i]))
+	}
+
+	stream, err := peer.GetBlocks(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for i := start; i < end; i++ {
+
+		block, err := stream.Recv()
+		if err == io.EOF {
+			return fmt.Errorf("peer closed the stream after (%d) of (%d) blocks", i-start, end-start)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(types.HashBlock(block), req.Hashes[i-start]) {
+			return fmt.Errorf("block at height (%d) does not match its header", headers[i].Height)
+		}
+
+		blocks[i] = block
+	}
+
+	return nil
+}
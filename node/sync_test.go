@@ -0,0 +1,130 @@
+package node
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+func freeAddr(t *testing.T) string {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func startNode(t *testing.T, n *Node, bootstrapNodes []string) {
+
+	go func() {
+		if err := n.Start(bootstrapNodes); err != nil {
+			t.Error(err)
+		}
+	}()
+}
+
+func TestSyncFromTallestPeer(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		nBlocks = maxBlocksPerRequest*3 + 5
+
+		origin = NewNode(ServerConfig{ListenAddr: freeAddr(t)})
+		joiner = NewNode(ServerConfig{ListenAddr: freeAddr(t)})
+	)
+
+	for i := 0; i < nBlocks; i++ {
+		require.Nil(t, origin.chain.AddBlock(NextBlock(t, origin.chain, privKey)))
+	}
+
+	startNode(t, origin, nil)
+	time.Sleep(time.Millisecond * 200)
+	startNode(t, joiner, []string{origin.ListenAddr})
+
+	require.Eventually(t, func() bool {
+		return joiner.chain.Height() == nBlocks
+	}, time.Second*10, time.Millisecond*50)
+
+	for i := 0; i <= nBlocks; i++ {
+		want, err := origin.chain.GetBlockByHeight(i)
+		require.Nil(t, err)
+		have, err := joiner.chain.GetBlockByHeight(i)
+		require.Nil(t, err)
+		require.Equal(t, types.HashBlock(want), types.HashBlock(have))
+	}
+}
+
+func TestSyncSwitchesToHeavierBranch(t *testing.T) {
+
+	var (
+		lighter = NewNode(ServerConfig{ListenAddr: freeAddr(t)})
+		heavier = NewNode(ServerConfig{ListenAddr: freeAddr(t)})
+		shared  = crypto.GeneratePrivateKey()
+	)
+
+	// A few blocks in common, then each goes its own way - the lighter branch taller than
+	// the point the two forked at, so sync can't just pick up from its tip
+	for i := 0; i < 3; i++ {
+		b := NextBlock(t, lighter.chain, shared)
+		require.Nil(t, lighter.chain.AddBlock(b))
+		require.Nil(t, heavier.chain.AddBlock(b))
+	}
+
+	for _, branch := range []struct {
+		n      *Node
+		blocks int
+	}{{lighter, 6}, {heavier, 9}} {
+		privKey := crypto.GeneratePrivateKey()
+		for i := 0; i < branch.blocks; i++ {
+			require.Nil(t, branch.n.chain.AddBlock(NextBlock(t, branch.n.chain, privKey)))
+		}
+	}
+
+	startNode(t, heavier, nil)
+	time.Sleep(time.Millisecond * 200)
+	startNode(t, lighter, []string{heavier.ListenAddr})
+
+	require.Eventually(t, func() bool {
+		return lighter.chain.Height() == heavier.chain.Height()
+	}, time.Second*10, time.Millisecond*50)
+
+	for i := 0; i <= heavier.chain.Height(); i++ {
+		want, err := heavier.chain.GetBlockByHeight(i)
+		require.Nil(t, err)
+		have, err := lighter.chain.GetBlockByHeight(i)
+		require.Nil(t, err)
+		require.Equal(t, types.HashBlock(want), types.HashBlock(have))
+	}
+}
+
+func TestGetHeadersCapsCount(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		n       = NewNode(ServerConfig{ListenAddr: ":0"})
+	)
+
+	for i := 0; i < 10; i++ {
+		require.Nil(t, n.chain.AddBlock(NextBlock(t, n.chain, privKey)))
+	}
+
+	res, err := n.GetHeaders(context.Background(), &proto.HeadersRequest{FromHeight: 4, Count: 3})
+	require.Nil(t, err)
+	require.Len(t, res.Headers, 3)
+	require.Equal(t, int32(4), res.Headers[0].Header.Height)
+
+	res, err = n.GetHeaders(context.Background(), &proto.HeadersRequest{FromHeight: 8, Count: 100})
+	require.Nil(t, err)
+	require.Len(t, res.Headers, 3)
+
+	for _, sh := range res.Headers {
+		require.True(t, types.VerifyHeader(sh.Header, sh.PublicKey, sh.Signature))
+	}
+}
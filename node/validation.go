@@ -0,0 +1,285 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// ------------------------------------------------------------------------
+// TxError ties a validation failure to the transaction - and input - it came from
+type TxError struct {
+	TxHash string
+	Input  int // -1 if the failure isn't down to a single input
+	Err    error
+}
+
+func (e *TxError) Error() string {
+
+	if e.Input < 0 {
+		return fmt.Sprintf("tx [%s]: %v", e.TxHash, e.Err)
+	}
+
+	return fmt.Sprintf("tx [%s] input (%d): %v", e.TxHash, e.Input, e.Err)
+}
+
+func (e *TxError) Unwrap() error {
+	return e.Err
+}
+
+// utxoReader is where validation looks up the outputs being spent - the UTXO store, or
+// a batch staged on top of it mid-reorg
+type utxoReader interface {
+	Get(string) (*UTXO, error)
+}
+
+// validateTransactions checks the transactions of [b], to be connected at [height] - and
+// that it has a coinbase, claiming no more than the block is due
+func (c *Chain) validateTransactions(b *proto.Block, utxos utxoReader, height int) error {
+
+	var (
+		// Every output spent so far in the block, so a second tx can't spend it again
+		spent = make(map[string]bool)
+
+		coinbase *proto.Transaction
+		fees     uint64
+		carry    uint64
+	)
+
+	for i, tx := range b.Transactions {
+
+		if tx.Kind == proto.TxKind_COINBASE {
+
+			fail := func(err error) error {
+				return &TxError{TxHash: hex.EncodeToString(types.HashTransaction(tx)), Input: -1, Err: err}
+			}
+
+			if i > 0 {
+				return fail(validationErrorf(CodeBadCoinbase, "coinbase is transaction (%d) of the block, not the first", i))
+			}
+
+			if err := checkCoinbase(b, tx, height); err != nil {
+				return fail(err)
+			}
+
+			coinbase = tx
+			continue
+		}
+
+		fee, err := c.validateTransaction(tx, utxos, height)
+		if err != nil {
+			return err
+		}
+
+		if fees, carry = bits.Add64(fees, fee, 0); carry != 0 {
+			return &TxError{TxHash: hex.EncodeToString(types.HashTransaction(tx)), Input: -1, Err: ErrAmountOverflow}
+		}
+
+		for i, input := range tx.Inputs {
+
+			key := inputKey(input)
+
+			if spent[key] {
+				return &TxError{TxHash: hex.EncodeToString(types.HashTransaction(tx)), Input: i, Err: ErrDoubleSpend}
+			}
+
+			spent[key] = true
+		}
+	}
+
+	if coinbase == nil {
+		return validationErrorf(CodeBadCoinbase, "block has no coinbase")
+	}
+
+	due, carry := bits.Add64(c.genesis.Subsidy(height), fees, 0)
+	if carry != 0 {
+		due = math.MaxUint64
+	}
+
+	if claimed := coinbase.Outputs[0].Amount; claimed > due {
+		return &TxError{
+			TxHash: hex.EncodeToString(types.HashTransaction(coinbase)),
+			Input:  -1,
+			Err:    validationErrorf(CodeBadCoinbase, "coinbase claims (%d) - the block is only due (%d)", claimed, due),
+		}
+	}
+
+	return nil
+}
+
+// ValidateTransaction checks [tx] could go in the next block
+func (c *Chain) ValidateTransaction(tx *proto.Transaction) error {
+	_, err := c.TransactionFee(tx)
+	return err
+}
+
+// TransactionFee checks [tx] could go in the next block, like ValidateTransaction, and
+// works out the fee it leaves for the proposer
+func (c *Chain) TransactionFee(tx *proto.Transaction) (uint64, error) {
+	return c.validateTransaction(tx, c.utxoStore, c.Height()+1)
+}
+
+// validateTransaction checks [tx] against [utxos] for a block at [height], and returns its fee
+func (c *Chain) validateTransaction(tx *proto.Transaction, utxos utxoReader, height int) (uint64, error) {
+
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+
+	fail := func(input int, err error) (uint64, error) {
+		return 0, &TxError{TxHash: hash, Input: input, Err: err}
+	}
+
+	if !types.VerifyTransaction(tx) {
+		return fail(-1, ErrBadSignature)
+	}
+
+	if err := c.validateKind(tx); err != nil {
+		return fail(-1, err)
+	}
+
+	unbondingPeriod := 0
+	if staking, ok := c.engine.(consensus.Staking); ok {
+		unbondingPeriod = staking.UnbondingPeriod()
+	}
+
+	var (
+		seen      = make(map[string]bool)
+		sumInputs uint64
+		carry     uint64
+	)
+
+	for i, input := range tx.Inputs {
+
+		key := inputKey(input)
+
+		if seen[key] {
+			return fail(i, ErrDuplicateInput)
+		}
+		seen[key] = true
+
+		utxo, err := utxos.Get(key)
+		if err != nil {
+			return fail(i, ErrUnknownInput)
+		}
+
+		if utxo.Spent {
+			return fail(i, ErrSpentInput)
+		}
+
+		if !ownsOutput(input.PubKey, utxo) {
+			return fail(i, ErrNotOwner)
+		}
+
+		// Bonded outputs can only be unbonded, and only bonded outputs can be
+		bonded := len(utxo.Validator) > 0
+
+		if bonded && tx.Kind != proto.TxKind_UNBOND {
+			return fail(i, ErrLockedInput)
+		}
+
+		if !bonded && tx.Kind == proto.TxKind_UNBOND {
+			return fail(i, validationErrorf(CodeBadStaking, "unbond spends an output that isn't bonded"))
+		}
+
+		if utxo.UnbondedAt > 0 && height < utxo.UnbondedAt+unbondingPeriod {
+			return fail(i, validationErrorf(CodeLockedInput, "output is unbonding until height (%d)", utxo.UnbondedAt+unbondingPeriod))
+		}
+
+		if utxo.MintedAt > 0 && height < utxo.MintedAt+c.genesis.CoinbaseMaturity {
+			return fail(i, validationErrorf(CodeLockedInput, "coinbase output matures at height (%d)", utxo.MintedAt+c.genesis.CoinbaseMaturity))
+		}
+
+		if sumInputs, carry = bits.Add64(sumInputs, utxo.Amount, 0); carry != 0 {
+			return fail(i, ErrAmountOverflow)
+		}
+	}
+
+	var sumOutputs uint64
+
+	for _, output := range tx.Outputs {
+		if sumOutputs, carry = bits.Add64(sumOutputs, output.Amount, 0); carry != 0 {
+			return fail(-1, ErrAmountOverflow)
+		}
+	}
+
+	if sumInputs < sumOutputs {
+		return fail(-1, ErrInsufficientFunds)
+	}
+
+	return sumInputs - sumOutputs, nil
+}
+
+// validateKind checks [tx] is put together the way its kind calls for
+func (c *Chain) validateKind(tx *proto.Transaction) error {
+
+	// Only a coinbase mints coins - everything else has to spend something
+	if tx.Kind == proto.TxKind_COINBASE {
+		return validationErrorf(CodeBadCoinbase, "a coinbase only goes first in a block")
+	}
+
+	if len(tx.Inputs) == 0 {
+		return validationErrorf(CodeMalformed, "transaction has no inputs")
+	}
+
+	if tx.Height != 0 {
+		return validationErrorf(CodeMalformed, "only a coinbase has a height")
+	}
+
+	if tx.Kind == proto.TxKind_TRANSFER {
+
+		if len(tx.Validator) > 0 {
+			return validationErrorf(CodeBadStaking, "transfer names a validator")
+		}
+
+		return nil
+	}
+
+	if _, ok := c.engine.(consensus.Staking); !ok {
+		return validationErrorf(CodeBadStaking, "%s transactions need a staking engine", tx.Kind)
+	}
+
+	switch tx.Kind {
+
+	case proto.TxKind_BOND:
+
+		if len(tx.Outputs) == 0 || tx.Outputs[0].Amount == 0 {
+			return validationErrorf(CodeBadStaking, "bond has nothing to stake")
+		}
+
+		if _, err := crypto.PubKeyFromBytes(tx.Validator); err != nil {
+			return validationErrorf(CodeBadStaking, "bond names an invalid validator key")
+		}
+
+	case proto.TxKind_UNBOND:
+
+		if len(tx.Validator) > 0 {
+			return validationErrorf(CodeBadStaking, "unbond names a validator")
+		}
+
+	default:
+		return validationErrorf(CodeBadStaking, "unknown transaction kind (%d)", tx.Kind)
+	}
+
+	return nil
+}
+
+func inputKey(input *proto.TxInput) string {
+	return fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
+}
+
+// ownsOutput checks the address [pubKey] hashes to is the one [utxo] was paid to
+func ownsOutput(pubKey []byte, utxo *UTXO) bool {
+
+	key, err := crypto.PubKeyFromBytes(pubKey)
+	if err != nil || len(utxo.Address) == 0 {
+		return false
+	}
+
+	return bytes.Equal(key.Address().Bytes(), utxo.Address)
+}
@@ -0,0 +1,146 @@
+package node
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+// spendTX builds a tx signed by [privKey] spending [prevOuts] of [prevTx] into [amounts],
+// all paid back to [privKey]'s address
+func spendTX(privKey *crypto.PrivateKey, prevTx *proto.Transaction, prevOuts []uint32, amounts ...uint64) *proto.Transaction {
+
+	tx := &proto.Transaction{Version: 1}
+
+	for _, index := range prevOuts {
+		tx.Inputs = append(tx.Inputs, &proto.TxInput{
+			PrevTxHash:   types.HashTransaction(prevTx),
+			PrevOutIndex: index,
+			PubKey:       privKey.PubKey().Bytes(),
+		})
+	}
+
+	for _, amount := range amounts {
+		tx.Outputs = append(tx.Outputs, &proto.TxOutput{
+			Amount:  amount,
+			Address: privKey.PubKey().Address().Bytes(),
+		})
+	}
+
+	sig := types.SignTransaction(privKey, tx).Bytes()
+	for _, input := range tx.Inputs {
+		input.Signature = sig
+	}
+
+	return tx
+}
+
+// splitChain is a chain whose tip splits the genesis output into two owned by the origin key
+func splitChain(t *testing.T) (*Chain, *crypto.PrivateKey, *proto.Transaction) {
+
+	var (
+		privKey = crypto.NewPrivateKeyFromString(originSeed)
+		chain   = NewChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore())
+	)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	split := spendTX(privKey, genesis.Transactions[0], []uint32{0}, 100, 23)
+	require.Nil(t, chain.AddBlock(BlockOn(t, genesis, privKey, split)))
+
+	return chain, privKey, split
+}
+
+func requireTxError(t *testing.T, err error, want error, input int) {
+
+	require.True(t, errors.Is(err, want), "expected %v, got %v", want, err)
+
+	var txErr *TxError
+	require.True(t, errors.As(err, &txErr))
+	require.Equal(t, input, txErr.Input)
+}
+
+func TestValidateTransactionUsesPrevOutIndex(t *testing.T) {
+
+	chain, privKey, split := splitChain(t)
+
+	// Output 1 spent from input 0 - looking it up by input position would find output 0
+	tx := spendTX(privKey, split, []uint32{1}, 23)
+	require.Nil(t, chain.ValidateTransaction(tx))
+
+	tx = spendTX(privKey, split, []uint32{1}, 24)
+	requireTxError(t, chain.ValidateTransaction(tx), ErrInsufficientFunds, -1)
+
+	tx = spendTX(privKey, split, []uint32{2}, 1)
+	requireTxError(t, chain.ValidateTransaction(tx), ErrUnknownInput, 0)
+
+	// Both outputs at once, in either order
+	tx = spendTX(privKey, split, []uint32{1, 0}, 123)
+	require.Nil(t, chain.ValidateTransaction(tx))
+}
+
+func TestValidateTransactionChecksOwnership(t *testing.T) {
+
+	chain, _, split := splitChain(t)
+
+	// Properly signed, but by a key the output wasn't paid to
+	thief := crypto.GeneratePrivateKey()
+	tx := spendTX(thief, split, []uint32{0}, 100)
+
+	requireTxError(t, chain.ValidateTransaction(tx), ErrNotOwner, 0)
+}
+
+func TestValidateTransactionRejectsSpentInput(t *testing.T) {
+
+	chain, privKey, _ := splitChain(t)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	tx := spendTX(privKey, genesis.Transactions[0], []uint32{0}, 123)
+	requireTxError(t, chain.ValidateTransaction(tx), ErrSpentInput, 0)
+}
+
+func TestValidateTransactionRejectsDuplicateInputs(t *testing.T) {
+
+	chain, privKey, split := splitChain(t)
+
+	tx := spendTX(privKey, split, []uint32{0, 1, 0}, 200)
+	requireTxError(t, chain.ValidateTransaction(tx), ErrDuplicateInput, 2)
+}
+
+func TestValidateTransactionRejectsOverflow(t *testing.T) {
+
+	chain, privKey, split := splitChain(t)
+
+	// Outputs that wrap around to less than the inputs
+	tx := spendTX(privKey, split, []uint32{0}, math.MaxUint64, 2)
+	requireTxError(t, chain.ValidateTransaction(tx), ErrAmountOverflow, -1)
+}
+
+func TestAddBlockRejectsDoubleSpendWithinBlock(t *testing.T) {
+
+	chain, privKey, split := splitChain(t)
+
+	var (
+		first  = spendTX(privKey, split, []uint32{0}, 100)
+		second = spendTX(privKey, split, []uint32{0}, 99)
+	)
+
+	// Each is fine on its own
+	require.Nil(t, chain.ValidateTransaction(first))
+	require.Nil(t, chain.ValidateTransaction(second))
+
+	tip, err := chain.GetBlockByHeight(chain.Height())
+	require.Nil(t, err)
+
+	err = chain.AddBlock(BlockOn(t, tip, privKey, first, second))
+	requireTxError(t, err, ErrDoubleSpend, 0)
+	require.Equal(t, 1, chain.Height())
+}
@@ -0,0 +1,407 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/i101dev/blocker/consensus"
+	"github.com/i101dev/blocker/proto"
+	"github.com/i101dev/blocker/types"
+)
+
+// ------------------------------------------------------------------------
+// Startup consistency check
+//
+// VerifyDB rebuilds the active branch from storage and checks it block by block from
+// genesis: linkage, signatures, and that it replays cleanly onto an empty UTXO set. The
+// replayed set is then compared against what the UTXO store actually holds. With
+// [repair] set, the stores are brought back in line with the longest good prefix of the
+// branch - a broken tip is cut off, the UTXO set rewritten, missing undo records and
+// transactions restored.
+
+type VerifyReport struct {
+	StoredTip string // tip hash as recorded in storage
+	TipHash   string // tip of the verified branch
+	TipHeight int
+	Blocks    int // blocks verified on the active branch
+	UTXOs     int // entries in the replayed UTXO set
+
+	// Height of the first block that failed verification, -1 if none did
+	BrokenAt  int
+	Truncated int // blocks past the last good one
+
+	MissingUTXOs    []string
+	UnexpectedUTXOs []string
+	MismatchedUTXOs []string
+	MissingUndo     []string
+	MissingTXs      []string
+
+	Problems []string
+	Repaired bool
+}
+
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) String() string {
+
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "stored tip:    %s\n", r.StoredTip)
+	fmt.Fprintf(&sb, "verified tip:  %s (height %d)\n", r.TipHash, r.TipHeight)
+	fmt.Fprintf(&sb, "blocks:        %d\n", r.Blocks)
+	fmt.Fprintf(&sb, "utxos:         %d\n", r.UTXOs)
+
+	if r.BrokenAt >= 0 {
+		fmt.Fprintf(&sb, "broken at:     %d (%d blocks past the last good one)\n", r.BrokenAt, r.Truncated)
+	}
+
+	fmt.Fprintf(&sb, "utxo diff:     %d missing, %d unexpected, %d mismatched\n", len(r.MissingUTXOs), len(r.UnexpectedUTXOs), len(r.MismatchedUTXOs))
+	fmt.Fprintf(&sb, "missing undo:  %d\n", len(r.MissingUndo))
+	fmt.Fprintf(&sb, "missing txs:   %d\n", len(r.MissingTXs))
+
+	for _, p := range r.Problems {
+		fmt.Fprintf(&sb, "  - %s\n", p)
+	}
+
+	switch {
+	case r.OK():
+		sb.WriteString("status:        OK\n")
+	case r.Repaired:
+		sb.WriteString("status:        REPAIRED\n")
+	default:
+		sb.WriteString("status:        CORRUPT\n")
+	}
+
+	return sb.String()
+}
+
+func (r *VerifyReport) problem(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// VerifyDB checks a store of the default, open chain
+func VerifyDB(bs BlockStorer, ts TXStorer, us UTXOStorer, repair bool) (*VerifyReport, error) {
+	return VerifyDBWithGenesis(DefaultGenesis(), bs, ts, us, repair)
+}
+
+// VerifyDBWithGenesis checks the store belongs to the chain started by [genesis], with
+// every block signed by whoever's turn it was
+func VerifyDBWithGenesis(genesis *Genesis, bs BlockStorer, ts TXStorer, us UTXOStorer, repair bool) (*VerifyReport, error) {
+
+	report := &VerifyReport{BrokenAt: -1}
+
+	storedTip, err := bs.GetTip()
+	if err != nil {
+		return nil, err
+	}
+
+	report.StoredTip = storedTip
+
+	// Nothing stored yet - a fresh chain will be started from genesis
+	if storedTip == "" {
+		return report, nil
+	}
+
+	branch, err := loadBranch(bs, storedTip)
+
+	if err != nil {
+		report.problem("stored tip [%s] is unreachable: %v", storedTip, err)
+
+		if branch, err = heaviestStoredBranch(genesis, bs); err != nil {
+			return nil, err
+		}
+	}
+
+	replay, good := verifyBranch(report, genesis, bs, ts, branch)
+
+	if good == 0 {
+		return report, fmt.Errorf("genesis block is missing or corrupt - storage can't be repaired")
+	}
+
+	report.Blocks = good
+	report.TipHeight = good - 1
+	report.TipHash = hex.EncodeToString(types.HashBlock(branch[good-1]))
+	report.Truncated = len(branch) - good
+
+	if report.TipHash != storedTip && report.BrokenAt < 0 {
+		report.problem("stored tip [%s] differs from the recovered tip", storedTip)
+	}
+
+	if err := diffUTXOs(report, replay.utxos, us); err != nil {
+		return nil, err
+	}
+
+	if !repair || report.OK() {
+		return report, nil
+	}
+
+	if err := repairDB(report, replay, bs, ts, us); err != nil {
+		return report, fmt.Errorf("repair failed: %v", err)
+	}
+
+	report.Repaired = true
+
+	return report, nil
+}
+
+// heaviestStoredBranch finds the branch the fork choice would pick among all stored blocks
+func heaviestStoredBranch(genesis *Genesis, bs BlockStorer) ([]*proto.Block, error) {
+
+	genesisBlock := genesis.Block()
+	genesisHash := hex.EncodeToString(types.HashBlock(genesisBlock))
+
+	if _, err := bs.GetBlock(genesisHash); err != nil {
+		return nil, fmt.Errorf("genesis block is missing: %v", err)
+	}
+
+	c := &Chain{
+		blockStore: bs,
+		tree:       NewBlockTree(genesis.engine().Weight),
+	}
+
+	c.tree.Insert(genesisBlock.Header, nil)
+
+	if err := c.loadSideBranches(); err != nil {
+		return nil, err
+	}
+
+	var heaviest *blockNode
+
+	c.tree.lock.RLock()
+	for _, node := range c.tree.nodes {
+		if heaviest == nil || node.weight > heaviest.weight {
+			heaviest = node
+		}
+	}
+	c.tree.lock.RUnlock()
+
+	return loadBranch(bs, heaviest.hash)
+}
+
+type replayState struct {
+	blocks *MemoryBlockStore
+	txs    *MemoryTXStore
+	utxos  *MemoryUTXOStore
+}
+
+// verifyBranch replays [branch] from genesis and returns how many blocks made it through
+func verifyBranch(report *VerifyReport, genesis *Genesis, bs BlockStorer, ts TXStorer, branch []*proto.Block) (*replayState, int) {
+
+	replay := &replayState{
+		blocks: NewMemoryBlockStore(),
+		txs:    NewMemoryTXStore(),
+		utxos:  NewMemoryUTXOStore(),
+	}
+
+	var (
+		genesisHeader = genesis.Block().Header
+		genesisHash   = types.HashHeader(genesisHeader)
+		engine        = genesis.engine()
+		index         = newHeaderIndex(genesisHeader)
+		reader        = &stakeView{ChainReader: index, stakes: newStakeIndex(replay.blocks.GetBlock)}
+	)
+
+	for i, b := range branch {
+
+		hash := types.HashBlock(b)
+
+		fail := func(format string, args ...any) (*replayState, int) {
+			report.BrokenAt = i
+			report.problem("block [%x] at height (%d): %s", hash, i, fmt.Sprintf(format, args...))
+			return replay, i
+		}
+
+		if b.Header == nil {
+			return fail("missing header")
+		}
+
+		if i == 0 && !bytes.Equal(hash, genesisHash) {
+			return fail("not the genesis block")
+		}
+
+		if i > 0 && !bytes.Equal(b.Header.PrevHash, types.HashBlock(branch[i-1])) {
+			return fail("does not link to its parent")
+		}
+
+		if !types.VerifyHeader(b.Header, b.PublicKey, b.Signature) {
+			return fail("invalid signature")
+		}
+
+		if !types.VerifyRootHash(b) {
+			return fail("merkle root does not match the transactions")
+		}
+
+		if !types.VerifyEvidenceHash(b) {
+			return fail("evidence hash does not match the evidence")
+		}
+
+		if i > 0 {
+
+			timestamps := []int64{}
+			for _, prev := range branch[max(0, i-medianTimeSpan):i] {
+				timestamps = append(timestamps, prev.Header.Timestamp)
+			}
+
+			if err := checkHeader(b.Header, i-1, medianTime(timestamps)); err != nil {
+				return fail("%v", err)
+			}
+
+			if err := engine.VerifyHeader(reader, branch[i-1].Header, b.Header, b.PublicKey); err != nil {
+				return fail("%v", err)
+			}
+
+			if finality, ok := engine.(consensus.Finality); ok {
+				if err := finality.VerifyCommit(index, b); err != nil {
+					return fail("%v", err)
+				}
+			}
+
+			if err := verifyEvidence(engine, reader.stakes, b.Evidence, hex.EncodeToString(b.Header.PrevHash), i); err != nil {
+				return fail("%v", err)
+			}
+
+			index.Add(b.Header)
+		}
+
+		forfeited, err := reader.stakes.forfeited(hex.EncodeToString(b.Header.PrevHash), b)
+		if err != nil {
+			return fail("does not replay: %v", err)
+		}
+
+		view := &batchView{batch: NewBatch(), blockStore: replay.blocks, utxoStore: replay.utxos}
+
+		if err := stageConnect(view, b, i, forfeited); err != nil {
+			return fail("does not replay: %v", err)
+		}
+
+		if err := commitBatch(replay.blocks, replay.txs, replay.utxos, view.batch); err != nil {
+			return fail("does not replay: %v", err)
+		}
+
+		hashHex := hex.EncodeToString(hash)
+
+		if _, err := bs.GetUndo(hashHex); err != nil {
+			report.MissingUndo = append(report.MissingUndo, hashHex)
+			report.problem("block [%s] has no undo record", hashHex)
+		}
+
+		for _, tx := range b.Transactions {
+
+			txHash := hex.EncodeToString(types.HashTransaction(tx))
+
+			if _, err := ts.Get(txHash); err != nil {
+				report.MissingTXs = append(report.MissingTXs, txHash)
+				report.problem("tx [%s] is missing", txHash)
+			}
+		}
+	}
+
+	return replay, len(branch)
+}
+
+func diffUTXOs(report *VerifyReport, expected *MemoryUTXOStore, us UTXOStorer) error {
+
+	seen := make(map[string]bool)
+
+	err := us.ForEach(func(utxo *UTXO) error {
+
+		key := utxo.Key()
+		seen[key] = true
+
+		want, err := expected.Get(key)
+		if err != nil {
+			report.UnexpectedUTXOs = append(report.UnexpectedUTXOs, key)
+			return nil
+		}
+
+		if !sameUTXO(want, utxo) {
+			report.MismatchedUTXOs = append(report.MismatchedUTXOs, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = expected.ForEach(func(utxo *UTXO) error {
+		report.UTXOs++
+		if !seen[utxo.Key()] {
+			report.MissingUTXOs = append(report.MissingUTXOs, utxo.Key())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(report.MissingUTXOs)
+	sort.Strings(report.UnexpectedUTXOs)
+	sort.Strings(report.MismatchedUTXOs)
+
+	if n := len(report.MissingUTXOs) + len(report.UnexpectedUTXOs) + len(report.MismatchedUTXOs); n > 0 {
+		report.problem("utxo set differs from the replayed chain in (%d) entries", n)
+	}
+
+	return nil
+}
+
+func sameUTXO(a, b *UTXO) bool {
+	return a.Hash == b.Hash &&
+		a.OutIndex == b.OutIndex &&
+		a.Amount == b.Amount &&
+		bytes.Equal(a.Address, b.Address) &&
+		a.Spent == b.Spent &&
+		bytes.Equal(a.Validator, b.Validator) &&
+		a.UnbondedAt == b.UnbondedAt &&
+		a.MintedAt == b.MintedAt
+}
+
+// repairDB brings the stores in line with [branch] in a single batch
+func repairDB(report *VerifyReport, replay *replayState, bs BlockStorer, ts TXStorer, us UTXOStorer) error {
+
+	batch := NewBatch()
+
+	for _, key := range append(report.MissingUTXOs, report.MismatchedUTXOs...) {
+
+		utxo, err := replay.utxos.Get(key)
+		if err != nil {
+			return err
+		}
+
+		batch.PutUTXO(utxo)
+	}
+
+	for _, key := range report.UnexpectedUTXOs {
+		batch.DeleteUTXO(key)
+	}
+
+	for _, hash := range report.MissingUndo {
+
+		undo, err := replay.blocks.GetUndo(hash)
+		if err != nil {
+			return err
+		}
+
+		batch.PutUndo(hash, undo)
+	}
+
+	for _, hash := range report.MissingTXs {
+
+		tx, err := replay.txs.Get(hash)
+		if err != nil {
+			return err
+		}
+
+		batch.PutTx(tx)
+	}
+
+	batch.SetTip(report.TipHash)
+
+	return commitBatch(bs, ts, us, batch)
+}
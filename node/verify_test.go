@@ -0,0 +1,175 @@
+package node
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/types"
+	"github.com/stretchr/testify/require"
+)
+
+// verifyTestChain builds a short chain with a spend of the genesis output in the tip
+func verifyTestChain(t *testing.T) (*Chain, *MemoryBlockStore, *MemoryTXStore, *MemoryUTXOStore) {
+
+	var (
+		privKey = crypto.NewPrivateKeyFromString(originSeed)
+		blocks  = NewMemoryBlockStore()
+		txs     = NewMemoryTXStore()
+		utxos   = NewMemoryUTXOStore()
+		chain   = NewChain(blocks, txs, utxos)
+	)
+
+	for i := 0; i < 5; i++ {
+		require.Nil(t, chain.AddBlock(NextBlock(t, chain, privKey)))
+	}
+
+	block := NextBlock(t, chain, privKey)
+	block.Transactions = append(block.Transactions, genesisSpendTX(t, chain, 100))
+	types.SignBlock(privKey, block)
+	require.Nil(t, chain.AddBlock(block))
+
+	return chain, blocks, txs, utxos
+}
+
+func TestVerifyDBCleanChain(t *testing.T) {
+
+	chain, blocks, txs, utxos := verifyTestChain(t)
+
+	report, err := VerifyDB(blocks, txs, utxos, false)
+	require.Nil(t, err)
+	require.True(t, report.OK(), report.String())
+	require.Equal(t, chain.Height(), report.TipHeight)
+	require.Equal(t, chain.Height()+1, report.Blocks)
+	require.Equal(t, -1, report.BrokenAt)
+	require.Equal(t, len(snapshotUTXOs(utxos)), report.UTXOs)
+}
+
+func TestVerifyDBRepairsUTXOSet(t *testing.T) {
+
+	chain, blocks, txs, utxos := verifyTestChain(t)
+	before := snapshotUTXOs(utxos)
+
+	tip, err := chain.GetBlockByHeight(chain.Height())
+	require.Nil(t, err)
+
+	var (
+		spendKey   = fmt.Sprintf("%x_0", types.HashTransaction(tip.Transactions[1]))
+		genesisKey = fmt.Sprintf("%x_0", tip.Transactions[1].Inputs[0].PrevTxHash)
+	)
+
+	require.Nil(t, utxos.Delete(spendKey))
+	require.Nil(t, utxos.Put(&UTXO{Hash: "ff", OutIndex: 0, Amount: 1}))
+
+	// The genesis output coming back unspent
+	spent, err := utxos.Get(genesisKey)
+	require.Nil(t, err)
+	tampered := *spent
+	tampered.Spent = false
+	require.Nil(t, utxos.Put(&tampered))
+
+	report, err := VerifyDB(blocks, txs, utxos, false)
+	require.Nil(t, err)
+	require.False(t, report.OK())
+	require.False(t, report.Repaired)
+	require.Equal(t, []string{spendKey}, report.MissingUTXOs)
+	require.Equal(t, []string{"ff_0"}, report.UnexpectedUTXOs)
+	require.Equal(t, []string{genesisKey}, report.MismatchedUTXOs)
+
+	report, err = VerifyDB(blocks, txs, utxos, true)
+	require.Nil(t, err)
+	require.True(t, report.Repaired)
+	require.Equal(t, before, snapshotUTXOs(utxos))
+
+	report, err = VerifyDB(blocks, txs, utxos, false)
+	require.Nil(t, err)
+	require.True(t, report.OK(), report.String())
+}
+
+func TestVerifyDBTruncatesBrokenTip(t *testing.T) {
+
+	chain, blocks, txs, utxos := verifyTestChain(t)
+
+	var (
+		privKey  = crypto.NewPrivateKeyFromString(originSeed)
+		goodTip  = chain.tip.hash
+		badBlock = NextBlock(t, chain, privKey)
+	)
+
+	// A block that made it to storage with a mangled signature, and a tip pointing at it
+	badBlock.Signature[0] ^= 0xff
+	require.Nil(t, blocks.PutBlock(badBlock))
+	require.Nil(t, blocks.SetTip(hex.EncodeToString(types.HashBlock(badBlock))))
+
+	report, err := VerifyDB(blocks, txs, utxos, true)
+	require.Nil(t, err)
+	require.Equal(t, chain.Height()+1, report.BrokenAt)
+	require.Equal(t, 1, report.Truncated)
+	require.Equal(t, goodTip, report.TipHash)
+	require.True(t, report.Repaired)
+
+	stored, err := blocks.GetTip()
+	require.Nil(t, err)
+	require.Equal(t, goodTip, stored)
+
+	reopened, err := OpenChain(blocks, txs, utxos)
+	require.Nil(t, err)
+	require.Equal(t, chain.Height(), reopened.Height())
+}
+
+func TestVerifyDBRecoversMissingTip(t *testing.T) {
+
+	chain, blocks, txs, utxos := verifyTestChain(t)
+
+	tip, err := chain.GetBlockByHeight(chain.Height())
+	require.Nil(t, err)
+	tipHash := hex.EncodeToString(types.HashBlock(tip))
+
+	// The tip record points at a block that never made it
+	require.Nil(t, blocks.SetTip("deadbeef"))
+
+	report, err := VerifyDB(blocks, txs, utxos, true)
+	require.Nil(t, err)
+	require.True(t, report.Repaired)
+	require.Equal(t, tipHash, report.TipHash)
+	require.Equal(t, chain.Height(), report.TipHeight)
+
+	stored, err := blocks.GetTip()
+	require.Nil(t, err)
+	require.Equal(t, tipHash, stored)
+}
+
+func TestVerifyDBRestoresUndoAndTXs(t *testing.T) {
+
+	chain, blocks, txs, utxos := verifyTestChain(t)
+
+	tip, err := chain.GetBlockByHeight(chain.Height())
+	require.Nil(t, err)
+
+	var (
+		tipHash = hex.EncodeToString(types.HashBlock(tip))
+		txHash  = hex.EncodeToString(types.HashTransaction(tip.Transactions[0]))
+	)
+
+	blocks.lock.Lock()
+	delete(blocks.undo, tipHash)
+	blocks.lock.Unlock()
+
+	txs.lock.Lock()
+	delete(txs.txx, txHash)
+	txs.lock.Unlock()
+
+	report, err := VerifyDB(blocks, txs, utxos, true)
+	require.Nil(t, err)
+	require.Equal(t, []string{tipHash}, report.MissingUndo)
+	require.Equal(t, []string{txHash}, report.MissingTXs)
+	require.True(t, report.Repaired)
+
+	_, err = txs.Get(txHash)
+	require.Nil(t, err)
+
+	// The restored undo record is good enough to take the block back off
+	_, err = chain.DisconnectTip()
+	require.Nil(t, err)
+}
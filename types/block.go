@@ -3,27 +3,24 @@ package types
 import (
 	"bytes"
 	"crypto/sha256"
-	"fmt"
 
-	"github.com/cbergoon/merkletree"
 	"github.com/i101dev/blocker/crypto"
 	"github.com/i101dev/blocker/proto"
 
 	pb "google.golang.org/protobuf/proto"
 )
 
-func SignBlock(pk *crypto.PrivateKey, block *proto.Block) *crypto.Signature {
-
-	if len(block.Transactions) > 0 {
-
-		tree, err := GetMerkleTree(block)
+// EmptyRootHash is the merkle root of a block with no transactions - sha256 of nothing -
+// so even an empty block's header commits to its body
+var EmptyRootHash = func() []byte {
+	h := sha256.Sum256(nil)
+	return h[:]
+}()
 
-		if err != nil {
-			panic(err)
-		}
+func SignBlock(pk *crypto.PrivateKey, block *proto.Block) *crypto.Signature {
 
-		block.Header.RootHash = tree.MerkleRoot()
-	}
+	block.Header.RootHash = CalculateRootHash(block)
+	block.Header.EvidenceHash = HashEvidence(block.Evidence)
 
 	blockHash := HashBlock(block)
 	blockSig := pk.Sign(blockHash)
@@ -51,82 +48,96 @@ func HashHeader(h *proto.Header) []byte {
 	return hash[:]
 }
 
+// VerifyBlock checks the header signature and that the header's root hash commits to
+// exactly the transactions in the body
 func VerifyBlock(b *proto.Block) bool {
 
-	// if len(b.Transactions) > 0 {
-	// if !VerifyRootHash(b) {
-	// 	fmt.Println("\n*** >>> INVALID ROOT HASH <<< ***")
-	// 	return false
-	// }
-	// }
-
-	if len(b.PublicKey) != crypto.PubKeyLen {
-		fmt.Println("\n*** >>> INVALID PUBLIC KEY LENGTH <<< ***")
+	if !VerifyRootHash(b) {
 		return false
 	}
-	if len(b.Signature) != crypto.SignatureLen {
-		fmt.Println("\n*** >>> INVALID SIGNATURE LENGTH <<< ***")
+
+	return VerifyHeader(b.Header, b.PublicKey, b.Signature)
+}
+
+// VerifyHeader checks a header signature on its own, for when the body isn't at hand
+func VerifyHeader(h *proto.Header, pubKeyBytes []byte, sigBytes []byte) bool {
+
+	pubKey, err := crypto.PubKeyFromBytes(pubKeyBytes)
+	if err != nil {
 		return false
 	}
 
-	pubKey := crypto.PubKeyFromBytes(b.PublicKey)
-	sig := crypto.SignatureFromBytes(b.Signature)
-	hash := HashBlock(b)
+	sig, err := crypto.SignatureFromBytes(sigBytes)
+	if err != nil {
+		return false
+	}
 
-	return sig.Verify(pubKey, hash)
+	return sig.Verify(pubKey, HashHeader(h))
 }
 
 // -------------------------------------------------------
-type TxHash struct {
-	hash []byte
-}
+func VerifyRootHash(b *proto.Block) bool {
 
-func NewTxHash(h []byte) TxHash {
-	return TxHash{hash: h}
-}
+	if b.Header == nil {
+		return false
+	}
 
-func (h TxHash) CalculateHash() ([]byte, error) {
-	return h.hash, nil
+	return bytes.Equal(b.Header.RootHash, CalculateRootHash(b))
 }
 
-func (h TxHash) Equals(other merkletree.Content) (bool, error) {
-	equals := bytes.Equal(h.hash, other.(TxHash).hash)
-	return equals, nil
-}
+// CalculateRootHash is the merkle root of [b]'s transactions, EmptyRootHash if it has none
+func CalculateRootHash(b *proto.Block) []byte {
 
-func VerifyRootHash(b *proto.Block) bool {
+	builder := NewMerkleBuilder()
 
-	merkleTree, err := GetMerkleTree(b)
-	if err != nil {
-		return false
+	for _, tx := range b.Transactions {
+		builder.Add(HashTransaction(tx))
 	}
 
-	treeIsValid, err := merkleTree.VerifyTree()
+	return builder.Root()
+}
 
-	if err != nil || !treeIsValid {
-		return false
+func GetMerkleTree(b *proto.Block) *MerkleTree {
+
+	txHashes := make([][]byte, len(b.Transactions))
+
+	for i, tx := range b.Transactions {
+		txHashes[i] = HashTransaction(tx)
 	}
 
-	return bytes.Equal(b.Header.RootHash, merkleTree.MerkleRoot())
+	return NewMerkleTree(txHashes)
+}
+
+// GetMerkleProof proves the tx at [index] in [b] is committed to by the block's root hash
+func GetMerkleProof(b *proto.Block, index int) (*proto.MerkleProof, error) {
+	return GetMerkleTree(b).Proof(index)
 }
 
-func GetMerkleTree(b *proto.Block) (*merkletree.MerkleTree, error) {
+// -------------------------------------------------------
+// HashEvidence is what a header commits its block's evidence to - nil for none, so
+// blocks without any hash the same as they always have
+func HashEvidence(evidence []*proto.Evidence) []byte {
 
-	// if len(b.Transactions) == 0 {
+	if len(evidence) == 0 {
+		return nil
+	}
 
-	// }
+	hasher := sha256.New()
 
-	list := make([]merkletree.Content, len(b.Transactions))
+	for _, ev := range evidence {
 
-	for i := 0; i < len(b.Transactions); i++ {
-		txHash := HashTransaction(b.Transactions[i])
-		list[i] = NewTxHash(txHash)
-	}
+		b, err := pb.Marshal(ev)
+		if err != nil {
+			panic(err)
+		}
 
-	t, err := merkletree.NewTree(list)
-	if err != nil {
-		return nil, err
+		hash := sha256.Sum256(b)
+		hasher.Write(hash[:])
 	}
 
-	return t, nil
+	return hasher.Sum(nil)
+}
+
+func VerifyEvidenceHash(b *proto.Block) bool {
+	return b.Header != nil && bytes.Equal(b.Header.EvidenceHash, HashEvidence(b.Evidence))
 }
@@ -56,3 +56,114 @@ func TestCalculateRootHash(t *testing.T) {
 	// assert.Nil(t, err)
 	// fmt.Println("block -", len(block.Header.RootHash))
 }
+
+func TestVerifyBlockEmptyRoot(t *testing.T) {
+
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		block   = util.RandomBlock()
+	)
+
+	SignBlock(privKey, block)
+	assert.Equal(t, EmptyRootHash, block.Header.RootHash)
+	assert.True(t, VerifyBlock(block))
+
+	// A body slipped into a block signed as empty
+	block.Transactions = append(block.Transactions, &proto.Transaction{Version: 1})
+	assert.False(t, VerifyBlock(block))
+
+	// And an empty body on a header that committed to something else
+	block.Transactions = nil
+	block.Header.RootHash = util.RandomHash()
+	assert.False(t, VerifyRootHash(block))
+}
+
+func TestVerifyBlockRejectsTamperedTransactions(t *testing.T) {
+
+	privKey := crypto.GeneratePrivateKey()
+
+	signed := func() *proto.Block {
+		block := util.RandomBlock()
+		for i := 0; i < 3; i++ {
+			block.Transactions = append(block.Transactions, &proto.Transaction{
+				Version: 1,
+				Outputs: []*proto.TxOutput{{Amount: uint64(10 * (i + 1))}},
+			})
+		}
+		SignBlock(privKey, block)
+		return block
+	}
+
+	block := signed()
+	assert.True(t, VerifyBlock(block))
+
+	block.Transactions[1].Outputs[0].Amount++
+	assert.False(t, VerifyBlock(block))
+
+	block = signed()
+	block.Transactions = block.Transactions[:2]
+	assert.False(t, VerifyBlock(block))
+
+	block = signed()
+	block.Transactions = append(block.Transactions, &proto.Transaction{Version: 1})
+	assert.False(t, VerifyBlock(block))
+
+	block = signed()
+	block.Transactions[0], block.Transactions[2] = block.Transactions[2], block.Transactions[0]
+	assert.False(t, VerifyBlock(block))
+
+	// Re-rooting the header to match breaks the signature instead
+	block = signed()
+	block.Transactions[0].Version = 2
+	block.Header.RootHash = CalculateRootHash(block)
+	assert.True(t, VerifyRootHash(block))
+	assert.False(t, VerifyBlock(block))
+}
+
+func TestMerkleProof(t *testing.T) {
+
+	privKey := crypto.GeneratePrivateKey()
+
+	for n := 1; n <= 9; n++ {
+
+		block := util.RandomBlock()
+		for i := 0; i < n; i++ {
+			block.Transactions = append(block.Transactions, &proto.Transaction{
+				Version: 1,
+				Outputs: []*proto.TxOutput{{Amount: uint64(i)}},
+			})
+		}
+		SignBlock(privKey, block)
+
+		root := block.Header.RootHash
+
+		for i, tx := range block.Transactions {
+
+			proof, err := GetMerkleProof(block, i)
+			assert.Nil(t, err)
+
+			txHash := HashTransaction(tx)
+			assert.True(t, VerifyMerkleProof(root, txHash, proof), "n=%d i=%d", n, i)
+
+			// The proof is for this tx only, and only at this position
+			other := HashTransaction(block.Transactions[(i+1)%n])
+			if n > 1 {
+				assert.False(t, VerifyMerkleProof(root, other, proof))
+			}
+
+			flipped := &proto.MerkleProof{Siblings: proof.Siblings, Path: proof.Path ^ 1}
+			if len(proof.Siblings) > 0 {
+				assert.False(t, VerifyMerkleProof(root, txHash, flipped))
+			}
+
+			extra := &proto.MerkleProof{Siblings: proof.Siblings, Path: proof.Path | 1<<len(proof.Siblings)}
+			assert.False(t, VerifyMerkleProof(root, txHash, extra))
+		}
+
+		_, err := GetMerkleProof(block, n)
+		assert.NotNil(t, err)
+	}
+
+	assert.False(t, VerifyMerkleProof(EmptyRootHash, EmptyRootHash, &proto.MerkleProof{}))
+	assert.False(t, VerifyMerkleProof(EmptyRootHash, EmptyRootHash, nil))
+}
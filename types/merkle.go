@@ -0,0 +1,202 @@
+package types
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/i101dev/blocker/proto"
+)
+
+// -------------------------------------------------------
+// Merkle trees over the transaction hashes of a block
+//
+// Hashing follows RFC 6962 so that a leaf can never be passed off as an inner node or
+// the other way round:
+//
+//	leaf  = sha256(0x00 || txHash)
+//	inner = sha256(0x01 || left || right)
+//	empty = sha256()
+//
+// A node left without a partner at the end of a level is carried up to the next level
+// as it is - never paired with a copy of itself - so no two lists of transactions share
+// a root. The tree over n leaves splits at the largest power of two below n, same as
+// RFC 6962's MTH.
+
+const (
+	merkleLeafPrefix  byte = 0x00
+	merkleInnerPrefix byte = 0x01
+
+	// Deeper than any tree over a block's worth of transactions can get
+	maxMerkleDepth = 64
+)
+
+func MerkleLeafHash(txHash []byte) []byte {
+
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(txHash)
+
+	return h.Sum(nil)
+}
+
+func MerkleInnerHash(left []byte, right []byte) []byte {
+
+	h := sha256.New()
+	h.Write([]byte{merkleInnerPrefix})
+	h.Write(left)
+	h.Write(right)
+
+	return h.Sum(nil)
+}
+
+// -------------------------------------------------------
+// MerkleBuilder computes a root from leaves fed in one at a time, holding on to no more
+// than one subtree root per level
+type MerkleBuilder struct {
+	// Roots of the complete subtrees built so far, biggest first - their sizes are the
+	// set bits of [n]
+	stack [][]byte
+	n     int
+}
+
+func NewMerkleBuilder() *MerkleBuilder {
+	return &MerkleBuilder{}
+}
+
+func (b *MerkleBuilder) Add(txHash []byte) {
+
+	b.stack = append(b.stack, MerkleLeafHash(txHash))
+	b.n++
+
+	// Every trailing 1 bit of the new count is a pair of equal subtrees to merge
+	for n := b.n; n&1 == 0; n >>= 1 {
+		last := len(b.stack) - 1
+		b.stack = append(b.stack[:last-1], MerkleInnerHash(b.stack[last-1], b.stack[last]))
+	}
+}
+
+func (b *MerkleBuilder) Len() int {
+	return b.n
+}
+
+func (b *MerkleBuilder) Root() []byte {
+
+	if b.n == 0 {
+		return EmptyRootHash
+	}
+
+	root := b.stack[len(b.stack)-1]
+
+	for i := len(b.stack) - 2; i >= 0; i-- {
+		root = MerkleInnerHash(b.stack[i], root)
+	}
+
+	return root
+}
+
+// -------------------------------------------------------
+// MerkleTree keeps every level, for when proofs are needed as well as the root
+type MerkleTree struct {
+	levels [][][]byte // leaf hashes first, the root last
+}
+
+func NewMerkleTree(txHashes [][]byte) *MerkleTree {
+
+	level := make([][]byte, len(txHashes))
+	for i, txHash := range txHashes {
+		level[i] = MerkleLeafHash(txHash)
+	}
+
+	t := &MerkleTree{levels: [][][]byte{level}}
+
+	for len(level) > 1 {
+
+		next := make([][]byte, 0, (len(level)+1)/2)
+
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, MerkleInnerHash(level[i], level[i+1]))
+			}
+		}
+
+		t.levels = append(t.levels, next)
+		level = next
+	}
+
+	return t
+}
+
+func (t *MerkleTree) Len() int {
+	return len(t.levels[0])
+}
+
+func (t *MerkleTree) Root() []byte {
+
+	if t.Len() == 0 {
+		return EmptyRootHash
+	}
+
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Proof lists the siblings on the way from leaf [index] to the root, skipping the levels
+// where the node was carried up without one
+func (t *MerkleTree) Proof(index int) (*proto.MerkleProof, error) {
+
+	if index < 0 || index >= t.Len() {
+		return nil, fmt.Errorf("leaf index (%d) out of range - tree has (%d)", index, t.Len())
+	}
+
+	proof := &proto.MerkleProof{}
+
+	for _, level := range t.levels[:len(t.levels)-1] {
+
+		sibling := index ^ 1
+
+		if sibling < len(level) {
+
+			if index&1 == 1 {
+				proof.Path |= 1 << len(proof.Siblings)
+			}
+
+			proof.Siblings = append(proof.Siblings, level[sibling])
+		}
+
+		index >>= 1
+	}
+
+	return proof, nil
+}
+
+// VerifyMerkleProof checks [proof] leads from [txHash] up to [root]
+func VerifyMerkleProof(root []byte, txHash []byte, proof *proto.MerkleProof) bool {
+
+	if proof == nil || len(proof.Siblings) > maxMerkleDepth {
+		return false
+	}
+
+	// Bits past the last sibling mean nothing - a proof carrying them is malformed
+	if len(proof.Siblings) < maxMerkleDepth && proof.Path>>len(proof.Siblings) != 0 {
+		return false
+	}
+
+	hash := MerkleLeafHash(txHash)
+
+	for i, sibling := range proof.Siblings {
+
+		if len(sibling) != sha256.Size {
+			return false
+		}
+
+		if proof.Path&(1<<i) != 0 {
+			hash = MerkleInnerHash(sibling, hash)
+		} else {
+			hash = MerkleInnerHash(hash, sibling)
+		}
+	}
+
+	return bytes.Equal(hash, root)
+}
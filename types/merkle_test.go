@@ -0,0 +1,102 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/i101dev/blocker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// referenceRoot is RFC 6962's MTH, straight from the definition
+func referenceRoot(txHashes [][]byte) []byte {
+
+	switch len(txHashes) {
+	case 0:
+		return EmptyRootHash
+	case 1:
+		return MerkleLeafHash(txHashes[0])
+	}
+
+	k := 1
+	for k*2 < len(txHashes) {
+		k *= 2
+	}
+
+	return MerkleInnerHash(referenceRoot(txHashes[:k]), referenceRoot(txHashes[k:]))
+}
+
+func randomHashes(n int) [][]byte {
+
+	hashes := make([][]byte, n)
+	for i := range hashes {
+		hashes[i] = util.RandomHash()
+	}
+
+	return hashes
+}
+
+func TestMerkleBuilderMatchesTree(t *testing.T) {
+
+	for n := 0; n <= 70; n++ {
+
+		hashes := randomHashes(n)
+		builder := NewMerkleBuilder()
+
+		for _, h := range hashes {
+			builder.Add(h)
+		}
+
+		want := referenceRoot(hashes)
+
+		assert.Equal(t, n, builder.Len())
+		assert.Equal(t, want, builder.Root(), "n=%d", n)
+		assert.Equal(t, want, NewMerkleTree(hashes).Root(), "n=%d", n)
+	}
+}
+
+func TestMerkleTreeProofs(t *testing.T) {
+
+	for n := 1; n <= 33; n++ {
+
+		hashes := randomHashes(n)
+		tree := NewMerkleTree(hashes)
+
+		for i, h := range hashes {
+
+			proof, err := tree.Proof(i)
+			assert.Nil(t, err)
+			assert.True(t, VerifyMerkleProof(tree.Root(), h, proof), "n=%d i=%d", n, i)
+		}
+
+		_, err := tree.Proof(n)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestMerkleRejectsDuplicatedLastLeaf(t *testing.T) {
+
+	hashes := randomHashes(3)
+
+	// Pairing the odd leaf with itself would make these two lists share a root
+	padded := append(append([][]byte{}, hashes...), hashes[2])
+
+	assert.NotEqual(t, NewMerkleTree(hashes).Root(), NewMerkleTree(padded).Root())
+}
+
+func TestMerkleRejectsInnerNodeAsLeaf(t *testing.T) {
+
+	var (
+		hashes = randomHashes(4)
+		tree   = NewMerkleTree(hashes)
+		left   = MerkleInnerHash(MerkleLeafHash(hashes[0]), MerkleLeafHash(hashes[1]))
+		right  = MerkleInnerHash(MerkleLeafHash(hashes[2]), MerkleLeafHash(hashes[3]))
+	)
+
+	// Without domain separation, the left inner node would pass as a leaf one level up
+	proof, err := NewMerkleTree([][]byte{left, right}).Proof(0)
+	assert.Nil(t, err)
+	proof.Siblings[0] = right
+
+	assert.False(t, VerifyMerkleProof(tree.Root(), left, proof))
+	assert.Equal(t, tree.Root(), MerkleInnerHash(left, right))
+}
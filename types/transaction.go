@@ -26,25 +26,32 @@ func HashTransaction(tx *proto.Transaction) []byte {
 	return hash[:]
 }
 
+// VerifyTransaction checks every input's signature against the tx hashed with all of
+// them cleared, which is what SignTransaction signs before any are filled in
 func VerifyTransaction(tx *proto.Transaction) bool {
 
-	for _, input := range tx.Inputs {
+	unsigned := pb.Clone(tx).(*proto.Transaction)
+	for _, input := range unsigned.Inputs {
+		input.Signature = nil
+	}
 
-		if len(input.Signature) == 0 {
-			panic("the transaction has no signature")
-		}
+	hash := HashTransaction(unsigned)
 
-		sig := crypto.SignatureFromBytes(input.Signature)
-		pubKey := crypto.PubKeyFromBytes(input.PubKey)
+	for _, input := range tx.Inputs {
 
-		tempSig := input.Signature
-		input.Signature = nil
+		sig, err := crypto.SignatureFromBytes(input.Signature)
+		if err != nil {
+			return false
+		}
 
-		if !sig.Verify(pubKey, HashTransaction(tx)) {
+		pubKey, err := crypto.PubKeyFromBytes(input.PubKey)
+		if err != nil {
 			return false
 		}
 
-		input.Signature = tempSig
+		if !sig.Verify(pubKey, hash) {
+			return false
+		}
 	}
 
 	return true
@@ -0,0 +1,83 @@
+package types
+
+import (
+	"crypto/sha256"
+
+	"github.com/i101dev/blocker/crypto"
+	"github.com/i101dev/blocker/proto"
+
+	pb "google.golang.org/protobuf/proto"
+)
+
+// -------------------------------------------------------
+// BFT proposals and votes are signed over everything in them but the signature
+
+func HashVote(v *proto.Vote) []byte {
+
+	unsigned := pb.Clone(v).(*proto.Vote)
+	unsigned.Signature = nil
+
+	return hashMessage(unsigned)
+}
+
+func SignVote(pk *crypto.PrivateKey, v *proto.Vote) *crypto.Signature {
+
+	v.PublicKey = pk.PubKey().Bytes()
+	sig := pk.Sign(HashVote(v))
+	v.Signature = sig.Bytes()
+
+	return sig
+}
+
+func VerifyVote(v *proto.Vote) bool {
+	return verifyMessage(v.PublicKey, v.Signature, HashVote(v))
+}
+
+func HashProposal(p *proto.Proposal) []byte {
+
+	unsigned := pb.Clone(p).(*proto.Proposal)
+	unsigned.Signature = nil
+
+	return hashMessage(unsigned)
+}
+
+func SignProposal(pk *crypto.PrivateKey, p *proto.Proposal) *crypto.Signature {
+
+	p.PublicKey = pk.PubKey().Bytes()
+	sig := pk.Sign(HashProposal(p))
+	p.Signature = sig.Bytes()
+
+	return sig
+}
+
+func VerifyProposal(p *proto.Proposal) bool {
+	return verifyMessage(p.PublicKey, p.Signature, HashProposal(p))
+}
+
+func hashMessage(m pb.Message) []byte {
+
+	b, err := pb.Marshal(m)
+
+	if err != nil {
+		panic(err)
+	}
+
+	hash := sha256.Sum256(b)
+
+	return hash[:]
+}
+
+func verifyMessage(pubKeyBytes []byte, sigBytes []byte, hash []byte) bool {
+
+	pubKey, err := crypto.PubKeyFromBytes(pubKeyBytes)
+	if err != nil {
+		return false
+	}
+
+	sig, err := crypto.SignatureFromBytes(sigBytes)
+	if err != nil {
+		return false
+	}
+
+	return sig.Verify(pubKey, hash)
+}